@@ -1,11 +1,13 @@
 package lovedb
 
 import (
+	"context"
 	"encoding/binary"
 	"lovedb/data"
 	"lovedb/index"
 	"sync"
 	"sync/atomic"
+	"time"
 )
 
 var txnFinKey = []byte("txn-fin")
@@ -23,11 +25,6 @@ type WriteBatch struct {
 //初始化WriteBatch
 
 func (db *DB) NewWriteBatch(opts WriteBatchOption) *WriteBatch {
-	//如果索引类型为B+树，且不存在事务序列号文件，且不是第一次初始化目录，则无法使用原子写
-	if db.options.IndexType == index.BPTree && !db.seqNoFileExists && !db.isInitial {
-		panic("cannot use writeBatch, seqNo file not exists ")
-	}
-
 	return &WriteBatch{
 		options:       opts,
 		mu:            new(sync.Mutex),
@@ -76,6 +73,16 @@ func (wb *WriteBatch) Delete(key []byte) error {
 
 // Commit 提交事务：将暂存数据全部写到数据文件，并更新内存索引
 func (wb *WriteBatch) Commit() error {
+	return wb.CommitCtx(context.Background())
+}
+
+// CommitCtx 和Commit一样，写入每条记录之前检查ctx，写入事务结束记录以后不会再取消
+// 取消时返回ctx.Err()，已经写入的记录没有结束记录，不会更新到索引，暂存的数据保留，可以重新提交
+func (wb *WriteBatch) CommitCtx(ctx context.Context) (err error) {
+	start := time.Now()
+	defer func() {
+		wb.db.metrics.batchCommit.observe(start, err)
+	}()
 	wb.mu.Lock()
 	defer wb.mu.Unlock()
 
@@ -94,10 +101,16 @@ func (wb *WriteBatch) Commit() error {
 	pos := make(map[string]*data.LogRecordPos)
 	//开始写数据到数据文件当中
 	for _, record := range wb.pendingWrites {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
 		logRecordPos, err := wb.db.appendLogRecord(&data.LogRecord{
-			Key:   LogRecordKeyWithSeq(record.Key, seqNo),
+			Key:   record.Key,
 			Value: record.Value,
 			Type:  record.Type,
+			SeqNo: seqNo,
 		})
 		if err != nil {
 			return err
@@ -107,33 +120,52 @@ func (wb *WriteBatch) Commit() error {
 	}
 	//一条表示fin的记录，说明批量数据正确，若没有可能中间发生错误，全部丢弃
 	finLogRecord := &data.LogRecord{
-		Key:  LogRecordKeyWithSeq(txnFinKey, seqNo),
-		Type: data.LogRecordFinished,
+		Key:   txnFinKey,
+		Type:  data.LogRecordFinished,
+		SeqNo: seqNo,
 	}
-	_, err := wb.db.appendLogRecord(finLogRecord)
+	_, err = wb.db.appendLogRecord(finLogRecord)
 	if err != nil {
 		return err
 	}
-
 	//根据配置判断是否持久化
 	if wb.options.SyncWrites && wb.db.activeFile != nil {
-		err := wb.db.activeFile.Sync()
+		err := wb.db.syncDataFile(wb.db.activeFile)
 		if err != nil {
 			return err
 		}
 	}
 	//更新内存索引即可
+	records := make([]*data.LogRecord, 0, len(wb.pendingWrites))
+	ops := make([]index.BatchOp, 0, len(wb.pendingWrites))
 	for _, record := range wb.pendingWrites {
-		position := pos[string(record.Key)]
-		var oldValue *data.LogRecordPos
-		if record.Type == data.LogRecordNormal {
-			oldValue = wb.db.index.Put(record.Key, position)
-		}
+		records = append(records, record)
+		ops = append(ops, index.BatchOp{
+			Key:    record.Key,
+			Pos:    pos[string(record.Key)],
+			Delete: record.Type == data.LogRecordDeleted,
+		})
+	}
+	//b+树索引不会在启动时读取数据文件，和索引一起持久化事务序列号，没有正常关闭也能知道最新的序列号
+	oldPositions, err := wb.db.applyIndexBatch(ops, seqNo)
+	if err != nil {
+		return err
+	}
+	for i, record := range records {
+		position, oldValue := ops[i].Pos, oldPositions[i]
 		if record.Type == data.LogRecordDeleted {
-			oldValue, _ = wb.db.index.Delete(record.Key)
+			//和Delete一样，删除的这条记录本身也可以被清理
+			wb.db.reclaimSize += int64(position.Size)
+			wb.db.ops.deletes.Add(1)
+		} else {
+			wb.db.ops.puts.Add(1)
 		}
 		if oldValue != nil {
 			wb.db.reclaimSize += int64(oldValue.Size)
+			wb.db.removeCache(oldValue)
+		}
+		if record.Type == data.LogRecordNormal && wb.db.cache != nil {
+			wb.db.cache.Put(position, record.Value)
 		}
 	}
 	//重置暂存空间
@@ -141,7 +173,30 @@ func (wb *WriteBatch) Commit() error {
 	return nil
 }
 
+// 批量更新索引，支持批量更新的索引在一个事务中完成，其余的索引逐个更新
+// seqNo不为0时和索引一起持久化事务序列号
+func (db *DB) applyIndexBatch(ops []index.BatchOp, seqNo uint64) ([]*data.LogRecordPos, error) {
+	if batcher, ok := db.index.(index.BatchIndexer); ok {
+		return batcher.ApplyBatch(ops, seqNo)
+	}
+	oldPositions := make([]*data.LogRecordPos, len(ops))
+	for i, op := range ops {
+		if op.Delete {
+			oldPositions[i], _ = db.index.Delete(op.Key)
+		} else {
+			oldPositions[i] = db.index.Put(op.Key, op.Pos)
+		}
+	}
+	if store, ok := db.index.(index.SeqNoStore); ok && seqNo > 0 {
+		if err := store.SaveSeqNo(seqNo); err != nil {
+			return nil, err
+		}
+	}
+	return oldPositions, nil
+}
+
 // LogRecordKeyWithSeq 将 seqNo 与 key 组合成一个新的字节数组，并返回该组合后的键。
+// 这是v1格式数据文件中key的编码方式，v2格式的seqNo单独存放在记录的header中
 func LogRecordKeyWithSeq(key []byte, seqNo uint64) []byte {
 	//使用变长编码存储seqNo
 	seq := make([]byte, binary.MaxVarintLen64)
@@ -154,7 +209,7 @@ func LogRecordKeyWithSeq(key []byte, seqNo uint64) []byte {
 	return encKey
 }
 
-// ParseLogRecordKey 解析key，拿到真正的key和事务id
+// ParseLogRecordKey 解析v1格式的key，拿到真正的key和事务id
 func ParseLogRecordKey(key []byte) ([]byte, uint64) {
 	seq, n := binary.Uvarint(key)
 	realKey := key[n:]
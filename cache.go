@@ -0,0 +1,112 @@
+package lovedb
+
+import (
+	"container/list"
+	"lovedb/data"
+	"sync"
+)
+
+// 每个缓存项除了value本身以外额外占用的内存，粗略估计
+const cacheEntryOverhead = 64
+
+// valueCache value的LRU缓存，key为数据在文件中的位置(文件id + 偏移量)
+// 同一个位置的数据写入以后就不会再变化，所以缓存不会读到旧的数据，
+// 删除或者覆盖key以后旧位置的缓存项就没有用了，需要主动清除来释放内存
+type valueCache struct {
+	mu       *sync.Mutex
+	capacity int64                      //缓存占用内存的上限，字节为单位
+	size     int64                      //当前缓存占用的内存
+	ll       *list.List                 //最近使用的在链表头部
+	items    map[cacheKey]*list.Element //位置 -> 链表节点
+	hits     uint64                     //命中次数
+	misses   uint64                     //未命中次数
+}
+
+type cacheKey struct {
+	fid    uint32
+	offset int64
+}
+
+type cacheEntry struct {
+	key   cacheKey
+	value []byte
+}
+
+func newValueCache(capacity int64) *valueCache {
+	return &valueCache{
+		mu:       new(sync.Mutex),
+		capacity: capacity,
+		ll:       list.New(),
+		items:    make(map[cacheKey]*list.Element),
+	}
+}
+
+// Get 获取缓存的value，返回的是一份拷贝
+func (c *valueCache) Get(pos *data.LogRecordPos) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.items[cacheKey{fid: pos.Fid, offset: pos.Offset}]
+	if !ok {
+		c.misses++
+		return nil, false
+	}
+	c.hits++
+	c.ll.MoveToFront(elem)
+	value := elem.Value.(*cacheEntry).value
+	return append([]byte{}, value...), true
+}
+
+// Put 缓存value，超过内存上限时淘汰最久没有使用的数据
+func (c *valueCache) Put(pos *data.LogRecordPos, value []byte) {
+	entrySize := int64(len(value)) + cacheEntryOverhead
+	//单个value比整个缓存还大，不缓存
+	if entrySize > c.capacity {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key := cacheKey{fid: pos.Fid, offset: pos.Offset}
+	if elem, ok := c.items[key]; ok {
+		c.ll.MoveToFront(elem)
+		return
+	}
+	entry := &cacheEntry{key: key, value: append([]byte{}, value...)}
+	c.items[key] = c.ll.PushFront(entry)
+	c.size += entrySize
+	for c.size > c.capacity {
+		c.removeElement(c.ll.Back())
+	}
+}
+
+// Remove 清除某个位置的缓存
+func (c *valueCache) Remove(pos *data.LogRecordPos) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.items[cacheKey{fid: pos.Fid, offset: pos.Offset}]; ok {
+		c.removeElement(elem)
+	}
+}
+
+// RemoveFiles 清除文件id小于fid的所有缓存，merge删除旧的数据文件以后调用
+func (c *valueCache) RemoveFiles(fid uint32) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key, elem := range c.items {
+		if key.fid < fid {
+			c.removeElement(elem)
+		}
+	}
+}
+
+// Stats 返回命中和未命中的次数
+func (c *valueCache) Stats() (hits, misses uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.hits, c.misses
+}
+
+func (c *valueCache) removeElement(elem *list.Element) {
+	entry := c.ll.Remove(elem).(*cacheEntry)
+	delete(c.items, entry.key)
+	c.size -= int64(len(entry.value)) + cacheEntryOverhead
+}
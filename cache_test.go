@@ -0,0 +1,42 @@
+package lovedb
+
+import (
+	"github.com/stretchr/testify/assert"
+	"lovedb/data"
+	"testing"
+)
+
+func TestValueCache_Evict(t *testing.T) {
+	//只能放下两个缓存项
+	c := newValueCache(2*cacheEntryOverhead + 20)
+	pos1 := &data.LogRecordPos{Fid: 1, Offset: 0}
+	pos2 := &data.LogRecordPos{Fid: 1, Offset: 100}
+	pos3 := &data.LogRecordPos{Fid: 2, Offset: 0}
+	c.Put(pos1, []byte("value-1"))
+	c.Put(pos2, []byte("value-2"))
+
+	//访问pos1以后pos2变成最久没有使用的，放入pos3时淘汰pos2
+	_, ok := c.Get(pos1)
+	assert.True(t, ok)
+	c.Put(pos3, []byte("value-3"))
+	_, ok = c.Get(pos2)
+	assert.False(t, ok)
+	val, ok := c.Get(pos3)
+	assert.True(t, ok)
+	assert.Equal(t, []byte("value-3"), val)
+
+	//太大的value不缓存
+	c.Put(&data.LogRecordPos{Fid: 3}, make([]byte, 1024))
+	assert.Equal(t, 2, c.ll.Len())
+
+	//清除merge删除的文件
+	c.RemoveFiles(2)
+	_, ok = c.Get(pos1)
+	assert.False(t, ok)
+	_, ok = c.Get(pos3)
+	assert.True(t, ok)
+
+	hits, misses := c.Stats()
+	assert.Equal(t, uint64(3), hits)
+	assert.Equal(t, uint64(2), misses)
+}
@@ -0,0 +1,206 @@
+package lovedb
+
+import (
+	"encoding/binary"
+	"lovedb/data"
+	"lovedb/index"
+	"path/filepath"
+	"time"
+)
+
+// 内存索引的快照(checkpoint)，关闭数据库时写入，也可以按照IndexCheckpointInterval定时写入
+// 快照中保存了所有key的位置，以及写入快照时活跃文件的末尾位置(高水位)、事务序列号和可回收的数据量，
+// 启动时加载快照以后只需要读取高水位之后的记录
+// 快照的最后是一条结束记录，没有结束记录、高水位超出了数据文件或者位置指向不存在的文件的快照都会被忽略
+// merge和migrate会改变记录的位置，完成时会删除快照
+
+const indexCheckpointEndKey = "checkpoint-end"
+
+// 快照结束记录中保存的信息
+type indexCheckpointMeta struct {
+	mark        *data.LogRecordPos //高水位，之前的记录都已经包含在快照中
+	seqNo       uint64
+	reclaimSize int64
+}
+
+func encodeIndexCheckpointMeta(meta *indexCheckpointMeta) []byte {
+	buf := make([]byte, binary.MaxVarintLen64*4)
+	index := 0
+	index += binary.PutUvarint(buf[index:], uint64(meta.mark.Fid))
+	index += binary.PutVarint(buf[index:], meta.mark.Offset)
+	index += binary.PutUvarint(buf[index:], meta.seqNo)
+	index += binary.PutVarint(buf[index:], meta.reclaimSize)
+	return buf[:index]
+}
+
+func decodeIndexCheckpointMeta(buf []byte) (*indexCheckpointMeta, bool) {
+	index := 0
+	fid, n := binary.Uvarint(buf[index:])
+	if n <= 0 {
+		return nil, false
+	}
+	index += n
+	offset, n := binary.Varint(buf[index:])
+	if n <= 0 {
+		return nil, false
+	}
+	index += n
+	seqNo, n := binary.Uvarint(buf[index:])
+	if n <= 0 {
+		return nil, false
+	}
+	index += n
+	reclaimSize, n := binary.Varint(buf[index:])
+	if n <= 0 {
+		return nil, false
+	}
+	return &indexCheckpointMeta{
+		mark:        &data.LogRecordPos{Fid: uint32(fid), Offset: offset},
+		seqNo:       seqNo,
+		reclaimSize: reclaimSize,
+	}, true
+}
+
+// 写入内存索引的快照，需要在持有锁的情况下调用，读锁就可以阻止写入
+func (db *DB) writeIndexCheckpoint() (err error) {
+	if db.activeFile == nil || !db.options.IndexCheckpoint || db.options.IndexType == index.BPTree {
+		return nil
+	}
+	//高水位之前的数据需要先持久化
+	if err := db.syncDataFile(db.activeFile); err != nil {
+		return err
+	}
+	//先删除旧的快照，写入过程中崩溃了就没有可用的快照，启动时会读取全部的数据文件
+	fileName := filepath.Join(db.options.DirPath, data.IndexCheckpointName)
+	if db.fs.Exists(fileName) {
+		if err := db.fs.Remove(fileName); err != nil {
+			return err
+		}
+	}
+	checkpointFile, err := data.OpenIndexCheckpointFile(db.options.DirPath, db.fileIOType(), db.options.Checksum, db.options.IOOpener)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = checkpointFile.Close()
+		if err != nil {
+			_ = db.fs.Remove(fileName)
+		}
+	}()
+
+	var buf []byte
+	it := db.index.Iterator(false)
+	for it.Rewind(); it.Valid(); it.Next() {
+		encRecord, _ := data.EncodeLogRecord(&data.LogRecord{
+			Key:   it.Key(),
+			Value: data.EncodeLogRecordPos(it.Value()),
+		}, checkpointFile.Checksum)
+		buf = append(buf, encRecord...)
+		if len(buf) >= dataHintWriteSize {
+			if err := checkpointFile.Write(buf); err != nil {
+				it.Close()
+				return err
+			}
+			buf = buf[:0]
+		}
+	}
+	it.Close()
+
+	//结束记录使用fin类型，和索引中的记录区分开
+	endRecord, _ := data.EncodeLogRecord(&data.LogRecord{
+		Key: []byte(indexCheckpointEndKey),
+		Value: encodeIndexCheckpointMeta(&indexCheckpointMeta{
+			mark:        &data.LogRecordPos{Fid: db.activeFile.FileId, Offset: db.activeFile.WriteOff},
+			seqNo:       db.seqNo,
+			reclaimSize: db.reclaimSize,
+		}),
+		Type: data.LogRecordFinished,
+	}, checkpointFile.Checksum)
+	buf = append(buf, endRecord...)
+	if err := checkpointFile.Write(buf); err != nil {
+		return err
+	}
+	return checkpointFile.Sync()
+}
+
+// 加载内存索引的快照，返回快照的高水位，没有可用的快照时返回nil，索引不会被修改
+func (db *DB) loadIndexCheckpoint() *data.LogRecordPos {
+	fileName := filepath.Join(db.options.DirPath, data.IndexCheckpointName)
+	if !db.fs.Exists(fileName) {
+		return nil
+	}
+	checkpointFile, err := data.OpenIndexCheckpointFile(db.options.DirPath, db.fileIOType(), db.options.Checksum, db.options.IOOpener)
+	if err != nil {
+		return nil
+	}
+	defer func() {
+		_ = checkpointFile.Close()
+	}()
+
+	//先读出所有的记录，确认快照可用以后再更新索引
+	var keys [][]byte
+	var positions []*data.LogRecordPos
+	var meta *indexCheckpointMeta
+	offset := checkpointFile.HeaderSize()
+	for meta == nil {
+		logRecord, n, err := checkpointFile.ReadLogRecord(offset)
+		if err != nil {
+			return nil
+		}
+		offset += n
+		if logRecord.Type == data.LogRecordFinished {
+			var ok bool
+			if meta, ok = decodeIndexCheckpointMeta(logRecord.Value); !ok {
+				return nil
+			}
+			continue
+		}
+		pos := data.DecodeLogRecordPos(logRecord.Value)
+		if db.getDataFile(pos.Fid) == nil {
+			return nil
+		}
+		keys = append(keys, logRecord.Key)
+		positions = append(positions, pos)
+	}
+
+	//高水位需要在数据文件的范围内，并且所有的位置都在高水位之前
+	markFile := db.getDataFile(meta.mark.Fid)
+	if markFile == nil {
+		return nil
+	}
+	size, err := markFile.IoManager.Size()
+	if err != nil || meta.mark.Offset < markFile.HeaderSize() || meta.mark.Offset > size {
+		return nil
+	}
+	for _, pos := range positions {
+		if pos.Fid > meta.mark.Fid || (pos.Fid == meta.mark.Fid && pos.Offset >= meta.mark.Offset) {
+			return nil
+		}
+	}
+
+	for i, key := range keys {
+		db.index.Put(key, positions[i])
+	}
+	db.seqNo = meta.seqNo
+	db.reclaimSize = meta.reclaimSize
+	return meta.mark
+}
+
+// 定时写入内存索引的快照，直到关闭数据库
+func (db *DB) runIndexCheckpoint(interval time.Duration, stop <-chan struct{}, done chan<- struct{}) {
+	defer close(done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			db.mu.RLock()
+			if err := db.writeIndexCheckpoint(); err != nil {
+				db.logger.Warnf("failed to write index checkpoint: %v", err)
+			}
+			db.mu.RUnlock()
+		case <-stop:
+			return
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package lovedb
+
+import (
+	"github.com/stretchr/testify/assert"
+	"lovedb/data"
+	"lovedb/fio"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDB_IndexCheckpoint(t *testing.T) {
+	t.Parallel()
+	db, opts := openInMemoryDB(t)
+	for i := 0; i < 2000; i++ {
+		assert.Nil(t, db.Put(testKey(i), testValue(i)))
+	}
+	wb := db.NewWriteBatch(DefaultWriteBatchOptions)
+	for i := 0; i < 500; i++ {
+		assert.Nil(t, wb.Delete(testKey(i)))
+	}
+	assert.Nil(t, wb.Commit())
+	assert.Nil(t, db.Close())
+	checkpointFileName := filepath.Join(opts.DirPath, data.IndexCheckpointName)
+	assert.True(t, fio.MemFileSystem.Exists(checkpointFileName))
+
+	check := func(n int) (int64, uint64) {
+		db, err := Open(opts)
+		assert.Nil(t, err)
+		for i := 0; i < n; i++ {
+			val, err := db.Get(testKey(i))
+			if i < 500 {
+				assert.Equal(t, ErrKeyNotFound, err)
+			} else {
+				assert.Nil(t, err)
+				assert.Equal(t, testValue(i), val)
+			}
+		}
+		stat, err := db.Stat()
+		assert.Nil(t, err)
+		assert.Equal(t, n-500, int(stat.KeyNum))
+		reclaimSize, seqNo := db.reclaimSize, db.seqNo
+		assert.Nil(t, db.Close())
+		return reclaimSize, seqNo
+	}
+	reclaimSize, seqNo := check(2000)
+	assert.Equal(t, uint64(1), seqNo)
+
+	//快照之后写入的记录需要从数据文件中读取
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	for i := 2000; i < 3000; i++ {
+		assert.Nil(t, db.Put(testKey(i), testValue(i)))
+	}
+	wb = db.NewWriteBatch(DefaultWriteBatchOptions)
+	assert.Nil(t, wb.Put(testKey(2999), testValue(2999)))
+	assert.Nil(t, wb.Commit())
+	assert.Nil(t, db.Close())
+	reclaimSize, seqNo = check(3000)
+	assert.Equal(t, uint64(2), seqNo)
+
+	//快照损坏时读取所有的数据文件，结果相同
+	checkpointFile, err := fio.NewMemoryIOManager(checkpointFileName)
+	assert.Nil(t, err)
+	size, err := checkpointFile.Size()
+	assert.Nil(t, err)
+	assert.Nil(t, checkpointFile.Truncate(size-3))
+	opts.IndexCheckpoint = false
+	reclaimSize2, seqNo2 := check(3000)
+	assert.Equal(t, reclaimSize, reclaimSize2)
+	assert.Equal(t, seqNo, seqNo2)
+
+	//定时写入快照
+	assert.Nil(t, fio.MemFileSystem.Remove(checkpointFileName))
+	opts.IndexCheckpoint = true
+	opts.IndexCheckpointInterval = 10 * time.Millisecond
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	assert.Nil(t, db.Put(testKey(0), testValue(0)))
+	assert.Eventually(t, func() bool {
+		return fio.MemFileSystem.Exists(checkpointFileName)
+	}, time.Second, 10*time.Millisecond)
+	assert.Nil(t, db.Delete(testKey(0)))
+
+	//merge之后快照中的位置不能再使用
+	assert.Nil(t, db.Merge())
+	assert.Nil(t, db.Close())
+	//再次关闭不会重复关闭通知快照协程退出的channel
+	assert.NotPanics(t, func() {
+		assert.Nil(t, db.Close())
+	})
+	check(3000)
+}
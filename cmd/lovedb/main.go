@@ -0,0 +1,83 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"lovedb"
+	"os"
+	"strings"
+)
+
+// lovedb 命令行工具，用于离线维护数据目录
+//
+//	lovedb migrate <dir>                                                把数据目录中旧格式的文件重写为当前格式
+//	lovedb reindex --to=btree|art|bptree|skiplist|hash|compact <dir>    切换数据目录的索引类型
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+	switch os.Args[1] {
+	case "migrate":
+		migrate(os.Args[2:])
+	case "reindex":
+		reindex(os.Args[2:])
+	default:
+		usage()
+	}
+}
+
+func migrate(args []string) {
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: lovedb migrate <dir>")
+	}
+	_ = fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	if err := lovedb.Migrate(fs.Arg(0)); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to migrate %s: %v\n", fs.Arg(0), err)
+		os.Exit(1)
+	}
+	fmt.Printf("migrated %s\n", fs.Arg(0))
+}
+
+func reindex(args []string) {
+	fs := flag.NewFlagSet("reindex", flag.ExitOnError)
+	to := fs.String("to", "", "the index type to switch to: "+strings.Join(lovedb.IndexTypeNames(), ", "))
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: lovedb reindex --to=%s <dir>\n", indexTypes())
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+	if fs.NArg() != 1 || *to == "" {
+		fs.Usage()
+		os.Exit(2)
+	}
+	typ, err := lovedb.ParseIndexType(*to)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid index type %q: %v\n", *to, err)
+		os.Exit(2)
+	}
+	if err := lovedb.Reindex(fs.Arg(0), typ); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to reindex %s: %v\n", fs.Arg(0), err)
+		os.Exit(1)
+	}
+	fmt.Printf("reindexed %s to %s\n", fs.Arg(0), *to)
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: lovedb <command> [arguments]")
+	fmt.Fprintln(os.Stderr, "commands:")
+	fmt.Fprintln(os.Stderr, "  migrate <dir>")
+	fmt.Fprintln(os.Stderr, "        rewrite the data files of dir to the current format")
+	fmt.Fprintf(os.Stderr, "  reindex --to=%s <dir>\n", indexTypes())
+	fmt.Fprintln(os.Stderr, "        switch the index type of dir")
+	os.Exit(2)
+}
+
+// 用法中列出的索引类型，和ParseIndexType接受的名称一致
+func indexTypes() string {
+	return strings.Join(lovedb.IndexTypeNames(), "|")
+}
@@ -0,0 +1,118 @@
+package lovedb
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDB_ContextCanceled(t *testing.T) {
+	t.Parallel()
+	db, _ := openInMemoryDB(t)
+	defer func() {
+		assert.Nil(t, db.Close())
+	}()
+	for i := 0; i < 2000; i++ {
+		assert.Nil(t, db.Put(testKey(i), testValue(i)))
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	keys, err := db.ListKeysCtx(ctx)
+	assert.Equal(t, context.Canceled, err)
+	assert.Nil(t, keys)
+	keys, err = db.ListKeysCtx(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, 2000, len(keys))
+
+	//遍历到一半时取消
+	foldCtx, foldCancel := context.WithCancel(context.Background())
+	var count int
+	err = db.FoldCtx(foldCtx, func(key []byte, value []byte) bool {
+		count++
+		if count == 10 {
+			foldCancel()
+		}
+		return true
+	})
+	assert.Equal(t, context.Canceled, err)
+	assert.Equal(t, 10, count)
+
+	it := db.NewIteratorCtx(ctx, DefaultIteratorOptions)
+	assert.False(t, it.Valid())
+	assert.Equal(t, context.Canceled, it.Err())
+	it.Close()
+
+	iterCtx, iterCancel := context.WithCancel(context.Background())
+	it = db.NewIteratorCtx(iterCtx, DefaultIteratorOptions)
+	assert.True(t, it.Valid())
+	it.Next()
+	assert.True(t, it.Valid())
+	iterCancel()
+	it.Next()
+	assert.False(t, it.Valid())
+	assert.Equal(t, context.Canceled, it.Err())
+	it.Close()
+
+	//取消的提交不会更新索引，暂存的数据可以重新提交
+	wb := db.NewWriteBatch(DefaultWriteBatchOptions)
+	assert.Nil(t, wb.Put(testKey(5000), testValue(5000)))
+	assert.Nil(t, wb.Delete(testKey(0)))
+	assert.Equal(t, context.Canceled, wb.CommitCtx(ctx))
+	_, err = db.Get(testKey(5000))
+	assert.Equal(t, ErrKeyNotFound, err)
+	_, err = db.Get(testKey(0))
+	assert.Nil(t, err)
+	assert.Nil(t, wb.CommitCtx(context.Background()))
+	_, err = db.Get(testKey(5000))
+	assert.Nil(t, err)
+	_, err = db.Get(testKey(0))
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	//merge到一半时取消，不会留下merge目录
+	assert.Equal(t, context.Canceled, db.MergeCtx(ctx))
+	assert.Equal(t, context.Canceled, db.MergeCtx(newCountdownContext(100)))
+	assert.False(t, db.fs.Exists(db.getMergePath()))
+	assert.Equal(t, 2000, len(db.ListKeys()))
+	assert.Nil(t, db.Merge())
+
+	//取消的备份删除新建的备份目录
+	backupDir := filepath.Join(t.TempDir(), "backup")
+	assert.Equal(t, context.Canceled, db.BackUpCtx(ctx, backupDir))
+	_, err = os.Stat(backupDir)
+	assert.True(t, os.IsNotExist(err))
+	assert.Nil(t, db.BackUpCtx(context.Background(), backupDir))
+	entries, err := os.ReadDir(backupDir)
+	assert.Nil(t, err)
+	assert.True(t, len(entries) > 0)
+}
+
+// 检查了n次以后取消的context，只能在一个协程中使用
+type countdownContext struct {
+	context.Context
+	n    int
+	done chan struct{}
+}
+
+func newCountdownContext(n int) *countdownContext {
+	done := make(chan struct{})
+	close(done)
+	return &countdownContext{Context: context.Background(), n: n, done: done}
+}
+
+func (c *countdownContext) Done() <-chan struct{} {
+	if c.n > 0 {
+		c.n--
+		return nil
+	}
+	return c.done
+}
+
+func (c *countdownContext) Err() error {
+	if c.n > 0 {
+		return nil
+	}
+	return context.Canceled
+}
@@ -0,0 +1,157 @@
+package lovedb
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"lovedb/fio"
+	"math/rand"
+	"path/filepath"
+	"testing"
+)
+
+// 复现失败的崩溃测试时，用失败时日志中的种子运行：go test -run CrashConsistency -crash-seed=<seed>
+var crashSeed = flag.Int64("crash-seed", 0, "random seed of the crash consistency test, 0 means a random seed")
+
+// 崩溃一致性测试：随机执行Put/Delete/WriteBatch/Merge，在随机的位置注入写入故障并模拟掉电，
+// 重新打开以后检查：已经提交的数据都在，没有提交的批次完全不可见，没有凭空出现的key
+func TestDB_CrashConsistency(t *testing.T) {
+	t.Run("InMemory", func(t *testing.T) {
+		t.Parallel()
+		opts := DefaultOptions
+		opts.DirPath = filepath.Join("/lovedb-crash", t.Name())
+		opts.InMemory = true
+		t.Cleanup(func() {
+			_ = fio.MemFileSystem.RemoveAll(opts.DirPath)
+		})
+		testCrashConsistency(t, opts, 2000)
+	})
+	t.Run("Disk", func(t *testing.T) {
+		t.Parallel()
+		opts := DefaultOptions
+		opts.DirPath = filepath.Join(t.TempDir(), "lovedb")
+		testCrashConsistency(t, opts, 500)
+	})
+}
+
+func testCrashConsistency(t *testing.T, opts Options, rounds int) {
+	seed := *crashSeed
+	if seed == 0 {
+		seed = rand.Int63()
+	}
+	t.Logf("seed: %d", seed)
+	rnd := rand.New(rand.NewSource(seed))
+
+	opts.SyncWrite = true
+	opts.DataFileSize = 16 * 1024
+	opts.DataFileMergeRatio = 0
+	inj := fio.NewFaultInjector()
+	opts.IOOpener = inj.Opener()
+
+	db, err := Open(opts)
+	assert.Nil(t, err)
+
+	//已经提交的数据
+	model := make(map[string][]byte)
+	var crashes int
+	for round := 0; round < rounds; round++ {
+		//随机选一个位置注入写入故障
+		if rnd.Intn(20) == 0 {
+			if rnd.Intn(2) == 0 {
+				inj.FailWriteAt(rnd.Intn(30) + 1)
+			} else {
+				inj.ShortWriteAt(rnd.Intn(30) + 1)
+			}
+		}
+
+		err := crashTestOp(rnd, db, model)
+		if err == nil && !inj.Crashed() {
+			continue
+		}
+		//写入失败，进程崩溃，掉电丢失没有持久化的数据，进程退出时释放目录锁
+		crashes++
+		assert.Nil(t, inj.PowerLoss(rnd))
+		assert.Nil(t, db.unlockDir())
+		db, err = Open(opts)
+		if !assert.Nil(t, err, "seed: %d", seed) {
+			return
+		}
+		if !checkCrashModel(t, db, model) {
+			t.Fatalf("inconsistent after crash %d, seed: %d", crashes, seed)
+		}
+	}
+	//正常关闭时不再注入故障
+	inj.FailWriteAt(0)
+	assert.Nil(t, db.Close())
+	assert.Nil(t, inj.PowerLoss(nil))
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	checkCrashModel(t, db, model)
+	assert.Nil(t, db.Close())
+	t.Logf("crashes: %d, keys: %d", crashes, len(model))
+}
+
+// 随机执行一个操作，操作成功时更新已提交的数据
+func crashTestOp(rnd *rand.Rand, db *DB, model map[string][]byte) error {
+	key := []byte(fmt.Sprintf("key-%03d", rnd.Intn(200)))
+	switch n := rnd.Intn(100); {
+	case n < 50:
+		value := []byte(fmt.Sprintf("value-%d", rnd.Int()))
+		if err := db.Put(key, value); err != nil {
+			return err
+		}
+		model[string(key)] = value
+	case n < 70:
+		if err := db.Delete(key); err != nil {
+			return err
+		}
+		delete(model, string(key))
+	case n < 98:
+		wb := db.NewWriteBatch(DefaultWriteBatchOptions)
+		pending := make(map[string][]byte)
+		for i := rnd.Intn(10) + 1; i > 0; i-- {
+			key := []byte(fmt.Sprintf("key-%03d", rnd.Intn(200)))
+			if rnd.Intn(4) == 0 {
+				_ = wb.Delete(key)
+				pending[string(key)] = nil
+			} else {
+				value := []byte(fmt.Sprintf("batch-%d", rnd.Int()))
+				_ = wb.Put(key, value)
+				pending[string(key)] = value
+			}
+		}
+		if err := wb.Commit(); err != nil {
+			return err
+		}
+		for k, v := range pending {
+			if v == nil {
+				delete(model, k)
+			} else {
+				model[k] = v
+			}
+		}
+	default:
+		if err := db.Merge(); err != nil && err != ErrMergeRatioUnreached {
+			return err
+		}
+	}
+	return nil
+}
+
+// 数据库中的数据和已提交的数据完全一致
+func checkCrashModel(t *testing.T, db *DB, model map[string][]byte) bool {
+	ok := true
+	for k, v := range model {
+		value, err := db.Get([]byte(k))
+		ok = assert.Nil(t, err, "committed key %s lost", k) && ok
+		ok = assert.True(t, bytes.Equal(v, value), "committed key %s has value %s, want %s", k, value, v) && ok
+	}
+	keys := db.ListKeys()
+	ok = assert.Equal(t, len(model), len(keys)) && ok
+	for _, k := range keys {
+		_, found := model[string(k)]
+		ok = assert.True(t, found, "phantom key %s", k) && ok
+	}
+	return ok
+}
@@ -0,0 +1,42 @@
+package data
+
+import (
+	"errors"
+	"hash/crc32"
+)
+
+// ChecksumType 记录的校验算法，保存在文件头中，同一个文件中的记录使用相同的算法
+type ChecksumType = byte
+
+const (
+	// ChecksumIEEE crc32 IEEE，v1格式的文件只能使用这种算法
+	ChecksumIEEE ChecksumType = iota
+
+	// ChecksumCRC32C crc32 Castagnoli，大多数cpu有硬件指令加速
+	ChecksumCRC32C
+)
+
+var ErrUnsupportedChecksum = errors.New("unsupported checksum type")
+
+var castagnoliTable = crc32.MakeTable(crc32.Castagnoli)
+
+// 校验算法对应的crc表
+func checksumTable(checksum ChecksumType) (*crc32.Table, error) {
+	switch checksum {
+	case ChecksumIEEE:
+		return crc32.IEEETable, nil
+	case ChecksumCRC32C:
+		return castagnoliTable, nil
+	default:
+		return nil, ErrUnsupportedChecksum
+	}
+}
+
+// 写入时使用的crc表，校验算法已经由checkOptions或者打开文件时的checksumTable检查过，
+// 不会在写入的热路径上返回错误
+func crcTable(checksum ChecksumType) *crc32.Table {
+	if checksum == ChecksumIEEE {
+		return crc32.IEEETable
+	}
+	return castagnoliTable
+}
@@ -0,0 +1,76 @@
+package data
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+)
+
+var ErrInvalidChunkedValue = errors.New("invalid chunked value, log record maybe corrupted")
+
+// ChunkedValue 分块存储的大value的清单，保存在带有LogRecordFlagChunked标志的记录中
+// 除了最后一块，每一块的大小都是ChunkSize
+type ChunkedValue struct {
+	Size      int64           //value的总大小
+	ChunkSize int64           //每一块的大小
+	Chunks    []*LogRecordPos //每一块chunk记录的位置
+}
+
+// EncodeChunkedValue 编码分块清单
+func EncodeChunkedValue(cv *ChunkedValue) []byte {
+	buf := make([]byte, binary.MaxVarintLen64*3+len(cv.Chunks)*(binary.MaxVarintLen32*2+binary.MaxVarintLen64))
+	index := 0
+	index += binary.PutVarint(buf[index:], cv.Size)
+	index += binary.PutVarint(buf[index:], cv.ChunkSize)
+	index += binary.PutVarint(buf[index:], int64(len(cv.Chunks)))
+	for _, pos := range cv.Chunks {
+		index += copy(buf[index:], EncodeLogRecordPos(pos))
+	}
+	return buf[:index]
+}
+
+// DecodeChunkedValue 解码分块清单
+func DecodeChunkedValue(buf []byte) (*ChunkedValue, error) {
+	cv := &ChunkedValue{}
+	index := 0
+	var values [3]int64
+	for i := range values {
+		v, n := binary.Varint(buf[index:])
+		if n <= 0 || v < 0 {
+			return nil, ErrInvalidChunkedValue
+		}
+		values[i] = v
+		index += n
+	}
+	cv.Size, cv.ChunkSize = values[0], values[1]
+	count := values[2]
+	if cv.ChunkSize <= 0 || count != (cv.Size+cv.ChunkSize-1)/cv.ChunkSize {
+		return nil, ErrInvalidChunkedValue
+	}
+	cv.Chunks = make([]*LogRecordPos, 0, count)
+	for i := int64(0); i < count; i++ {
+		var fields [3]int64
+		for j := range fields {
+			v, n := binary.Varint(buf[index:])
+			if n <= 0 {
+				return nil, ErrInvalidChunkedValue
+			}
+			fields[j] = v
+			index += n
+		}
+		cv.Chunks = append(cv.Chunks, &LogRecordPos{Fid: uint32(fields[0]), Offset: fields[1], Size: uint32(fields[2])})
+	}
+	return cv, nil
+}
+
+// DiskSize 清单记录和所有chunk记录在磁盘上占用的总大小，超过uint32时取最大值
+func (cv *ChunkedValue) DiskSize(manifestSize int64) uint32 {
+	size := manifestSize
+	for _, pos := range cv.Chunks {
+		size += int64(pos.Size)
+	}
+	if size > math.MaxUint32 {
+		return math.MaxUint32
+	}
+	return uint32(size)
+}
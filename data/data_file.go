@@ -1,23 +1,33 @@
 package data
 
 import (
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"hash/crc32"
 	"io"
 	"lovedb/fio"
+	"os"
 	"path/filepath"
+	"time"
 )
 
 const (
 	DataFileNameSuffix    = ".data"
+	DataHintFileSuffix    = ".hint"
 	HintFileName          = "hint-index"
 	MergeFinishedFileName = "merge-finished"
 	SeqNoFileName         = "seq-no"
+	IndexCheckpointName   = "index-checkpoint"
+	IndexTypeFileName     = "index-type"
 )
 
+// 检查写了一半的记录之后是否还有数据时，每次读取的大小
+const tornTailScanSize = 64 * 1024
+
 var (
-	ErrInvalidCRC = errors.New("invalid crc value, log record maybe corrupted")
+	ErrInvalidCRC           = errors.New("invalid crc value, log record maybe corrupted")
+	ErrTruncateNotSupported = errors.New("the io type of data file does not support truncate")
 )
 
 // DataFile 数据文件
@@ -26,48 +36,163 @@ type DataFile struct {
 	FileId    uint32        //文件id
 	WriteOff  int64         //文件写到了哪个位置
 	IoManager fio.IoManager //用于数据读写的抽象接口，
+	Version   byte          //文件格式的版本
+	Checksum  ChecksumType  //记录使用的校验算法
+	seqInKey  bool          //v1格式的数据文件中事务序列号编码在key的前面，读取时需要解析出来
 }
 
-// OpenDataFile 打开新的数据文件
-func OpenDataFile(dirPath string, fileId uint32, ioType fio.FileIOType) (*DataFile, error) {
+// OpenDataFile 打开新的数据文件，checksum为新建文件时使用的校验算法，已有的文件使用文件头中记录的算法
+// opener用来打开文件的IO，为nil时使用fio.NewIOManager，其他文件的Open函数也一样
+func OpenDataFile(dirPath string, fileId uint32, ioType fio.FileIOType, checksum ChecksumType, opener fio.IOOpener) (*DataFile, error) {
 	// dirpath\000000001.data
 	filename := GetDataFileName(dirPath, fileId)
 	//初始化IO Manager文件管理接口，也就是打开了文件
-	return newDataFile(filename, fileId, ioType)
+	dataFile, err := newDataFile(filename, fileId, ioType, checksum, opener)
+	if err != nil {
+		return nil, err
+	}
+	dataFile.seqInKey = dataFile.Version == FileFormatV1
+	return dataFile, nil
+}
+
+// OpenDataFileReadOnly 只读地打开已有的数据文件，不会创建文件，也不会写入文件头
+func OpenDataFileReadOnly(dirPath string, fileId uint32) (*DataFile, error) {
+	dataFile, err := OpenFileReadOnly(GetDataFileName(dirPath, fileId), fileId)
+	if err != nil {
+		return nil, err
+	}
+	dataFile.seqInKey = dataFile.Version == FileFormatV1
+	return dataFile, nil
+}
+
+// OpenFileReadOnly 只读地打开已有的文件，空文件或者只写了一半文件头的文件当作没有记录的当前版本的文件
+func OpenFileReadOnly(fileName string, fileId uint32) (*DataFile, error) {
+	//mmap打开不存在的文件时会创建文件
+	if _, err := os.Stat(fileName); err != nil {
+		return nil, err
+	}
+	ioManager, err := fio.NewMMapIOManager(fileName)
+	if err != nil {
+		return nil, err
+	}
+	dataFile := &DataFile{FileId: fileId, IoManager: ioManager}
+	if err := dataFile.loadFileHeader(true); err != nil {
+		_ = ioManager.Close()
+		return nil, err
+	}
+	return dataFile, nil
 }
 
 // OpenHintFile 打开新的hint索引文件
-func OpenHintFile(dirPath string) (*DataFile, error) {
+func OpenHintFile(dirPath string, ioType fio.FileIOType, checksum ChecksumType, opener fio.IOOpener) (*DataFile, error) {
 	filename := filepath.Join(dirPath, HintFileName)
-	return newDataFile(filename, 0, fio.StandardFIO)
+	return newDataFile(filename, 0, ioType, checksum, opener)
+}
+
+// OpenDataHintFile 打开数据文件对应的hint文件，记录了数据文件中每条记录的key和位置
+func OpenDataHintFile(dirPath string, fileId uint32, ioType fio.FileIOType, checksum ChecksumType, opener fio.IOOpener) (*DataFile, error) {
+	filename := GetDataHintFileName(dirPath, fileId)
+	return newDataFile(filename, fileId, ioType, checksum, opener)
 }
 
 // OpenMergeFinishedFile  打开标识merge完成的文件
-func OpenMergeFinishedFile(dirPath string) (*DataFile, error) {
+func OpenMergeFinishedFile(dirPath string, ioType fio.FileIOType, checksum ChecksumType, opener fio.IOOpener) (*DataFile, error) {
 	filename := filepath.Join(dirPath, MergeFinishedFileName)
-	return newDataFile(filename, 0, fio.StandardFIO)
+	return newDataFile(filename, 0, ioType, checksum, opener)
 }
 
 // OpenSeqNoFile 存储事务序列号的文件
-func OpenSeqNoFile(dirPath string) (*DataFile, error) {
+func OpenSeqNoFile(dirPath string, ioType fio.FileIOType, checksum ChecksumType, opener fio.IOOpener) (*DataFile, error) {
 	filename := filepath.Join(dirPath, SeqNoFileName)
-	return newDataFile(filename, 0, fio.StandardFIO)
+	return newDataFile(filename, 0, ioType, checksum, opener)
+}
+
+// OpenIndexCheckpointFile 打开保存内存索引快照的文件
+func OpenIndexCheckpointFile(dirPath string, ioType fio.FileIOType, checksum ChecksumType, opener fio.IOOpener) (*DataFile, error) {
+	filename := filepath.Join(dirPath, IndexCheckpointName)
+	return newDataFile(filename, 0, ioType, checksum, opener)
+}
+
+// OpenIndexTypeFile 打开记录数据目录索引类型的文件
+func OpenIndexTypeFile(dirPath string, ioType fio.FileIOType, checksum ChecksumType, opener fio.IOOpener) (*DataFile, error) {
+	filename := filepath.Join(dirPath, IndexTypeFileName)
+	return newDataFile(filename, 0, ioType, checksum, opener)
 }
 
 func GetDataFileName(dirPath string, fileId uint32) string {
 	return filepath.Join(dirPath, fmt.Sprintf("%09d", fileId)+DataFileNameSuffix)
 }
 
-func newDataFile(fileName string, fileID uint32, ioType fio.FileIOType) (*DataFile, error) {
-	ioManager, err := fio.NewIOManager(fileName, ioType)
+func GetDataHintFileName(dirPath string, fileId uint32) string {
+	return filepath.Join(dirPath, fmt.Sprintf("%09d", fileId)+DataHintFileSuffix)
+}
+
+func newDataFile(fileName string, fileID uint32, ioType fio.FileIOType, checksum ChecksumType, opener fio.IOOpener) (*DataFile, error) {
+	if _, err := checksumTable(checksum); err != nil {
+		return nil, err
+	}
+	ioManager, err := fio.OpenIO(opener, fileName, ioType)
 	if err != nil {
 		return nil, err
 	}
-	return &DataFile{
+	dataFile := &DataFile{
 		FileId:    fileID,
 		WriteOff:  0,
 		IoManager: ioManager,
-	}, nil
+		Checksum:  checksum,
+	}
+	//mmap只能读，文件头损坏时不能重新写入
+	if err := dataFile.loadFileHeader(ioType == fio.MemoryMap); err != nil {
+		_ = ioManager.Close()
+		return nil, err
+	}
+	return dataFile, nil
+}
+
+// 读取文件头得到文件格式的版本，新建的文件写入当前版本的文件头，只读打开时不写入
+func (df *DataFile) loadFileHeader(readOnly bool) error {
+	size, err := df.IoManager.Size()
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, FileHeaderSize)
+	if size < FileHeaderSize {
+		buf = buf[:size]
+	}
+	if _, err := df.IoManager.Read(buf, 0); err != nil && err != io.EOF {
+		return err
+	}
+	//空文件，或者写文件头时崩溃了，重新写入文件头
+	if isTornFileHeader(buf) {
+		if readOnly {
+			df.Version = CurrentFileFormat
+			return nil
+		}
+		if size > 0 {
+			if err := df.Truncate(0); err != nil {
+				return err
+			}
+		}
+		if err := df.Write(encodeFileHeader(CurrentFileFormat, df.Checksum)); err != nil {
+			return err
+		}
+		df.Version = CurrentFileFormat
+		return nil
+	}
+	version, checksum, err := decodeFileHeader(buf)
+	if err != nil {
+		return err
+	}
+	df.Version, df.Checksum = version, checksum
+	return nil
+}
+
+// HeaderSize 文件头的大小，第一条记录从这个位置开始，v1格式的文件没有文件头
+func (df *DataFile) HeaderSize() int64 {
+	if df.Version == FileFormatV1 {
+		return 0
+	}
+	return FileHeaderSize
 }
 
 // Write 文件的写入
@@ -82,13 +207,58 @@ func (df *DataFile) Write(buf []byte) error {
 	return nil
 }
 
+// Preallocate 预分配数据文件的磁盘空间，io方式不支持预分配则忽略
+func (df *DataFile) Preallocate(size int64) error {
+	if p, ok := df.IoManager.(fio.Preallocator); ok {
+		return p.Preallocate(size)
+	}
+	return nil
+}
+
+// EnableWriteBuffer 为数据文件开启写缓冲，追加写的数据先放在内存中，按大小、定时或者Sync时写入文件
+func (df *DataFile) EnableWriteBuffer(bufferSize int, flushInterval time.Duration) error {
+	if _, ok := df.IoManager.(*fio.BufferedIO); ok {
+		return nil
+	}
+	bio, err := fio.NewBufferedIOManager(df.IoManager, bufferSize, flushInterval)
+	if err != nil {
+		return err
+	}
+	df.IoManager = bio
+	return nil
+}
+
+// SetWriteOff 设置文件写到的位置，加载数据文件时找到真正的数据末尾以后调用，
+// 预分配或者块对齐填充的零值尾部不会被当作数据
+func (df *DataFile) SetWriteOff(offset int64) error {
+	if r, ok := df.IoManager.(fio.Resizer); ok {
+		if err := r.Resize(offset); err != nil {
+			return err
+		}
+	}
+	df.WriteOff = offset
+	return nil
+}
+
+// Truncate 把数据文件截断到size大小，用于丢弃崩溃时写了一半的记录
+func (df *DataFile) Truncate(size int64) error {
+	t, ok := df.IoManager.(fio.Truncater)
+	if !ok {
+		return ErrTruncateNotSupported
+	}
+	if err := t.Truncate(size); err != nil {
+		return err
+	}
+	return df.SetWriteOff(size)
+}
+
 // WriteHintRecord 写入索引信息到hint文件中
 func (df *DataFile) WriteHintRecord(key []byte, pos *LogRecordPos) error {
 	record := &LogRecord{
 		Key:   key,
 		Value: EncodeLogRecordPos(pos),
 	}
-	encodeRecord, _ := EncodeLogRecord(record)
+	encodeRecord, _ := EncodeLogRecord(record, df.Checksum)
 	return df.Write(encodeRecord)
 
 }
@@ -102,44 +272,38 @@ func (df *DataFile) Close() error {
 	return df.IoManager.Close()
 }
 
-// ReadLogRecord 文件的读取,根据offset去文件中读取相应的logRecord
+// ReadLogRecord 文件的读取,根据offset去文件中读取相应的logRecord，并校验crc
 func (df *DataFile) ReadLogRecord(offset int64) (*LogRecord, int64, error) {
-	//先获取文件的大小
-	fileSize, err := df.IoManager.Size()
-	if err != nil {
-		return nil, 0, err
-	}
+	return df.readLogRecord(offset, true)
+}
 
-	var headerBytes int64 = maxLogRecordHeaderSize
-	//如果该条记录是最后一条记录，且读取maxLogRecordHeaderSize超过文件大小了，就应该只读取到文件末尾
-	if offset+maxLogRecordHeaderSize > fileSize {
-		headerBytes = fileSize - offset
-	}
+// ReadLogRecordNoVerify 读取logRecord但是不校验crc，只用于可信的读取热路径
+// 数据是否损坏交给Verify和Merge检查，它们总是会校验crc
+func (df *DataFile) ReadLogRecordNoVerify(offset int64) (*LogRecord, int64, error) {
+	return df.readLogRecord(offset, false)
+}
 
-	//读取header信息
-	headerBuf, err := df.ReadNBytes(headerBytes, offset)
+func (df *DataFile) readLogRecord(offset int64, verify bool) (*LogRecord, int64, error) {
+	header, headerBuf, headerSize, fileSize, err := df.readLogRecordHeader(offset)
 	if err != nil {
 		return nil, 0, err
 	}
-	//对header的字节数组进行解码
-	header, headerSize := DecodeLogRecordHeader(headerBuf)
-
-	//下面两个条件代表读取到了文件的末尾，直接返回错误即可
-	if header == nil {
-		return nil, 0, io.EOF
-	}
-	if header.crc == 0 && header.keySize == 0 && header.valueSize == 0 {
-		return nil, 0, io.EOF
-	}
 
 	LogRecord := &LogRecord{
-		Type: header.recordType,
+		Type:      header.recordType,
+		Flags:     header.flags,
+		Timestamp: header.timestamp,
+		SeqNo:     header.seqNo,
 	}
 
 	//取出keySize和valSize
 	keySize, valSize := int64(header.keySize), int64(header.valueSize)
 	//返回的记录长度就是headerSize+keySize+valSize
 	recordSize := headerSize + keySize + valSize
+	//记录超出了文件末尾，说明这条记录没有写完（比如写入时崩溃了）
+	if offset+recordSize > fileSize {
+		return nil, 0, io.ErrUnexpectedEOF
+	}
 
 	//根据size去读取用户实际的key和value
 	if keySize > 0 || valSize > 0 {
@@ -157,21 +321,108 @@ func (df *DataFile) ReadLogRecord(offset int64) (*LogRecord, int64, error) {
 	}
 
 	//用crc校验数据的有效性
-	crc := getLogRecordCRC(LogRecord, headerBuf[crc32.Size:headerSize]) //从crc后面开始到header结束
-	if crc != header.crc {
-		return nil, 0, ErrInvalidCRC
+	if verify {
+		table, err := checksumTable(df.Checksum)
+		if err != nil {
+			return nil, 0, err
+		}
+		crc := getLogRecordCRC(LogRecord, headerBuf[crc32.Size:headerSize], table) //从crc后面开始到header结束
+		if crc != header.crc {
+			return nil, 0, ErrInvalidCRC
+		}
+	}
+	//v1格式把事务序列号编码在key的前面，解析出来和v2格式保持一致
+	if df.seqInKey {
+		seqNo, n := binary.Uvarint(LogRecord.Key)
+		LogRecord.Key, LogRecord.SeqNo = LogRecord.Key[n:], seqNo
 	}
 	return LogRecord, recordSize, nil
 }
 
+// 读取并解码offset处记录的header，同时返回header的原始字节、header的长度以及文件的大小
+// 读到了文件末尾或者预分配的零值时返回io.EOF
+func (df *DataFile) readLogRecordHeader(offset int64) (*LogRecordHeader, []byte, int64, int64, error) {
+	//先获取文件的大小
+	fileSize, err := df.IoManager.Size()
+	if err != nil {
+		return nil, nil, 0, 0, err
+	}
+
+	//已经读到了文件末尾
+	if offset >= fileSize {
+		return nil, nil, 0, 0, io.EOF
+	}
+
+	var headerBytes int64 = maxLogRecordHeaderSize
+	if df.Version != FileFormatV1 {
+		headerBytes = maxLogRecordHeaderSizeV2
+	}
+	//如果该条记录是最后一条记录，且读取maxLogRecordHeaderSize超过文件大小了，就应该只读取到文件末尾
+	if offset+headerBytes > fileSize {
+		headerBytes = fileSize - offset
+	}
+
+	//读取header信息
+	headerBuf, err := df.ReadNBytes(headerBytes, offset)
+	if err != nil {
+		return nil, nil, 0, 0, err
+	}
+	//对header的字节数组进行解码
+	var header *LogRecordHeader
+	var headerSize int64
+	if df.Version == FileFormatV1 {
+		header, headerSize = DecodeLogRecordHeader(headerBuf)
+	} else {
+		header, headerSize = decodeLogRecordHeaderV2(headerBuf)
+	}
+
+	//下面两个条件代表读取到了文件的末尾，直接返回错误即可
+	if header == nil {
+		return nil, nil, 0, 0, io.EOF
+	}
+	if header.crc == 0 && header.keySize == 0 && header.valueSize == 0 {
+		return nil, nil, 0, 0, io.EOF
+	}
+	return header, headerBuf, headerSize, fileSize, nil
+}
+
+// IsTornTail 从offset读取记录返回io.ErrUnexpectedEOF或者ErrInvalidCRC时，判断这条记录是不是崩溃时文件末尾写了一半的记录
+// 记录超出了文件末尾，或者记录之后直到文件末尾都是零值（预分配或者块对齐的填充）时是写了一半的记录；
+// 记录之后还有写入的数据，说明是文件中间的数据损坏，不能当作末尾截断掉
+func (df *DataFile) IsTornTail(offset int64) (bool, error) {
+	header, _, headerSize, fileSize, err := df.readLogRecordHeader(offset)
+	if err != nil {
+		if err == io.EOF {
+			return true, nil
+		}
+		return false, err
+	}
+	end := offset + headerSize + int64(header.keySize) + int64(header.valueSize)
+	buf := make([]byte, tornTailScanSize)
+	for ; end < fileSize; end += int64(len(buf)) {
+		if fileSize-end < int64(len(buf)) {
+			buf = buf[:fileSize-end]
+		}
+		if _, err := df.IoManager.Read(buf, end); err != nil && err != io.EOF {
+			return false, err
+		}
+		for _, b := range buf {
+			if b != 0 {
+				return false, nil
+			}
+		}
+	}
+	return true, nil
+}
+
 // SetIOManager 对当前文件设置我们的io方式
-func (df *DataFile) SetIOManager(dirPath string, iotype fio.FileIOType) error {
+func (df *DataFile) SetIOManager(dirPath string, iotype fio.FileIOType, opener fio.IOOpener) error {
 	//将当前io方式关闭
 	if err := df.IoManager.Close(); err != nil {
 		return err
 	}
 	//设置一个新的
-	ioManager, err := fio.NewIOManager(GetDataFileName(dirPath, df.FileId), iotype)
+	ioManager, err := fio.OpenIO(opener, GetDataFileName(dirPath, df.FileId), iotype)
 	if err != nil {
 		return err
 	}
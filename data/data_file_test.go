@@ -2,27 +2,29 @@ package data
 
 import (
 	"github.com/stretchr/testify/assert"
+	"io"
+	"lovedb/fio"
 	"testing"
 )
 
 func TestOpenDataFile(t *testing.T) {
 	//打开文件测试
-	dataFile1, err := OpenDataFile("D:\\git_space\\lovedb\\tmp", 1)
+	dataFile1, err := OpenDataFile("D:\\git_space\\lovedb\\tmp", 1, fio.StandardFIO, ChecksumIEEE, nil)
 	assert.Nil(t, err)
 	assert.NotNil(t, dataFile1)
 
-	dataFile2, err := OpenDataFile("D:\\git_space\\lovedb\\tmp", 111)
+	dataFile2, err := OpenDataFile("D:\\git_space\\lovedb\\tmp", 111, fio.StandardFIO, ChecksumIEEE, nil)
 	assert.Nil(t, err)
 	assert.NotNil(t, dataFile2)
 
-	dataFile3, err := OpenDataFile("D:\\git_space\\lovedb\\tmp", 111)
+	dataFile3, err := OpenDataFile("D:\\git_space\\lovedb\\tmp", 111, fio.StandardFIO, ChecksumIEEE, nil)
 	assert.Nil(t, err)
 	assert.NotNil(t, dataFile3)
 
 }
 
 func TestDataFile_Write(t *testing.T) {
-	dataFile1, err := OpenDataFile("D:\\git_space\\lovedb\\tmp", 1)
+	dataFile1, err := OpenDataFile("D:\\git_space\\lovedb\\tmp", 1, fio.StandardFIO, ChecksumIEEE, nil)
 	assert.Nil(t, err)
 	assert.NotNil(t, dataFile1)
 
@@ -36,7 +38,7 @@ func TestDataFile_Write(t *testing.T) {
 }
 
 func TestDataFile_Close(t *testing.T) {
-	dataFile1, err := OpenDataFile("D:\\git_space\\lovedb\\tmp", 123)
+	dataFile1, err := OpenDataFile("D:\\git_space\\lovedb\\tmp", 123, fio.StandardFIO, ChecksumIEEE, nil)
 	assert.Nil(t, err)
 	assert.NotNil(t, dataFile1)
 
@@ -49,7 +51,7 @@ func TestDataFile_Close(t *testing.T) {
 }
 
 func TestDataFile_Sync(t *testing.T) {
-	dataFile1, err := OpenDataFile("D:\\git_space\\lovedb\\tmp", 123)
+	dataFile1, err := OpenDataFile("D:\\git_space\\lovedb\\tmp", 123, fio.StandardFIO, ChecksumIEEE, nil)
 	assert.Nil(t, err)
 	assert.NotNil(t, dataFile1)
 
@@ -61,7 +63,7 @@ func TestDataFile_Sync(t *testing.T) {
 }
 
 func TestDataFile_ReadLogRecord(t *testing.T) {
-	dataFile, err := OpenDataFile("..\\tmp", 444)
+	dataFile, err := OpenDataFile("..\\tmp", 444, fio.StandardFIO, ChecksumIEEE, nil)
 	assert.Nil(t, err)
 	assert.NotNil(t, dataFile)
 
@@ -71,7 +73,7 @@ func TestDataFile_ReadLogRecord(t *testing.T) {
 		Value: []byte("bitcask-go"),
 		Type:  LogRecordNormal,
 	}
-	res1, n1 := EncodeLogRecord(rec1)
+	res1, n1 := EncodeLogRecord(rec1, ChecksumIEEE)
 	err = dataFile.Write(res1)
 	assert.Nil(t, err)
 	readRec1, readSize1, err := dataFile.ReadLogRecord(0)
@@ -85,7 +87,7 @@ func TestDataFile_ReadLogRecord(t *testing.T) {
 		Value: []byte("a new value come"),
 		Type:  LogRecordNormal,
 	}
-	res2, n2 := EncodeLogRecord(rec2)
+	res2, n2 := EncodeLogRecord(rec2, ChecksumIEEE)
 	err = dataFile.Write(res2)
 	assert.Nil(t, err)
 	readRec2, readSize2, err := dataFile.ReadLogRecord(readSize1)
@@ -99,7 +101,7 @@ func TestDataFile_ReadLogRecord(t *testing.T) {
 		Value: []byte(""),
 		Type:  LogRecordDeleted,
 	}
-	res3, n3 := EncodeLogRecord(rec3)
+	res3, n3 := EncodeLogRecord(rec3, ChecksumIEEE)
 	err = dataFile.Write(res3)
 	assert.Nil(t, err)
 	readRec3, readSize3, err := dataFile.ReadLogRecord(readSize1 + readSize2)
@@ -107,3 +109,42 @@ func TestDataFile_ReadLogRecord(t *testing.T) {
 	assert.Equal(t, rec3, readRec3)
 	assert.Equal(t, n3, readSize3)
 }
+
+func TestDataFile_IsTornTail(t *testing.T) {
+	dir := "/lovedb-mem/" + t.Name()
+	defer func() {
+		_ = fio.MemFileSystem.RemoveAll(dir)
+	}()
+	dataFile, err := OpenDataFile(dir, 1, fio.MemoryIO, ChecksumIEEE, nil)
+	assert.Nil(t, err)
+
+	rec1, n1 := EncodeLogRecord(&LogRecord{Key: []byte("a"), Value: []byte("value-a")}, ChecksumIEEE)
+	rec2, _ := EncodeLogRecord(&LogRecord{Key: []byte("b"), Value: []byte("value-b")}, ChecksumIEEE)
+	assert.Nil(t, dataFile.Write(rec1))
+	offset := dataFile.HeaderSize()
+
+	//最后一条记录损坏，后面是填充的零值，是写了一半的记录
+	rec1[len(rec1)-1] ^= 0x01
+	broken, _ := OpenDataFile(dir, 2, fio.MemoryIO, ChecksumIEEE, nil)
+	assert.Nil(t, broken.Write(rec1))
+	assert.Nil(t, broken.Write(make([]byte, 100)))
+	_, _, err = broken.ReadLogRecord(offset)
+	assert.Equal(t, ErrInvalidCRC, err)
+	torn, err := broken.IsTornTail(offset)
+	assert.Nil(t, err)
+	assert.True(t, torn)
+
+	//后面还有记录，是文件中间的数据损坏
+	assert.Nil(t, broken.Write(rec2))
+	torn, err = broken.IsTornTail(offset)
+	assert.Nil(t, err)
+	assert.False(t, torn)
+
+	//记录超出了文件末尾
+	assert.Nil(t, dataFile.Write(rec2[:len(rec2)/2]))
+	_, _, err = dataFile.ReadLogRecord(offset + n1)
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+	torn, err = dataFile.IsTornTail(offset + n1)
+	assert.Nil(t, err)
+	assert.True(t, torn)
+}
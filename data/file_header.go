@@ -0,0 +1,76 @@
+package data
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+)
+
+// 文件格式的版本
+const (
+	// FileFormatV1 最早的格式，没有文件头，事务序列号编码在key的前面
+	FileFormatV1 byte = 1
+
+	// FileFormatV2 文件开头有文件头，记录中带有标志位、写入时间和事务序列号
+	FileFormatV2 byte = 2
+
+	// CurrentFileFormat 新建的文件使用的格式
+	CurrentFileFormat = FileFormatV2
+)
+
+// FileHeaderSize 文件头的大小
+// magic  version  checksum  reserved  crc
+//
+//	4   +   1    +    1     +    6    +  4  = 16
+const FileHeaderSize = 16
+
+var fileMagic = []byte("LVDB")
+
+var (
+	ErrInvalidFileHeader      = errors.New("invalid file header, data file maybe corrupted")
+	ErrUnsupportedFileVersion = errors.New("unsupported data file format version")
+)
+
+// 编码文件头
+func encodeFileHeader(version byte, checksum ChecksumType) []byte {
+	buf := make([]byte, FileHeaderSize)
+	copy(buf[:4], fileMagic)
+	buf[4] = version
+	buf[5] = checksum
+	binary.LittleEndian.PutUint32(buf[12:], crc32.ChecksumIEEE(buf[:12]))
+	return buf
+}
+
+// 解码文件头，返回文件格式的版本和记录的校验算法
+// 开头不是magic的文件是v1格式，没有文件头
+func decodeFileHeader(buf []byte) (byte, ChecksumType, error) {
+	if len(buf) < FileHeaderSize || !bytes.Equal(buf[:4], fileMagic) {
+		return FileFormatV1, ChecksumIEEE, nil
+	}
+	if binary.LittleEndian.Uint32(buf[12:]) != crc32.ChecksumIEEE(buf[:12]) {
+		return 0, 0, ErrInvalidFileHeader
+	}
+	version := buf[4]
+	if version < FileFormatV2 || version > CurrentFileFormat {
+		return 0, 0, ErrUnsupportedFileVersion
+	}
+	checksum := buf[5]
+	if _, err := checksumTable(checksum); err != nil {
+		return 0, 0, err
+	}
+	return version, checksum, nil
+}
+
+// 是否是写了一半的文件头：新建文件写文件头时崩溃了
+// v1文件中最小的记录也有7个字节，开头4个字节和magic相同的概率可以忽略
+func isTornFileHeader(buf []byte) bool {
+	if len(buf) >= FileHeaderSize {
+		return false
+	}
+	n := len(buf)
+	if n > len(fileMagic) {
+		n = len(fileMagic)
+	}
+	return bytes.Equal(buf[:n], fileMagic[:n])
+}
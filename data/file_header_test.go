@@ -0,0 +1,89 @@
+package data
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io"
+	"lovedb/fio"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileHeader(t *testing.T) {
+	buf := encodeFileHeader(CurrentFileFormat, ChecksumCRC32C)
+	assert.Equal(t, FileHeaderSize, len(buf))
+	version, checksum, err := decodeFileHeader(buf)
+	assert.Nil(t, err)
+	assert.Equal(t, CurrentFileFormat, version)
+	assert.Equal(t, ChecksumCRC32C, checksum)
+
+	//没有magic的是v1文件
+	version, checksum, err = decodeFileHeader([]byte{104, 82, 240, 150, 0, 8, 20, 110, 97, 109, 101, 98, 105, 116, 99, 97})
+	assert.Nil(t, err)
+	assert.Equal(t, FileFormatV1, version)
+	assert.Equal(t, ChecksumIEEE, checksum)
+
+	//文件头损坏
+	buf[6] = 1
+	_, _, err = decodeFileHeader(buf)
+	assert.Equal(t, ErrInvalidFileHeader, err)
+
+	assert.True(t, isTornFileHeader(nil))
+	assert.True(t, isTornFileHeader([]byte("LV")))
+	assert.True(t, isTornFileHeader(encodeFileHeader(CurrentFileFormat, ChecksumCRC32C)[:10]))
+	assert.False(t, isTornFileHeader([]byte{104, 82, 240, 150, 0, 8, 20}))
+}
+
+func TestDataFile_V1(t *testing.T) {
+	dir := filepath.Join("/lovedb-data", t.Name())
+	defer func() {
+		_ = fio.MemFileSystem.RemoveAll(dir)
+	}()
+	//手动写一个v1格式的文件：没有文件头，事务序列号编码在key的前面
+	ioManager, err := fio.NewIOManager(GetDataFileName(dir, 1), fio.MemoryIO)
+	assert.Nil(t, err)
+	_, err = ioManager.Write([]byte{55, 42, 95, 204, 0, 10, 8, 0, 110, 97, 109, 101, 107, 118, 103, 111})
+	assert.Nil(t, err)
+
+	dataFile, err := OpenDataFile(dir, 1, fio.MemoryIO, ChecksumCRC32C, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, FileFormatV1, dataFile.Version)
+	assert.Equal(t, int64(0), dataFile.HeaderSize())
+	record, size, err := dataFile.ReadLogRecord(0)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(16), size)
+	assert.Equal(t, []byte("name"), record.Key)
+	assert.Equal(t, []byte("kvgo"), record.Value)
+	assert.Equal(t, uint64(0), record.SeqNo)
+
+	//新建的文件写入文件头
+	dataFile, err = OpenDataFile(dir, 2, fio.MemoryIO, ChecksumCRC32C, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, CurrentFileFormat, dataFile.Version)
+	assert.Equal(t, int64(FileHeaderSize), dataFile.WriteOff)
+	rec, n := EncodeLogRecord(&LogRecord{Key: []byte("name"), Value: []byte("kvgo"), SeqNo: 3}, dataFile.Checksum)
+	assert.Nil(t, dataFile.Write(rec))
+	record, size, err = dataFile.ReadLogRecord(dataFile.HeaderSize())
+	assert.Nil(t, err)
+	assert.Equal(t, n, size)
+	assert.Equal(t, []byte("name"), record.Key)
+	assert.Equal(t, uint64(3), record.SeqNo)
+}
+
+func TestDataFile_MMapTornHeader(t *testing.T) {
+	dir := t.TempDir()
+	//空文件和写了一半文件头的文件，mmap只读打开时不会写入文件头
+	assert.Nil(t, os.WriteFile(GetDataFileName(dir, 1), nil, fio.DataFilePerm))
+	assert.Nil(t, os.WriteFile(GetDataFileName(dir, 2), fileMagic[:2], fio.DataFilePerm))
+	for fid, size := range map[uint32]int64{1: 0, 2: 2} {
+		dataFile, err := OpenDataFile(dir, fid, fio.MemoryMap, ChecksumCRC32C, nil)
+		assert.Nil(t, err)
+		assert.Equal(t, CurrentFileFormat, dataFile.Version)
+		_, _, err = dataFile.ReadLogRecord(dataFile.HeaderSize())
+		assert.Equal(t, io.EOF, err)
+		assert.Nil(t, dataFile.Close())
+		info, err := os.Stat(GetDataFileName(dir, fid))
+		assert.Nil(t, err)
+		assert.Equal(t, size, info.Size())
+	}
+}
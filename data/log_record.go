@@ -2,7 +2,6 @@ package data
 
 import (
 	"encoding/binary"
-	"fmt"
 	"hash/crc32"
 )
 
@@ -16,18 +15,33 @@ const (
 
 	// LogRecordFinished 批量数据提交的fin标记记录
 	LogRecordFinished
+
+	// LogRecordChunk 大value的一个分块，只能通过分块清单找到，不会加入索引
+	LogRecordChunk
 )
 
-// crc type keySize valSize      （key和val 的size为变长元素）
-//  4 +  1  +  5  +   5 = 15
+// LogRecordFlagChunked 标志位：记录的value是分块清单，真正的value分块存放在前面的chunk记录中
+const LogRecordFlagChunked byte = 1 << 0
 
+// v1格式的header
+// crc type keySize valSize      （key和val 的size为变长元素）
+//
+//	4 +  1  +  5  +   5 = 15
 const maxLogRecordHeaderSize = binary.MaxVarintLen32*2 + 5
 
+// v2格式的header
+// crc type flags timestamp seqNo keySize valSize      （除了crc、type、flags都是变长元素）
+//
+//	4 +  1  +  1  +   10    + 10  +  5   +   5 = 36
+const maxLogRecordHeaderSizeV2 = binary.MaxVarintLen64*2 + binary.MaxVarintLen32*2 + 6
+
 // LogRecordHeader LogRecord记录的头部信息
-// todo 需要进行 Varint 编码，否则就是定长的uint32类型字段
 type LogRecordHeader struct {
 	crc        uint32        //crc校验值
 	recordType LogRecordType //表示LogRecord的类型
+	flags      byte          //标志位，v2格式才有
+	timestamp  int64         //写入时间，v2格式才有
+	seqNo      uint64        //事务序列号，v2格式才有
 	keySize    uint32        //key的长度
 	valueSize  uint32        //value的长度
 }
@@ -35,9 +49,12 @@ type LogRecordHeader struct {
 // LogRecord 写入到数据文件的记录
 // 之所以叫日志，是因为数据文件中的数据是追加写入的，类似日志的格式
 type LogRecord struct {
-	Key   []byte
-	Value []byte
-	Type  LogRecordType
+	Key       []byte
+	Value     []byte
+	Type      LogRecordType
+	Flags     byte   //标志位，见LogRecordFlagChunked
+	Timestamp int64  //写入时间，unix纳秒，v1格式的记录为0
+	SeqNo     uint64 //事务序列号，不是事务写入的记录为0
 }
 
 // LogRecordPos 内存索引的value值，主要描述数据在磁盘上的位置
@@ -53,18 +70,19 @@ type TxRecord struct {
 	Pos    *LogRecordPos
 }
 
-// EncodeLogRecord 将logRecord转化为字节数组写入到文件中,并返回长度
-func EncodeLogRecord(logRecord *LogRecord) ([]byte, int64) {
+// EncodeLogRecord 将logRecord按照v2格式转化为字节数组写入到文件中,并返回长度，checksum需要是已经检查过的校验算法
+// checksum需要和要写入的文件使用的校验算法一致
+func EncodeLogRecord(logRecord *LogRecord, checksum ChecksumType) ([]byte, int64) {
 	//先将header写入到字节数组中，crc先保留
-	header := make([]byte, maxLogRecordHeaderSize)
+	header := make([]byte, maxLogRecordHeaderSizeV2)
 	header[4] = logRecord.Type
-	index := 5
-	//5字节之后，存储的是key和value的size
-	//使用变长类型，节省空间
-	//做法是将logRecord中的key的长度进行变长的编码并放入到header的第五个字节往后
+	header[5] = logRecord.Flags
+	index := 6
+	//写入时间、事务序列号以及key和value的size都使用变长类型，节省空间
+	index += binary.PutVarint(header[index:], logRecord.Timestamp)
+	index += binary.PutUvarint(header[index:], logRecord.SeqNo)
 	index += binary.PutVarint(header[index:], int64(len(logRecord.Key)))
 	index += binary.PutVarint(header[index:], int64(len(logRecord.Value)))
-	fmt.Println(index)
 	//编码之后的实际长度！！第二个返回值
 	size := index + len(logRecord.Key) + len(logRecord.Value)
 
@@ -79,8 +97,7 @@ func EncodeLogRecord(logRecord *LogRecord) ([]byte, int64) {
 	copy(resBytes[index+len(logRecord.Key):], logRecord.Value)
 
 	//对前四个字节以后所有取一个crc值
-	crc := crc32.ChecksumIEEE(resBytes[4:])
-	fmt.Println(crc)
+	crc := crc32.Checksum(resBytes[4:], crcTable(checksum))
 	//PutUint32用于将无符号 32 位整数值编码为字节切片。
 	binary.LittleEndian.PutUint32(resBytes[:4], crc)
 	return resBytes, int64(size)
@@ -112,7 +129,7 @@ func DecodeLogRecordPos(buf []byte) *LogRecordPos {
 	return logRecordPos
 }
 
-// DecodeLogRecordHeader 对头部信息的字节数组进行解码得到LogRecordHeader结构体记录,返回结构体和header的长度
+// DecodeLogRecordHeader 对v1格式头部信息的字节数组进行解码得到LogRecordHeader结构体记录,返回结构体和header的长度
 // 由于key和value本身就是字节数组，所以不需要对整体进行解码
 func DecodeLogRecordHeader(buf []byte) (*LogRecordHeader, int64) {
 	if len(buf) <= 4 {
@@ -136,14 +153,52 @@ func DecodeLogRecordHeader(buf []byte) (*LogRecordHeader, int64) {
 
 }
 
-func getLogRecordCRC(lr *LogRecord, header []byte) uint32 {
+// 对v2格式的头部信息进行解码，返回结构体和header的长度
+func decodeLogRecordHeaderV2(buf []byte) (*LogRecordHeader, int64) {
+	if len(buf) <= 6 {
+		return nil, 0
+	}
+	header := &LogRecordHeader{
+		crc:        binary.LittleEndian.Uint32(buf[:4]),
+		recordType: buf[4],
+		flags:      buf[5],
+	}
+	index := 6
+	timestamp, n := binary.Varint(buf[index:])
+	if n <= 0 {
+		return nil, 0
+	}
+	header.timestamp = timestamp
+	index += n
+	seqNo, n := binary.Uvarint(buf[index:])
+	if n <= 0 {
+		return nil, 0
+	}
+	header.seqNo = seqNo
+	index += n
+	keySize, n := binary.Varint(buf[index:])
+	if n <= 0 {
+		return nil, 0
+	}
+	header.keySize = uint32(keySize)
+	index += n
+	valueSize, n := binary.Varint(buf[index:])
+	if n <= 0 {
+		return nil, 0
+	}
+	header.valueSize = uint32(valueSize)
+	index += n
+	return header, int64(index)
+}
+
+func getLogRecordCRC(lr *LogRecord, header []byte, table *crc32.Table) uint32 {
 	if lr == nil {
 		return 0
 	}
 
-	crc := crc32.ChecksumIEEE(header[:])
+	crc := crc32.Checksum(header[:], table)
 	//再加上key和value继续取crc
-	crc = crc32.Update(crc, crc32.IEEETable, lr.Key)
-	crc = crc32.Update(crc, crc32.IEEETable, lr.Value)
+	crc = crc32.Update(crc, table, lr.Key)
+	crc = crc32.Update(crc, table, lr.Value)
 	return crc
 }
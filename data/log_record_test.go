@@ -13,7 +13,7 @@ func TestEncodeLogRecord(t *testing.T) {
 		Value: []byte("bitcask-go"),
 		Type:  LogRecordNormal,
 	}
-	res1, n1 := EncodeLogRecord(rec1)
+	res1, n1 := EncodeLogRecord(rec1, ChecksumIEEE)
 	assert.NotNil(t, res1)
 	assert.Greater(t, n1, int64(5))
 
@@ -22,7 +22,7 @@ func TestEncodeLogRecord(t *testing.T) {
 		Key:  []byte("name"),
 		Type: LogRecordNormal,
 	}
-	res2, n2 := EncodeLogRecord(rec2)
+	res2, n2 := EncodeLogRecord(rec2, ChecksumIEEE)
 	//240712713
 	assert.NotNil(t, res2)
 	assert.Greater(t, n2, int64(5))
@@ -33,7 +33,7 @@ func TestEncodeLogRecord(t *testing.T) {
 		Value: []byte("bitcask-go"),
 		Type:  LogRecordDeleted,
 	}
-	res3, n3 := EncodeLogRecord(rec3)
+	res3, n3 := EncodeLogRecord(rec3, ChecksumIEEE)
 	assert.NotNil(t, res3)
 	assert.Greater(t, n3, int64(5))
 }
@@ -77,7 +77,7 @@ func TestGetLogRecordCRC(t *testing.T) {
 		Type:  LogRecordNormal,
 	}
 	headerBuf := []byte{104, 82, 240, 150, 0, 8, 20}
-	crc1 := getLogRecordCRC(rec1, headerBuf[crc32.Size:])
+	crc1 := getLogRecordCRC(rec1, headerBuf[crc32.Size:], crc32.IEEETable)
 	assert.Equal(t, uint32(2532332136), crc1)
 
 	//2
@@ -86,7 +86,7 @@ func TestGetLogRecordCRC(t *testing.T) {
 		Type: LogRecordNormal,
 	}
 	headerBuf2 := []byte{9, 252, 88, 14, 0, 8, 0}
-	crc2 := getLogRecordCRC(rec2, headerBuf2[crc32.Size:])
+	crc2 := getLogRecordCRC(rec2, headerBuf2[crc32.Size:], crc32.IEEETable)
 	assert.Equal(t, uint32(240712713), crc2)
 
 	//3
@@ -96,6 +96,53 @@ func TestGetLogRecordCRC(t *testing.T) {
 		Type:  LogRecordDeleted,
 	}
 	headerBuf3 := []byte{43, 153, 86, 17, 1, 8, 20}
-	crc3 := getLogRecordCRC(rec3, headerBuf3[crc32.Size:])
+	crc3 := getLogRecordCRC(rec3, headerBuf3[crc32.Size:], crc32.IEEETable)
 	assert.Equal(t, uint32(290887979), crc3)
 }
+
+func TestEncodeLogRecord_V2(t *testing.T) {
+	rec := &LogRecord{
+		Key:       []byte("name"),
+		Value:     []byte("bitcask-go"),
+		Type:      LogRecordDeleted,
+		Timestamp: 1700000000000000000,
+		SeqNo:     12,
+	}
+	res, n := EncodeLogRecord(rec, ChecksumIEEE)
+	assert.Equal(t, int64(len(res)), n)
+
+	header, headerSize := decodeLogRecordHeaderV2(res)
+	assert.NotNil(t, header)
+	assert.Equal(t, n, headerSize+4+10)
+	assert.Equal(t, LogRecordDeleted, header.recordType)
+	assert.Equal(t, int64(1700000000000000000), header.timestamp)
+	assert.Equal(t, uint64(12), header.seqNo)
+	assert.Equal(t, uint32(4), header.keySize)
+	assert.Equal(t, uint32(10), header.valueSize)
+	assert.Equal(t, header.crc, getLogRecordCRC(rec, res[crc32.Size:headerSize], crc32.IEEETable))
+
+	//header不完整
+	header, _ = decodeLogRecordHeaderV2(res[:8])
+	assert.Nil(t, header)
+}
+
+func TestChunkedValue(t *testing.T) {
+	cv := &ChunkedValue{
+		Size:      2500,
+		ChunkSize: 1000,
+		Chunks: []*LogRecordPos{
+			{Fid: 1, Offset: 16, Size: 1010},
+			{Fid: 1, Offset: 1026, Size: 1010},
+			{Fid: 2, Offset: 16, Size: 510},
+		},
+	}
+	res, err := DecodeChunkedValue(EncodeChunkedValue(cv))
+	assert.Nil(t, err)
+	assert.Equal(t, cv, res)
+	assert.Equal(t, uint32(2560), cv.DiskSize(30))
+
+	//分块的数量和大小对不上
+	cv.Chunks = cv.Chunks[:2]
+	_, err = DecodeChunkedValue(EncodeChunkedValue(cv))
+	assert.Equal(t, ErrInvalidChunkedValue, err)
+}
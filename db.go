@@ -1,48 +1,88 @@
 package lovedb
 
 import (
+	"context"
 	"errors"
 	"fmt"
-	"github.com/gofrs/flock"
 	"io"
 	"lovedb/data"
 	"lovedb/fio"
 	"lovedb/index"
-	"lovedb/utils"
 	"os"
 	"path/filepath"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 //面向用户的操作接口
 
 // DB Bitcask存储引擎实例
 type DB struct {
-	options         Options
-	mu              *sync.RWMutex
-	fileIds         []int                     //文件们的id，由于加载文件的时候得到过，所以放入结构体里，用于加载索引的时候使用
-	activeFile      *data.DataFile            //当前活跃数据文件,可以用于写入
-	olderFiles      map[uint32]*data.DataFile //旧的数据文件，只能用于读
-	index           index.Indexer             //内存索引
-	seqNo           uint64                    //事务序列号，全局递增
-	isMerging       bool                      //正在进行merge
-	seqNoFileExists bool                      //存储事务序列号的文件是否存在
-
-	isInitial   bool         //是否是第一次初始化此数据目录，用于判断能否事务写：如果索引类型为B+树，且不存在事务序列号文件，且不是第一次初始化目录，则无法使用原子写
-	fileLock    *flock.Flock //文件锁保证多进程之间的互斥
-	bytesWrite  uint         //累计写了多少字节
-	reclaimSize int64        //表示无效数据的数量
+	options    Options
+	mu         *sync.RWMutex
+	fileIds    []int                     //文件们的id，由于加载文件的时候得到过，所以放入结构体里，用于加载索引的时候使用
+	activeFile *data.DataFile            //当前活跃数据文件,可以用于写入
+	olderFiles map[uint32]*data.DataFile //旧的数据文件，只能用于读
+	index      index.Indexer             //内存索引
+	seqNo      uint64                    //事务序列号，全局递增
+	isMerging  bool                      //正在进行merge
+
+	unlockDir   func() error   //释放目录的文件锁，文件锁保证多进程之间的互斥
+	bytesWrite  uint           //累计写了多少字节
+	reclaimSize int64          //表示无效数据的数量
+	fs          fio.FileSystem //数据目录所在的文件系统，磁盘或者内存
+	cache       *valueCache    //value缓存，没有开启时为nil
+
+	startup     StartupStat  //启动时各个阶段的耗时
+	hintEntries []*hintEntry //活跃文件中所有记录的索引信息，切换活跃文件时写入hint文件
+
+	checkpointStop chan struct{} //通知定时写入索引快照的协程退出，没有开启时为nil
+	checkpointDone chan struct{} //定时写入索引快照的协程已经退出
+	closed         bool          //是否已经Close，再次Close时直接返回
+	hintComplete   bool          //hintEntries是否包含了活跃文件中的所有记录，b+树索引不需要hint文件，总是为false
+
+	ops         opCounters                         //各种操作的累计次数
+	lastMerge   atomic.Pointer[MergeStat]          //最近一次merge的结果，还没有merge过时为nil
+	sketch      atomic.Pointer[keySketch]          //EstimateRange和RandomSample使用的索引抽样，第一次使用时生成
+	statMu      *sync.Mutex                        //保护fileRecords，DetailedStat只持有读锁
+	fileRecords map[*data.DataFile]*fileRecordStat //每个数据文件已经统计过的记录数量
+	metrics     *dbMetrics                         //导出给Prometheus和expvar的指标
+	events      EventListener                      //内部事件的回调，没有设置时忽略所有事件
+	logger      Logger                             //日志，没有设置时丢弃所有日志
+
+	streamCond       *sync.Cond //和mu关联，分块写入结束或者merge切换完活跃文件时通知等待的协程
+	inflightStreams  int        //正在分块写入的PutReader数量，merge要等它们都结束才能切换活跃文件
+	mergeWaitStreams bool       //merge正在等待分块写入结束，新的PutReader要等merge切换完活跃文件再开始
 }
 
 // Stat db的统计信息
 type Stat struct {
-	KeyNum          uint  //key的总数量
-	DataFileNum     uint  //db中数据文件的数量
-	ReclaimableSize int64 //可以进行merge回收的数据量,字节为单位
-	DiskSize        int64 //数据目录所占磁盘空间大小
+	KeyNum            uint    //key的总数量
+	DataFileNum       uint    //db中数据文件的数量
+	ReclaimableSize   int64   //可以进行merge回收的数据量,字节为单位
+	DiskSize          int64   //数据目录所占磁盘空间大小
+	CacheHits         uint64  //value缓存命中的次数
+	CacheMisses       uint64  //value缓存未命中的次数
+	IndexMemory       int64   //内存索引占用的字节数，索引不支持统计时为0
+	IndexMemoryPerKey float64 //内存索引中平均每个key占用的字节数
+	Startup           StartupStat
+	Ops               OpStat     //打开以后各种操作的累计次数
+	LastMerge         *MergeStat //最近一次merge的结果，还没有merge过时为nil
+}
+
+// StartupStat 打开数据库时各个阶段的耗时
+type StartupStat struct {
+	LoadMergeFiles         time.Duration //处理上一次完成的merge
+	LoadDataFiles          time.Duration //打开所有的数据文件
+	LoadIndexCheckpoint    time.Duration //加载内存索引的快照
+	LoadIndexFromHint      time.Duration //从merge生成的hint文件加载索引
+	LoadIndexFromDataFiles time.Duration //从数据文件和数据文件的hint文件加载索引
+	LoadSeqNo              time.Duration //b+树索引读取事务序列号和活跃文件的末尾
+	Total                  time.Duration
 }
 
 const (
@@ -51,73 +91,131 @@ const (
 )
 
 // Open 数据库启动时打开bitcask引擎实例
-func Open(options Options) (*DB, error) {
+func Open(options Options) (_ *DB, err error) {
 	//对用户传过来的配置项进行校验
 	if err := checkOptions(options); err != nil {
 		return nil, err
 	}
-	var isInitial bool
+	options = fillDefaultOptions(options)
+	openStart := time.Now()
+	//内存模式下所有文件都在内存文件系统中，不会访问磁盘
+	fs := fio.OSFileSystem
+	if options.InMemory {
+		fs = fio.MemFileSystem
+	}
+
+	//migrate已经写完了新文件但是没有移动完，目录中新旧文件混在一起
+	if fs.Exists(filepath.Join(migrateDirPath(options.DirPath), migrateFinishedKey)) {
+		return nil, ErrMigrateUnfinished
+	}
+
 	//对用户传过来的目录进行校验，如果不存在则创建目录
-	//需要注意的是，checkOptions函数是校验用户的传递参数，而Stat函数是真正检查是否存在目录并返回信息
-	if _, err := os.Stat(options.DirPath); os.IsNotExist(err) { //判断返回的错误是否表示目录不存在。
-		isInitial = true
-		if err := os.MkdirAll(options.DirPath, os.ModePerm); err != nil {
+	//需要注意的是，checkOptions函数是校验用户的传递参数，而Exists函数是真正检查是否存在目录
+	if !fs.Exists(options.DirPath) {
+		if err := fs.MkdirAll(options.DirPath); err != nil {
 			return nil, err
 		}
 	}
 
 	//尝试获取文件锁flock，没拿到就返回，保证单线程操作目录
 	//为了最后关闭，所以要放到我们的db结构体里
-	fileLock := flock.New(filepath.Join(options.DirPath, fileLockName))
-	hold, err := fileLock.TryRLock()
+	unlockDir, err := fs.TryLock(filepath.Join(options.DirPath, fileLockName))
 	if err != nil {
 		return nil, err
 	}
-	if !hold {
+	if unlockDir == nil {
+		optionsLogger(options).Warnf("directory %s is locked by another process", options.DirPath)
 		return nil, ErrDatabaseIsUsing
 	}
+	//打开失败时释放目录锁，否则之后再也打不开这个目录
+	defer func() {
+		if err != nil {
+			_ = unlockDir()
+		}
+	}()
 
-	//目录存在但是为空，没有文件，也为true
-	entries, err := os.ReadDir(options.DirPath)
-	if err != nil {
+	//检查数据目录记录的索引类型，b+树索引和内存索引不能直接切换
+	if err := checkIndexType(options, fs); err != nil {
 		return nil, err
 	}
-	if len(entries) == 0 {
-		isInitial = true
+
+	db, err := openDB(options, fs, unlockDir)
+	if err != nil {
+		optionsLogger(options).Errorf("failed to open %s: %v", options.DirPath, err)
+		return nil, err
 	}
+	db.startup.Total = time.Since(openStart)
+	db.logger.Infof("opened %s in %v: %d keys, %d data files, reclaimable %d bytes, seq no %d "+
+		"(merge %v, data files %v, checkpoint %v, hint %v, index %v, seq no %v)",
+		options.DirPath, db.startup.Total, db.index.Size(), len(db.fileIds), db.reclaimSize, db.seqNo,
+		db.startup.LoadMergeFiles, db.startup.LoadDataFiles, db.startup.LoadIndexCheckpoint,
+		db.startup.LoadIndexFromHint, db.startup.LoadIndexFromDataFiles, db.startup.LoadSeqNo)
+	return db, nil
+}
 
+// 加载数据目录，调用方需要持有目录锁
+func openDB(options Options, fs fio.FileSystem, unlockDir func() error) (*DB, error) {
 	//初始化db结构体
 	db := &DB{
 		options:    options,
 		mu:         new(sync.RWMutex),
+		statMu:     new(sync.Mutex),
 		olderFiles: make(map[uint32]*data.DataFile),
 		//根据用户传过来的类型而去创建相应的内存数据结构
 		index:     index.NewIndexer(options.IndexType, options.DirPath, options.SyncWrite),
-		isInitial: isInitial,
-		fileLock:  fileLock,
+		unlockDir: unlockDir,
+		fs:        fs,
+	}
+	db.streamCond = sync.NewCond(db.mu)
+	db.metrics = newDBMetrics(db)
+	db.logger = optionsLogger(options)
+	db.events = options.EventListener
+	if db.events == nil {
+		db.events = NoopEventListener{}
+	}
+	if options.ValueCacheSize > 0 {
+		db.cache = newValueCache(options.ValueCacheSize)
+	}
+
+	//记录每个阶段的耗时
+	phaseStart := time.Now()
+	endPhase := func(d *time.Duration) {
+		now := time.Now()
+		*d = now.Sub(phaseStart)
+		phaseStart = now
 	}
 
 	//加载merge数据目录
 	if err := db.loadMergeFiles(); err != nil {
 		return nil, err
 	}
+	endPhase(&db.startup.LoadMergeFiles)
 
 	//加载数据文件
 	if err := db.loadDataFiles(); err != nil {
 		return nil, err
 	}
+	endPhase(&db.startup.LoadDataFiles)
 
 	//如果是b+树索引，不需要从数据文件中加载索引
 	if options.IndexType != index.BPTree {
-		//从hint文件中加载索引
-		if err := db.loadIndexFromHint(); err != nil {
-			return nil, err
+		//从内存索引的快照中加载索引，只需要再读取快照之后写入的记录
+		checkpointMark := db.loadIndexCheckpoint()
+		endPhase(&db.startup.LoadIndexCheckpoint)
+
+		//没有可用的快照时从hint文件中加载索引
+		if checkpointMark == nil {
+			if err := db.loadIndexFromHint(); err != nil {
+				return nil, err
+			}
 		}
+		endPhase(&db.startup.LoadIndexFromHint)
 
 		//从数据文件中加载索引
-		if err := db.loadIndexFromDataFiles(); err != nil {
+		if err := db.loadIndexFromDataFiles(checkpointMark); err != nil {
 			return nil, err
 		}
+		endPhase(&db.startup.LoadIndexFromDataFiles)
 
 		//重置IO类型为标准文件IO
 		if db.options.MMapAtStartUp {
@@ -127,53 +225,104 @@ func Open(options Options) (*DB, error) {
 		}
 
 	} else {
-		//如果是B+树索引，需要打开特定文件取出最新事务号
-		err := db.loadSeqNo()
-		if err != nil {
-			return nil, err
-		}
-		if db.activeFile == nil {
-			size, err := db.activeFile.IoManager.Size()
+		//读一遍活跃文件找到真正的数据末尾，direct io的文件末尾可能有对齐填充的零值，崩溃时也可能有写了一半的记录
+		var activeSeqNo uint64
+		if db.activeFile != nil {
+			size, seqNo, torn, err := db.dataFileEnd(db.activeFile)
 			if err != nil {
 				return nil, err
 			}
-			db.activeFile.WriteOff = size
+			if err := db.setActiveFileEnd(size, torn); err != nil {
+				return nil, err
+			}
+			activeSeqNo = seqNo
 		}
+		//如果是B+树索引，需要取出最新事务号
+		if err := db.loadSeqNo(activeSeqNo); err != nil {
+			return nil, err
+		}
+		endPhase(&db.startup.LoadSeqNo)
 
 	}
 
+	//活跃文件开启写缓冲，需要在修正了文件的写入位置之后
+	if db.activeFile != nil && db.options.WriteBufferSize > 0 {
+		if err := db.activeFile.EnableWriteBuffer(db.options.WriteBufferSize, db.options.WriteBufferFlushInterval); err != nil {
+			return nil, err
+		}
+	}
+
+	//定时写入内存索引的快照
+	if db.options.IndexCheckpoint && db.options.IndexCheckpointInterval > 0 && options.IndexType != index.BPTree {
+		db.checkpointStop = make(chan struct{})
+		db.checkpointDone = make(chan struct{})
+		go db.runIndexCheckpoint(db.options.IndexCheckpointInterval, db.checkpointStop, db.checkpointDone)
+	}
 	return db, nil
 }
 
-// Stat 返回数据库相关统计信息
-func (db *DB) Stat() *Stat {
+// Stat 返回数据库相关统计信息，获取数据目录大小失败时返回错误
+func (db *DB) Stat() (*Stat, error) {
 	db.mu.RLock()
 	defer db.mu.RUnlock()
 	var dataFiles = uint(len(db.olderFiles))
 	if db.activeFile != nil {
 		dataFiles++
 	}
-	dirSize, err := utils.DirSize(db.options.DirPath)
+	dirSize, err := db.fs.DirSize(db.options.DirPath)
 	if err != nil {
-		panic(fmt.Sprintf("failed to get dir size :%v", err))
+		return nil, err
 	}
-	return &Stat{
+	stat := &Stat{
 		KeyNum:          uint(db.index.Size()),
 		DataFileNum:     dataFiles,
 		ReclaimableSize: db.reclaimSize,
 		DiskSize:        dirSize,
 	}
+	if db.cache != nil {
+		stat.CacheHits, stat.CacheMisses = db.cache.Stats()
+	}
+	if reporter, ok := db.index.(index.MemoryReporter); ok {
+		stat.IndexMemory = reporter.MemoryUsage()
+		if stat.KeyNum > 0 {
+			stat.IndexMemoryPerKey = float64(stat.IndexMemory) / float64(stat.KeyNum)
+		}
+	}
+	stat.Startup = db.startup
+	stat.Ops = db.ops.snapshot()
+	stat.LastMerge = db.lastMerge.Load()
+	return stat, nil
 }
 
-// BackUp 备份方法，拷贝目录，排除掉文件锁文件
+// BackUp 备份方法，拷贝目录，排除掉文件锁文件，内存模式下会备份到磁盘上的目录
 func (db *DB) BackUp(dir string) error {
+	return db.BackUpCtx(context.Background(), dir)
+}
+
+// BackUpCtx 和BackUp一样，每拷贝一个文件之前检查ctx
+// 取消时返回ctx.Err()，备份目录是这次新建的就删除掉，已经存在的目录中会留下拷贝了一部分的文件
+func (db *DB) BackUpCtx(ctx context.Context, dir string) error {
 	db.mu.RLock()
 	defer db.mu.RUnlock()
-	return utils.CopyFile(db.options.DirPath, dir, []string{fileLockName})
+	_, statErr := os.Stat(dir)
+	created := os.IsNotExist(statErr)
+	err := db.fs.CopyDir(ctx, db.options.DirPath, dir, []string{fileLockName})
+	if err != nil && ctx.Err() != nil {
+		if created {
+			_ = os.RemoveAll(dir)
+		}
+		return ctx.Err()
+	}
+	return err
 }
 
 // Put 写入key/value数据，key不能为空，如果有相关记录会替代原先数据
-func (db *DB) Put(key []byte, value []byte) error {
+func (db *DB) Put(key []byte, value []byte) (err error) {
+	db.ops.puts.Add(1)
+	start := time.Now()
+	defer func() {
+		db.metrics.put.observe(start, err)
+	}()
 	//判断key是否有效
 	if len(key) == 0 {
 		//一般通过判断别的方式而产生错误就需要自定义一些错误常量
@@ -182,13 +331,17 @@ func (db *DB) Put(key []byte, value []byte) error {
 
 	//构造LogRecord结构体
 	logRecord := &data.LogRecord{
-		//nonTxSeqNo代表不是通过batch提交，是单独提交
-		Key:   LogRecordKeyWithSeq(key, nonTxSeqNo),
+		Key:   key,
 		Value: value,
 		Type:  data.LogRecordNormal,
+		//nonTxSeqNo代表不是通过batch提交，是单独提交
+		SeqNo: nonTxSeqNo,
 	}
+	//写入和更新索引都在锁内完成，索引快照记录的高水位之前的记录都已经更新到索引
+	db.mu.Lock()
+	defer db.mu.Unlock()
 	//追加写入到当前活跃文件中
-	pos, err := db.appendLogRecordWithLock(logRecord)
+	pos, err := db.appendLogRecord(logRecord)
 	if err != nil {
 		return err
 	}
@@ -196,16 +349,27 @@ func (db *DB) Put(key []byte, value []byte) error {
 	//拿到内存索引以后更新内存索引
 	if oldPos := db.index.Put(key, pos); oldPos != nil {
 		db.reclaimSize += int64(oldPos.Size)
+		db.removeCache(oldPos)
+	}
+	if db.cache != nil {
+		db.cache.Put(pos, value)
 	}
 	return nil
 }
 
 // Delete 删除接口
-func (db *DB) Delete(key []byte) error {
+func (db *DB) Delete(key []byte) (err error) {
+	db.ops.deletes.Add(1)
+	start := time.Now()
+	defer func() {
+		db.metrics.delete.observe(start, err)
+	}()
 	//判断key是否有效
 	if len(key) == 0 {
 		return ErrKeyIsEmpty
 	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
 	//判断key是否存在，不存在则直接返回
 	logRecordPos := db.index.Get(key)
 	if logRecordPos == nil {
@@ -215,10 +379,11 @@ func (db *DB) Delete(key []byte) error {
 
 	//构造LogRecord结构体,删除的话不需要知道value值，删除这个key对应的记录就可以
 	logRecord := &data.LogRecord{
-		Key:  LogRecordKeyWithSeq(key, nonTxSeqNo),
-		Type: data.LogRecordDeleted,
+		Key:   key,
+		Type:  data.LogRecordDeleted,
+		SeqNo: nonTxSeqNo,
 	}
-	pos, err := db.appendLogRecordWithLock(logRecord)
+	pos, err := db.appendLogRecord(logRecord)
 	if err != nil {
 		return err
 	}
@@ -232,11 +397,17 @@ func (db *DB) Delete(key []byte) error {
 	}
 	if oldPos != nil {
 		db.reclaimSize += int64(oldPos.Size)
+		db.removeCache(oldPos)
 	}
 	return nil
 }
 
-func (db *DB) Get(key []byte) ([]byte, error) {
+func (db *DB) Get(key []byte) (_ []byte, err error) {
+	db.ops.gets.Add(1)
+	start := time.Now()
+	defer func() {
+		db.observeGet(start, err)
+	}()
 	db.mu.Lock()
 	defer db.mu.Unlock()
 
@@ -247,26 +418,54 @@ func (db *DB) Get(key []byte) ([]byte, error) {
 	return db.getValueByPos(logRecordPos)
 }
 
+// 记录一次读取的耗时和结果，key不存在不算失败，GetReader和GetRange也使用
+func (db *DB) observeGet(start time.Time, err error) {
+	if err == ErrKeyNotFound {
+		err = nil
+	}
+	db.metrics.get.observe(start, err)
+}
+
 // ListKeys 获取数据库中所有的key
 func (db *DB) ListKeys() [][]byte {
+	keys, _ := db.ListKeysCtx(context.Background())
+	return keys
+}
+
+// ListKeysCtx 和ListKeys一样，每个key之前检查ctx，取消时返回ctx.Err()
+func (db *DB) ListKeysCtx(ctx context.Context) ([][]byte, error) {
 	it := db.index.Iterator(false)
 	defer it.Close()
-	keys := make([][]byte, db.index.Size())
-	var idx int
+	keys := make([][]byte, 0, db.index.Size())
 	for it.Rewind(); it.Valid(); it.Next() {
-		keys[idx] = it.Key()
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		default:
+		}
+		keys = append(keys, it.Key())
 	}
-	return keys
+	return keys, nil
 }
 
 // Fold 获取所有数据，并执行用户指定的操作
 func (db *DB) Fold(fun func(key []byte, value []byte) bool) error {
+	return db.FoldCtx(context.Background(), fun)
+}
+
+// FoldCtx 和Fold一样，每个key之前检查ctx，取消时停止遍历并返回ctx.Err()
+func (db *DB) FoldCtx(ctx context.Context, fun func(key []byte, value []byte) bool) error {
 	db.mu.Lock()
 	defer db.mu.Unlock()
 
 	it := db.index.Iterator(false)
 	defer it.Close()
 	for it.Rewind(); it.Valid(); it.Next() {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
 		value, err := db.getValueByPos(it.Value())
 		if err != nil {
 			return err
@@ -279,12 +478,31 @@ func (db *DB) Fold(fun func(key []byte, value []byte) bool) error {
 	return nil
 }
 
-// Close 关闭数据库
-func (db *DB) Close() error {
+// Close 关闭数据库，已经关闭的数据库再次Close什么也不做
+func (db *DB) Close() (err error) {
+	//先停止定时写入索引快照，关闭时会再写入一次
+	//快照协程需要持有读锁，不能持有锁等待它退出
+	db.mu.Lock()
+	if db.closed {
+		db.mu.Unlock()
+		return nil
+	}
+	db.closed = true
+	checkpointStop, checkpointDone := db.checkpointStop, db.checkpointDone
+	db.checkpointStop = nil
+	db.mu.Unlock()
+	if checkpointStop != nil {
+		close(checkpointStop)
+		<-checkpointDone
+	}
+
 	defer func() {
-		err := db.fileLock.Close()
-		if err != nil {
-			panic(fmt.Sprintf("failed to unlock the directory,%v", err))
+		//释放目录锁失败时其他进程还是打不开这个目录，返回错误而不是panic
+		if unlockErr := db.unlockDir(); unlockErr != nil {
+			db.logger.Errorf("failed to unlock directory %s: %v", db.options.DirPath, unlockErr)
+			if err == nil {
+				err = unlockErr
+			}
 		}
 	}()
 
@@ -294,14 +512,19 @@ func (db *DB) Close() error {
 	db.mu.Lock()
 	defer db.mu.Unlock()
 
+	//写入内存索引的快照，快照只是为了加快启动，写入失败时启动会读取数据文件
+	if err := db.writeIndexCheckpoint(); err != nil {
+		db.logger.Warnf("failed to write index checkpoint: %v", err)
+	}
+
 	//b+树实例，boltdb需要关闭我们的索引
-	err := db.index.Close()
+	err = db.index.Close()
 	if err != nil {
 		return err
 	}
 
 	//关闭时保存事务序列号
-	seqNoFile, err := data.OpenSeqNoFile(db.options.DirPath)
+	seqNoFile, err := data.OpenSeqNoFile(db.options.DirPath, db.fileIOType(), db.options.Checksum, db.options.IOOpener)
 	if err != nil {
 		return err
 	}
@@ -311,7 +534,7 @@ func (db *DB) Close() error {
 		Value: []byte(strconv.FormatUint(db.seqNo, 10)),
 	}
 
-	encRecord, _ := data.EncodeLogRecord(logRecord)
+	encRecord, _ := data.EncodeLogRecord(logRecord, seqNoFile.Checksum)
 	err = seqNoFile.Write(encRecord)
 	if err != nil {
 		return err
@@ -337,6 +560,18 @@ func (db *DB) Close() error {
 	return nil
 }
 
+// Destroy 关闭数据库并删除目录中所有的数据，包括没有完成的merge目录，已经Close过的数据库也可以调用
+// 内存模式的数据保存在进程内的内存文件系统中，Close以后仍然保留，不再使用时需要调用Destroy释放内存
+func (db *DB) Destroy() error {
+	if err := db.Close(); err != nil {
+		return err
+	}
+	if err := db.fs.RemoveAll(db.getMergePath()); err != nil {
+		return err
+	}
+	return db.fs.RemoveAll(db.options.DirPath)
+}
+
 // Sync 对活跃文件进行持久化
 func (db *DB) Sync() error {
 	if db.activeFile == nil {
@@ -344,7 +579,44 @@ func (db *DB) Sync() error {
 	}
 	db.mu.Lock()
 	defer db.mu.Unlock()
-	return db.activeFile.Sync()
+	return db.syncDataFile(db.activeFile)
+}
+
+// Verify 读取所有数据文件中的记录并校验crc，返回遇到的第一个损坏的记录
+// 不受SkipChecksumOnRead影响，校验期间不阻塞读写
+func (db *DB) Verify() error {
+	db.mu.RLock()
+	var dataFiles []*data.DataFile
+	for _, file := range db.olderFiles {
+		dataFiles = append(dataFiles, file)
+	}
+	var activeFile *data.DataFile
+	var activeEnd int64
+	if db.activeFile != nil {
+		activeFile, activeEnd = db.activeFile, db.activeFile.WriteOff
+		dataFiles = append(dataFiles, activeFile)
+	}
+	db.mu.RUnlock()
+
+	sort.Slice(dataFiles, func(i, j int) bool {
+		return dataFiles[i].FileId < dataFiles[j].FileId
+	})
+	for _, dataFile := range dataFiles {
+		offset := dataFile.HeaderSize()
+		//活跃文件只校验到开始校验时写到的位置
+		for dataFile != activeFile || offset < activeEnd {
+			_, size, err := dataFile.ReadLogRecord(offset)
+			if err != nil {
+				if err == io.EOF {
+					break
+				}
+				db.checkCorruption(dataFile.FileId, offset, err)
+				return fmt.Errorf("data file %d at offset %d: %w", dataFile.FileId, offset, err)
+			}
+			offset += size
+		}
+	}
+	return nil
 }
 
 // 根据logRecordPos去找到相应的value值
@@ -354,20 +626,13 @@ func (db *DB) getValueByPos(logRecordPos *data.LogRecordPos) ([]byte, error) {
 		return nil, ErrKeyNotFound
 	}
 
-	//根据索引提供的id去找对应的文件
-	var file *data.DataFile
-	if db.activeFile.FileId == logRecordPos.Fid {
-		file = db.activeFile
-	} else {
-		file = db.olderFiles[logRecordPos.Fid]
-	}
-
-	//如果找不到文件则抛出相应错误
-	if file == nil {
-		return nil, ErrDataFileNotFound
+	//先从缓存中获取
+	if db.cache != nil {
+		if value, ok := db.cache.Get(logRecordPos); ok {
+			return value, nil
+		}
 	}
-	//根据偏移量去读取响应数据并返回
-	LogRecord, _, err := file.ReadLogRecord(logRecordPos.Offset)
+	LogRecord, err := db.readLogRecordAt(logRecordPos)
 	if err != nil {
 		return nil, err
 	}
@@ -376,10 +641,53 @@ func (db *DB) getValueByPos(logRecordPos *data.LogRecordPos) ([]byte, error) {
 	if LogRecord.Type == data.LogRecordDeleted {
 		return nil, ErrKeyNotFound
 	}
+	//分块存储的大value，读取所有的分块拼起来
+	if LogRecord.Flags&data.LogRecordFlagChunked != 0 {
+		return db.readChunkedValue(LogRecord.Value)
+	}
 
+	if db.cache != nil {
+		db.cache.Put(logRecordPos, LogRecord.Value)
+	}
 	return LogRecord.Value, nil
 }
 
+// 根据文件id获取数据文件，不存在时返回nil
+func (db *DB) getDataFile(fid uint32) *data.DataFile {
+	if db.activeFile != nil && db.activeFile.FileId == fid {
+		return db.activeFile
+	}
+	return db.olderFiles[fid]
+}
+
+// 根据位置读取一条记录，需要在持有锁的情况下调用
+func (db *DB) readLogRecordAt(logRecordPos *data.LogRecordPos) (*data.LogRecord, error) {
+	//根据索引提供的id去找对应的文件
+	file := db.getDataFile(logRecordPos.Fid)
+
+	//如果找不到文件则抛出相应错误
+	if file == nil {
+		return nil, ErrDataFileNotFound
+	}
+	//根据偏移量去读取响应数据并返回
+	readLogRecord := file.ReadLogRecord
+	if db.options.SkipChecksumOnRead {
+		readLogRecord = file.ReadLogRecordNoVerify
+	}
+	logRecord, _, err := readLogRecord(logRecordPos.Offset)
+	if err != nil {
+		db.checkCorruption(logRecordPos.Fid, logRecordPos.Offset, err)
+	}
+	return logRecord, err
+}
+
+// 清除旧位置的value缓存，key被删除或者覆盖时调用
+func (db *DB) removeCache(pos *data.LogRecordPos) {
+	if db.cache != nil {
+		db.cache.Remove(pos)
+	}
+}
+
 func (db *DB) appendLogRecordWithLock(logRecord *data.LogRecord) (*data.LogRecordPos, error) {
 	db.mu.Lock()
 	defer db.mu.Unlock()
@@ -396,20 +704,19 @@ func (db *DB) appendLogRecord(logRecord *data.LogRecord) (*data.LogRecordPos, er
 		}
 	}
 
+	//记录写入的时间，merge重写的记录保留原来的时间
+	if logRecord.Timestamp == 0 {
+		logRecord.Timestamp = time.Now().UnixNano()
+	}
 	//将logRecord转化为字节数组写入到文件中
-	encRecord, size := data.EncodeLogRecord(logRecord)
+	//活跃文件的校验算法总是和配置一致，见下面切换活跃文件的条件
+	encRecord, size := data.EncodeLogRecord(logRecord, db.options.Checksum)
 
 	//如果写入的数据已经达到了活跃文件的阈值，则关闭活跃文件并打开新的文件
-	if db.activeFile.WriteOff+size > db.options.DataFileSize {
-		//因为要关闭，所以要先将当前的活跃文件进行持久化
-		if err := db.activeFile.Sync(); err != nil {
-			return nil, err
-		}
-		//当前活跃文件转化为旧的数据文件
-		db.olderFiles[db.activeFile.FileId] = db.activeFile
-
-		//设置新的活跃文件
-		if err := db.setActiveDataFile(); err != nil {
+	//旧版本格式或者校验算法和配置不一致的活跃文件不再追加写，新的记录写到新的文件中
+	if db.activeFile.WriteOff+size > db.options.DataFileSize || db.activeFile.Version != data.CurrentFileFormat ||
+		db.activeFile.Checksum != db.options.Checksum {
+		if err := db.rotateActiveFile(); err != nil {
 			return nil, err
 		}
 	}
@@ -420,7 +727,11 @@ func (db *DB) appendLogRecord(logRecord *data.LogRecord) (*data.LogRecordPos, er
 		return nil, err
 	}
 
+	//开启了写缓冲时这里累计的是写入缓冲区的字节数，下面的Sync会先把缓冲区写入文件再持久化，
+	//所以BytesPerSync同样限制了写缓冲中最多可能丢失的数据量
 	db.bytesWrite += uint(size)
+	db.ops.bytesWritten.Add(uint64(size))
+	db.metrics.bytesWritten.Add(uint64(size))
 
 	var needSync = db.options.SyncWrite
 	if !needSync && db.options.BytesPerSync > 0 && db.bytesWrite > db.options.BytesPerSync {
@@ -429,7 +740,7 @@ func (db *DB) appendLogRecord(logRecord *data.LogRecord) (*data.LogRecordPos, er
 
 	//根据用户配置项决定是否持久化
 	if needSync {
-		if err := db.activeFile.Sync(); err != nil {
+		if err := db.syncDataFile(db.activeFile); err != nil {
 			return nil, err
 		}
 		//清空累计值
@@ -442,10 +753,46 @@ func (db *DB) appendLogRecord(logRecord *data.LogRecord) (*data.LogRecordPos, er
 	pos := &data.LogRecordPos{
 		Fid:    db.activeFile.FileId,
 		Offset: writeOff,
+		Size:   uint32(size),
 	}
+	db.addHintEntry(logRecord, pos)
 	return pos, nil
 }
 
+// 把活跃文件转化为旧的数据文件，并打开新的活跃文件
+func (db *DB) rotateActiveFile() (err error) {
+	start := time.Now()
+	defer func() {
+		db.metrics.rotate.observe(start, err)
+	}()
+	//因为要关闭，所以要先将当前的活跃文件进行持久化
+	if err := db.syncDataFile(db.activeFile); err != nil {
+		return err
+	}
+	//写入旧文件的hint文件，hint文件只是为了加快启动，写入失败时启动会读取数据文件，不影响这次写入
+	if db.hintComplete {
+		if err := db.writeDataHint(db.activeFile.FileId, db.hintEntries, db.activeFile.WriteOff); err != nil {
+			db.logger.Warnf("failed to write hint file of data file %d: %v", db.activeFile.FileId, err)
+		}
+	}
+	//当前活跃文件转化为旧的数据文件
+	oldFile := db.activeFile
+	db.olderFiles[oldFile.FileId] = oldFile
+
+	//设置新的活跃文件
+	if err := db.setActiveDataFile(); err != nil {
+		return err
+	}
+	db.logger.Infof("rotated data file %d (%d bytes), new active file %d", oldFile.FileId, oldFile.WriteOff, db.activeFile.FileId)
+	db.events.OnFileRotated(FileRotatedInfo{
+		FileId:    oldFile.FileId,
+		Path:      data.GetDataFileName(db.options.DirPath, oldFile.FileId),
+		Size:      oldFile.WriteOff,
+		NewFileId: db.activeFile.FileId,
+	})
+	return nil
+}
+
 // 设置当前活跃文件
 // 在并发访问该db实例并修改共同资源时，需要上互斥锁
 func (db *DB) setActiveDataFile() error {
@@ -454,18 +801,32 @@ func (db *DB) setActiveDataFile() error {
 		initialFileId = db.activeFile.FileId + 1 //当前活跃文件已过期，设置它的下一个为活跃文件
 	}
 	//在配置文件给定的目录下，打开新的数据文件
-	dataFile, err := data.OpenDataFile(db.options.DirPath, initialFileId, fio.StandardFIO)
+	dataFile, err := data.OpenDataFile(db.options.DirPath, initialFileId, db.dataFileIOType(), db.options.Checksum, db.options.IOOpener)
 	if err != nil {
 		return err
 	}
+	//预分配整个数据文件的空间，之后的追加写不需要再分配磁盘块
+	if db.options.PreAllocate {
+		if err := dataFile.Preallocate(db.options.DataFileSize); err != nil {
+			return err
+		}
+	}
+	if db.options.WriteBufferSize > 0 {
+		if err := dataFile.EnableWriteBuffer(db.options.WriteBufferSize, db.options.WriteBufferFlushInterval); err != nil {
+			return err
+		}
+	}
 	db.activeFile = dataFile
+	//新的活跃文件是空的，从这里开始记录hint
+	db.hintEntries = nil
+	db.hintComplete = db.options.IndexType != index.BPTree
 	return nil
 }
 
 // 从磁盘中加载数据文件
 func (db *DB) loadDataFiles() error {
 	//读取目录，并返回一个文件切片
-	dirs, err := os.ReadDir(db.options.DirPath)
+	dirs, err := db.fs.ReadDir(db.options.DirPath)
 	if err != nil {
 		return err
 	}
@@ -473,9 +834,9 @@ func (db *DB) loadDataFiles() error {
 	var fileIds []int
 	for _, dir := range dirs {
 		//如果是.data结尾的文件
-		if strings.HasSuffix(dir.Name(), data.DataFileNameSuffix) {
+		if strings.HasSuffix(dir, data.DataFileNameSuffix) {
 			//00001.data ->  00001 -> 1
-			splitName := strings.Split(dir.Name(), ".")
+			splitName := strings.Split(dir, ".")
 			fileId, err := strconv.Atoi(splitName[0])
 			if err != nil {
 				//文件已损坏
@@ -491,20 +852,22 @@ func (db *DB) loadDataFiles() error {
 
 	//遍历每个文件id并对文件进行打开操作
 	for i, fileId := range fileIds {
-		ioType := fio.StandardFIO
-		if db.options.MMapAtStartUp {
+		//活跃文件加载完以后可能需要截断崩溃时写了一半的记录，所以不使用mmap
+		ioType := db.dataFileIOType()
+		if db.options.MMapAtStartUp && !db.options.InMemory && i != len(fileIds)-1 {
 			ioType = fio.MemoryMap
 		}
-		dataFile, err := data.OpenDataFile(db.options.DirPath, uint32(fileId), ioType)
+		dataFile, err := data.OpenDataFile(db.options.DirPath, uint32(fileId), ioType, db.options.Checksum, db.options.IOOpener)
 		if err != nil {
 			return err
 		}
 		//打开每个文件并加入到旧文件map或者活跃文件当中
 		if i == len(fileIds)-1 {
 			db.activeFile = dataFile
+		} else {
+			//旧文件放到map里
+			db.olderFiles[uint32(fileId)] = dataFile
 		}
-		//旧文件放到map里
-		db.olderFiles[uint32(fileId)] = dataFile
 	}
 	return nil
 }
@@ -512,8 +875,8 @@ func (db *DB) loadDataFiles() error {
 //fixme 注释加上
 
 // 从数据文件中加载索引
-// 遍历文件中所有记录，并更新到索引上去
-func (db *DB) loadIndexFromDataFiles() error {
+// 遍历文件中所有记录，并更新到索引上去，start不为nil时只加载索引快照的高水位之后的记录
+func (db *DB) loadIndexFromDataFiles(start *data.LogRecordPos) error {
 	//如果是空文件则直接返回
 	if len(db.fileIds) == 0 {
 		return nil
@@ -523,7 +886,7 @@ func (db *DB) loadIndexFromDataFiles() error {
 	//查看是否发生过merge
 	hasMerge, noMergeFileId := false, uint32(0)
 	mergeFinFileName := filepath.Join(db.options.DirPath, data.MergeFinishedFileName)
-	if _, err := os.Stat(mergeFinFileName); err == nil {
+	if db.fs.Exists(mergeFinFileName) {
 		fid, err := db.getNonMergeFileId(db.options.DirPath)
 		if err != nil {
 			return err
@@ -548,77 +911,196 @@ func (db *DB) loadIndexFromDataFiles() error {
 	//暂存事务的数据，直到碰到fin记录，就将该map遍历更新索引
 	txRecord := make(map[uint64][]*data.TxRecord)
 
-	//当前事务序列号
-	var currentSeqNo uint64 = nonTxSeqNo
+	//当前事务序列号，从索引快照中加载时是快照中的事务序列号
+	var currentSeqNo = db.seqNo
+
+	//处理一条记录，数据文件和数据文件的hint文件中读取的记录都在这里更新到索引
+	handleRecord := func(logRecord *data.LogRecord, logRecordPos *data.LogRecordPos) {
+		//拿到事务序列号和key
+		realKey, seqNo := logRecord.Key, logRecord.SeqNo
+		//若不是事务操作，则直接更新索引
+		if seqNo == nonTxSeqNo {
+			updateIndexFunc(realKey, logRecord.Type, logRecordPos)
+		} else {
+			//事务完成，对应的事务号能直接更新到索引当中
+			if logRecord.Type == data.LogRecordFinished {
+				for _, txRecord := range txRecord[seqNo] {
+					updateIndexFunc(txRecord.Record.Key, txRecord.Record.Type, txRecord.Pos)
+				}
+				delete(txRecord, seqNo)
+			} else {
+				//batch中间的记录，还未到fin记录
+				txRecord[seqNo] = append(txRecord[seqNo], &data.TxRecord{
+					Record: logRecord,
+					Pos:    logRecordPos,
+				})
+			}
+
+		}
+		//更新事务序列号
+		if seqNo > currentSeqNo {
+			currentSeqNo = seqNo
+		}
+	}
 
-	//遍历所有文件取出所有文件当中的内容
-	for i, fid := range db.fileIds {
+	//需要加载的文件
+	var dataFiles []*data.DataFile
+	for _, fid := range db.fileIds {
 		var fileId = uint32(fid)
 		//如果加载过hint文件中的数据就跳过，无需去数据文件再加载一遍
 		if hasMerge && fileId < noMergeFileId {
 			continue
 		}
-		//拿到当前文件
-		var dataFile *data.DataFile
-		if i == len(db.fileIds)-1 {
-			dataFile = db.activeFile
+		//索引快照中已经包含的文件
+		if start != nil && fileId < start.Fid {
+			continue
+		}
+		if fileId == db.activeFile.FileId {
+			dataFiles = append(dataFiles, db.activeFile)
 		} else {
-			dataFile = db.olderFiles[fileId]
+			dataFiles = append(dataFiles, db.olderFiles[fileId])
 		}
+	}
 
-		//读取当前文件的所有的内容
-		var offset int64 = 0
-		for {
-			logRecord, size, err := dataFile.ReadLogRecord(offset)
-			if err != nil {
-				if err == io.EOF {
-					break
-				}
+	//多个文件并发读取，读取的结果按照文件id从小到大的顺序更新到索引，保证后写入的数据覆盖先写入的数据，事务也能正确处理
+	//sem限制同时读取和读取完但还没有更新到索引的文件数量，避免占用过多的内存
+	results := make([]chan *dataFileIndex, len(dataFiles))
+	for i := range results {
+		results[i] = make(chan *dataFileIndex, 1)
+	}
+	sem := make(chan struct{}, db.options.IndexLoadParallelism)
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	//出错返回时等待正在读取的文件读完，之后不会再访问数据文件
+	defer func() {
+		close(done)
+		wg.Wait()
+	}()
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i, dataFile := range dataFiles {
+			select {
+			case sem <- struct{}{}:
+			case <-done:
+				return
+			}
+			wg.Add(1)
+			offset := dataFile.HeaderSize()
+			if start != nil && dataFile.FileId == start.Fid {
+				offset = start.Offset
+			}
+			go func(i int, dataFile *data.DataFile, offset int64) {
+				defer wg.Done()
+				results[i] <- db.loadDataFileIndex(dataFile, dataFile == db.activeFile, offset)
+			}(i, dataFile, offset)
+		}
+	}()
+
+	for i, dataFile := range dataFiles {
+		result := <-results[i]
+		if result.err != nil {
+			return result.err
+		}
+		for _, entry := range result.entries {
+			handleRecord(entry.record, entry.pos)
+		}
+		//如果是当前活跃文件，更新这个文件的 WriteOff，之后的零值尾部不会被当成数据
+		if dataFile == db.activeFile {
+			if err := db.setActiveFileEnd(result.end, result.torn); err != nil {
 				return err
 			}
+			//只读取了一部分的活跃文件切换时不能写hint文件
+			db.hintEntries = result.entries
+			db.hintComplete = !result.partial
+		}
+		<-sem
+	}
+	//更新事务序列号
+	db.seqNo = currentSeqNo
+	return nil
+}
 
-			//构建内存索引并保存
-			logRecordPos := &data.LogRecordPos{Fid: fileId, Offset: offset, Size: uint32(size)}
+// 一个数据文件中读取到的索引信息
+type dataFileIndex struct {
+	entries []*hintEntry
+	end     int64 //数据文件的末尾
+	partial bool  //没有从文件开头读取
+	torn    bool  //活跃文件的末尾有写了一半的记录
+	err     error
+}
 
-			//解析key，拿到事务序列号和key
-			realKey, seqNo := ParseLogRecordKey(logRecord.Key)
-			//若不是事务操作，则直接更新索引
-			if seqNo == nonTxSeqNo {
-				updateIndexFunc(realKey, logRecord.Type, logRecordPos)
-			} else {
-				//事务完成，对应的事务号能直接更新到索引当中
-				if logRecord.Type == data.LogRecordFinished {
-					for _, txRecord := range txRecord[seqNo] {
-						updateIndexFunc(txRecord.Record.Key, txRecord.Record.Type, txRecord.Pos)
-					}
-					delete(txRecord, seqNo)
-				} else {
-					//batch中间的记录，还未到fin记录
-					logRecord.Key = realKey
-					txRecord[seqNo] = append(txRecord[seqNo], &data.TxRecord{
-						Record: logRecord,
-						Pos:    logRecordPos,
-					})
-				}
+// 读取一个数据文件中从offset开始的所有记录的索引信息，可以并发调用
+// 旧的数据文件优先从它的hint文件中读取，不需要读取value
+// 活跃文件总是读取数据文件，需要找到数据的末尾，并且记录切换时要写入hint文件的内容
+func (db *DB) loadDataFileIndex(dataFile *data.DataFile, isActive bool, offset int64) *dataFileIndex {
+	partial := offset != dataFile.HeaderSize()
+	if !isActive && !partial {
+		if entries, ok := db.loadDataHint(dataFile); ok {
+			return &dataFileIndex{entries: entries}
+		}
+	}
 
+	//没有可用的hint文件，读取数据文件的同时记录下来，读完以后补写hint文件
+	var entries []*hintEntry
+	var torn bool
+	for {
+		logRecord, size, err := dataFile.ReadLogRecord(offset)
+		if err != nil {
+			if err == io.EOF {
+				break
 			}
-			//更新事务序列号
-			if seqNo > currentSeqNo {
-				currentSeqNo = seqNo
+			//活跃文件的末尾是崩溃时写了一半的记录，后面会截断掉
+			if isActive && isTornTail(dataFile, offset, err) {
+				torn = true
+				break
 			}
+			db.checkCorruption(dataFile.FileId, offset, err)
+			return &dataFileIndex{err: err}
+		}
 
-			//递增offset
+		//分块只能通过分块清单找到，不需要加入索引
+		if logRecord.Type == data.LogRecordChunk {
 			offset += size
+			continue
+		}
 
+		//构建内存索引并保存
+		logRecordPos := &data.LogRecordPos{Fid: dataFile.FileId, Offset: offset, Size: uint32(size)}
+		//分块存储的value，记录的大小包括所有的分块，覆盖或者删除以后都可以回收
+		if logRecord.Flags&data.LogRecordFlagChunked != 0 {
+			chunked, err := data.DecodeChunkedValue(logRecord.Value)
+			if err != nil {
+				return &dataFileIndex{err: err}
+			}
+			logRecordPos.Size = chunked.DiskSize(size)
 		}
-		//如果是当前活跃文件，更新这个文件的 WriteOff
-		if i == len(db.fileIds)-1 {
-			db.activeFile.WriteOff = offset
+		entries = append(entries, &hintEntry{
+			record: &data.LogRecord{Key: logRecord.Key, Type: logRecord.Type, SeqNo: logRecord.SeqNo},
+			pos:    logRecordPos,
+		})
+
+		//递增offset
+		offset += size
+	}
+	if !isActive && !partial {
+		//补写hint文件，下次启动就不需要再读取这个数据文件了，写入失败也不影响这次启动
+		if err := db.writeDataHint(dataFile.FileId, entries, offset); err != nil {
+			db.logger.Warnf("failed to write hint file of data file %d: %v", dataFile.FileId, err)
 		}
-		//更新事务序列号
-		db.seqNo = currentSeqNo
 	}
-	return nil
+	return &dataFileIndex{entries: entries, end: offset, partial: partial, torn: torn}
+}
+
+// 后来新增的配置项在没有设置时为0，使用默认值，不是通过DefaultOptions构造的配置仍然可以打开
+func fillDefaultOptions(options Options) Options {
+	if options.ValueChunkSize == 0 {
+		options.ValueChunkSize = DefaultOptions.ValueChunkSize
+	}
+	if options.IndexLoadParallelism == 0 {
+		options.IndexLoadParallelism = DefaultOptions.IndexLoadParallelism
+	}
+	return options
 }
 
 // 校验用户配置文件合法性
@@ -630,24 +1112,63 @@ func checkOptions(options Options) error {
 		return errors.New("database data file size must be greater than 0")
 	}
 	if options.DataFileMergeRatio < 0 || options.DataFileMergeRatio > 1 {
-		errors.New("database file merge ratio， must between 0 and 1")
+		return errors.New("database file merge ratio， must between 0 and 1")
+	}
+	if options.InMemory && options.IndexType == index.BPTree {
+		return errors.New("database in memory mode does not support bptree index")
+	}
+	if options.WriteBufferSize < 0 {
+		return errors.New("database write buffer size must not be negative")
+	}
+	if options.ValueCacheSize < 0 {
+		return errors.New("database value cache size must not be negative")
+	}
+	if options.ValueChunkSize < 0 {
+		return errors.New("database value chunk size must not be negative")
+	}
+	if options.Checksum != data.ChecksumIEEE && options.Checksum != data.ChecksumCRC32C {
+		return data.ErrUnsupportedChecksum
+	}
+	if options.IndexLoadParallelism < 0 {
+		return errors.New("database index load parallelism must not be negative")
 	}
 
 	return nil
 }
 
 // 加载seqNo文件
-func (db *DB) loadSeqNo() error {
+// 正常关闭时写入的seq-no文件中就是最新的事务序列号，
+// 没有正常关闭时，取b+树索引中和批量提交一起持久化的序列号与活跃文件中最大的序列号两者中较大的，
+// 都没有时再往前到旧的数据文件中查找，保证之后的批量写入不会重复使用已经写入过的序列号
+func (db *DB) loadSeqNo(activeSeqNo uint64) error {
 	fileName := filepath.Join(db.options.DirPath, data.SeqNoFileName)
-	if _, err := os.Stat(fileName); os.IsNotExist(err) {
-		return err
+	if !db.fs.Exists(fileName) {
+		seqNo := activeSeqNo
+		if store, ok := db.index.(index.SeqNoStore); ok {
+			savedSeqNo, err := store.LoadSeqNo()
+			if err != nil {
+				return err
+			}
+			if savedSeqNo > seqNo {
+				seqNo = savedSeqNo
+			}
+		}
+		if seqNo == nonTxSeqNo {
+			olderSeqNo, err := db.lastSeqNoInOlderFiles()
+			if err != nil {
+				return err
+			}
+			seqNo = olderSeqNo
+		}
+		db.seqNo = seqNo
+		return nil
 	}
 	//打开seqno file，并读取我们要的最新事务序列号
-	seqNoFile, err := data.OpenSeqNoFile(fileName)
+	seqNoFile, err := data.OpenSeqNoFile(db.options.DirPath, db.fileIOType(), db.options.Checksum, db.options.IOOpener)
 	if err != nil {
 		return err
 	}
-	record, _, err := seqNoFile.ReadLogRecord(0)
+	record, _, err := seqNoFile.ReadLogRecord(seqNoFile.HeaderSize())
 	if err != nil {
 		return err
 	}
@@ -656,23 +1177,129 @@ func (db *DB) loadSeqNo() error {
 		return err
 	}
 	//赋给db.seqNo
+	if activeSeqNo > seqNo {
+		seqNo = activeSeqNo
+	}
 	db.seqNo = seqNo
-	db.seqNoFileExists = true
-	return os.Remove(fileName)
+	if err := seqNoFile.Close(); err != nil {
+		return err
+	}
+	return db.fs.Remove(fileName)
 }
 
-// 将数据文件的IO方式变为标准IO
+// 将数据文件的IO方式变为读写数据文件使用的IO
 func (db *DB) resetToType() error {
 	if db.activeFile == nil {
 		return nil
 	}
-	if err := db.activeFile.SetIOManager(db.options.DirPath, fio.StandardFIO); err != nil {
+	if err := db.activeFile.SetIOManager(db.options.DirPath, db.dataFileIOType(), db.options.IOOpener); err != nil {
+		return err
+	}
+	//换了io以后需要重新告诉它真正的数据末尾
+	if err := db.activeFile.SetWriteOff(db.activeFile.WriteOff); err != nil {
 		return err
 	}
 	for _, file := range db.olderFiles {
-		if err := file.SetIOManager(db.options.DirPath, fio.StandardFIO); err != nil {
+		if err := file.SetIOManager(db.options.DirPath, db.dataFileIOType(), db.options.IOOpener); err != nil {
 			return err
 		}
 	}
 	return nil
 }
+
+// 读写数据文件使用的IO类型
+func (db *DB) dataFileIOType() fio.FileIOType {
+	if db.options.InMemory {
+		return fio.MemoryIO
+	}
+	if db.options.DirectIO {
+		return fio.DirectIO
+	}
+	return fio.StandardFIO
+}
+
+// hint、merge完成标识、事务序列号这些辅助文件使用的IO类型
+func (db *DB) fileIOType() fio.FileIOType {
+	if db.options.InMemory {
+		return fio.MemoryIO
+	}
+	return fio.StandardFIO
+}
+
+// 读取数据文件中的所有记录，找到真正的数据末尾，末尾崩溃时写了一半的记录不算在内
+// 同时返回文件中最大的事务序列号，以及末尾是否有写了一半的记录
+func (db *DB) dataFileEnd(dataFile *data.DataFile) (int64, uint64, bool, error) {
+	offset := dataFile.HeaderSize()
+	var seqNo uint64
+	for {
+		logRecord, size, err := dataFile.ReadLogRecord(offset)
+		if err != nil {
+			if err == io.EOF {
+				return offset, seqNo, false, nil
+			}
+			if isTornTail(dataFile, offset, err) {
+				return offset, seqNo, true, nil
+			}
+			db.checkCorruption(dataFile.FileId, offset, err)
+			return 0, 0, false, err
+		}
+		if logRecord.SeqNo > seqNo {
+			seqNo = logRecord.SeqNo
+		}
+		offset += size
+	}
+}
+
+// 从新到旧在旧的数据文件中查找最大的事务序列号，序列号是递增的，找到第一个有事务记录的文件就可以停止
+func (db *DB) lastSeqNoInOlderFiles() (uint64, error) {
+	for i := len(db.fileIds) - 1; i >= 0; i-- {
+		dataFile := db.olderFiles[uint32(db.fileIds[i])]
+		if dataFile == nil {
+			continue
+		}
+		_, seqNo, _, err := db.dataFileEnd(dataFile)
+		if err != nil {
+			return 0, err
+		}
+		if seqNo != nonTxSeqNo {
+			return seqNo, nil
+		}
+	}
+	return nonTxSeqNo, nil
+}
+
+// 设置活跃文件的数据末尾，之后如果还有崩溃时写了一半的数据就截断掉，否则追加写会接在这些数据后面
+// torn表示末尾有写了一半的记录，截断以后通知监听者，预分配或者对齐填充的零值不算
+func (db *DB) setActiveFileEnd(offset int64, torn bool) error {
+	size, err := db.activeFile.IoManager.Size()
+	if err != nil {
+		return err
+	}
+	if size > offset {
+		if err := db.activeFile.Truncate(offset); err != nil {
+			return err
+		}
+		if torn {
+			db.logger.Warnf("truncated torn record at the end of data file %d: %d -> %d bytes", db.activeFile.FileId, size, offset)
+			db.events.OnRecoveryTruncated(RecoveryTruncatedInfo{FileId: db.activeFile.FileId, Offset: offset, Size: size})
+		}
+		return nil
+	}
+	return db.activeFile.SetWriteOff(offset)
+}
+
+// 是否是损坏的记录：记录超出了文件末尾，或者crc校验不通过
+// 可能是崩溃时写了一半的记录，也可能是文件中间的数据损坏，需要用isTornTail区分
+func isCorruptRecord(err error) bool {
+	return err == io.ErrUnexpectedEOF || err == data.ErrInvalidCRC
+}
+
+// 数据文件从offset开始读取记录出错时，是否是崩溃时末尾写了一半的记录，可以截断掉
+// 后面还有数据的损坏记录返回false，截断会丢掉它后面所有已经提交的记录
+func isTornTail(dataFile *data.DataFile, offset int64, err error) bool {
+	if !isCorruptRecord(err) {
+		return false
+	}
+	torn, tailErr := dataFile.IsTornTail(offset)
+	return tailErr == nil && torn
+}
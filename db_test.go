@@ -1 +1,511 @@
 package lovedb
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"lovedb/data"
+	"lovedb/fio"
+	"lovedb/index"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// 内存模式的测试实例，不会访问磁盘，可以并行执行
+func openInMemoryDB(t *testing.T) (*DB, Options) {
+	opts := DefaultOptions
+	opts.DirPath = filepath.Join("/lovedb-mem", t.Name())
+	opts.InMemory = true
+	opts.DataFileSize = 32 * 1024
+	opts.DataFileMergeRatio = 0
+	t.Cleanup(func() {
+		_ = fio.MemFileSystem.RemoveAll(opts.DirPath)
+	})
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+	return db, opts
+}
+
+func testKey(i int) []byte {
+	return []byte(fmt.Sprintf("lovedb-key-%09d", i))
+}
+
+func testValue(i int) []byte {
+	return []byte(fmt.Sprintf("lovedb-value-%09d", i))
+}
+
+func TestOpen_InMemory(t *testing.T) {
+	t.Parallel()
+	db, opts := openInMemoryDB(t)
+
+	//写入足够多的数据，触发活跃文件的切换
+	for i := 0; i < 2000; i++ {
+		assert.Nil(t, db.Put(testKey(i), testValue(i)))
+	}
+	for i := 0; i < 1000; i++ {
+		assert.Nil(t, db.Delete(testKey(i)))
+	}
+	assert.Greater(t, len(db.olderFiles), 1)
+	assert.Nil(t, db.Close())
+
+	//重新打开，数据依然存在
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	for i := 0; i < 2000; i++ {
+		val, err := db.Get(testKey(i))
+		if i < 1000 {
+			assert.Equal(t, ErrKeyNotFound, err)
+		} else {
+			assert.Nil(t, err)
+			assert.Equal(t, testValue(i), val)
+		}
+	}
+	assert.Nil(t, db.Close())
+
+	//磁盘上没有创建任何文件
+	_, err = os.Stat(opts.DirPath)
+	assert.True(t, os.IsNotExist(err))
+
+	//Destroy释放内存中的数据，重新打开是一个空的数据库
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	assert.Nil(t, db.Destroy())
+	assert.False(t, fio.MemFileSystem.Exists(opts.DirPath))
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	_, err = db.Get(testKey(1500))
+	assert.Equal(t, ErrKeyNotFound, err)
+	assert.Nil(t, db.Destroy())
+}
+
+func TestDB_Destroy_AfterClose(t *testing.T) {
+	t.Parallel()
+	db, opts := openInMemoryDB(t)
+	assert.Nil(t, db.Close())
+	opts.IndexCheckpointInterval = 10 * time.Millisecond
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, db.Put(testKey(i), testValue(i)))
+	}
+	//Close以后再Destroy，仍然会释放内存中的数据
+	assert.Nil(t, db.Close())
+	assert.Nil(t, db.Close())
+	assert.Nil(t, db.Destroy())
+	assert.False(t, fio.MemFileSystem.Exists(opts.DirPath))
+
+	//磁盘上的目录也一样
+	opts = DefaultOptions
+	opts.DirPath = filepath.Join(t.TempDir(), "lovedb")
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	assert.Nil(t, db.Put(testKey(0), testValue(0)))
+	assert.Nil(t, db.Close())
+	assert.Nil(t, db.Destroy())
+	_, err = os.Stat(opts.DirPath)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestDB_Merge_InMemory(t *testing.T) {
+	t.Parallel()
+	db, opts := openInMemoryDB(t)
+
+	for i := 0; i < 2000; i++ {
+		assert.Nil(t, db.Put(testKey(i), testValue(i)))
+	}
+	for i := 0; i < 1500; i++ {
+		assert.Nil(t, db.Delete(testKey(i)))
+	}
+	assert.Nil(t, db.Merge())
+	assert.Nil(t, db.Close())
+
+	//重新打开以后加载merge的结果
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	stat, err := db.Stat()
+	assert.Nil(t, err)
+	assert.Equal(t, uint(500), stat.KeyNum)
+	for i := 1500; i < 2000; i++ {
+		val, err := db.Get(testKey(i))
+		assert.Nil(t, err)
+		assert.Equal(t, testValue(i), val)
+	}
+
+	//备份到磁盘上的目录
+	backupDir, _ := os.MkdirTemp("", "lovedb-backup")
+	defer func() {
+		_ = os.RemoveAll(backupDir)
+	}()
+	assert.Nil(t, db.BackUp(backupDir))
+	assert.Nil(t, db.Close())
+
+	backupOpts := DefaultOptions
+	backupOpts.DirPath = backupDir
+	backupOpts.MMapAtStartUp = false
+	backupDB, err := Open(backupOpts)
+	assert.Nil(t, err)
+	val, err := backupDB.Get(testKey(1999))
+	assert.Nil(t, err)
+	assert.Equal(t, testValue(1999), val)
+	assert.Nil(t, backupDB.Close())
+}
+
+func TestDB_ValueCache(t *testing.T) {
+	t.Parallel()
+	opts := DefaultOptions
+	opts.DirPath = filepath.Join("/lovedb-mem", t.Name())
+	opts.InMemory = true
+	opts.DataFileSize = 32 * 1024
+	opts.DataFileMergeRatio = 0
+	opts.ValueCacheSize = 1024 * 1024
+	t.Cleanup(func() {
+		_ = fio.MemFileSystem.RemoveAll(opts.DirPath)
+	})
+	db, err := Open(opts)
+	assert.Nil(t, err)
+
+	//写入时填充缓存，读取命中
+	assert.Nil(t, db.Put(testKey(1), testValue(1)))
+	val, err := db.Get(testKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, testValue(1), val)
+	stat, err := db.Stat()
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(1), stat.CacheHits)
+	assert.Equal(t, uint64(0), stat.CacheMisses)
+
+	//覆盖以后读到新的值
+	assert.Nil(t, db.Put(testKey(1), testValue(2)))
+	val, err = db.Get(testKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, testValue(2), val)
+
+	//删除以后读不到
+	assert.Nil(t, db.Delete(testKey(1)))
+	_, err = db.Get(testKey(1))
+	assert.Equal(t, ErrKeyNotFound, err)
+	assert.Equal(t, 0, db.cache.ll.Len())
+
+	//批量写入同样会填充缓存
+	wb := db.NewWriteBatch(DefaultWriteBatchOptions)
+	assert.Nil(t, wb.Put(testKey(2), testValue(2)))
+	assert.Nil(t, wb.Commit())
+	val, err = db.Get(testKey(2))
+	assert.Nil(t, err)
+	assert.Equal(t, testValue(2), val)
+	stat, err = db.Stat()
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(3), stat.CacheHits)
+
+	//merge以后重新打开，缓存为空，第一次读取未命中
+	for i := 0; i < 2000; i++ {
+		assert.Nil(t, db.Put(testKey(i), testValue(i)))
+	}
+	assert.Nil(t, db.Merge())
+	assert.Nil(t, db.Close())
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	for i := 0; i < 2000; i++ {
+		val, err := db.Get(testKey(i))
+		assert.Nil(t, err)
+		assert.Equal(t, testValue(i), val)
+	}
+	stat, err = db.Stat()
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(0), stat.CacheHits)
+	assert.Equal(t, uint64(2000), stat.CacheMisses)
+	assert.Nil(t, db.Close())
+}
+
+func TestDB_Checksum(t *testing.T) {
+	t.Parallel()
+	db, opts := openInMemoryDB(t)
+	assert.Nil(t, db.Close())
+
+	//兼容IEEE的文件
+	opts.Checksum = data.ChecksumIEEE
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, db.Put(testKey(i), testValue(i)))
+	}
+	assert.Equal(t, data.ChecksumIEEE, db.activeFile.Checksum)
+	assert.Nil(t, db.Close())
+
+	//改变校验算法以后新的数据写到新的文件中
+	opts.Checksum = data.ChecksumCRC32C
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	for i := 100; i < 200; i++ {
+		assert.Nil(t, db.Put(testKey(i), testValue(i)))
+	}
+	assert.Equal(t, data.ChecksumCRC32C, db.activeFile.Checksum)
+	assert.Equal(t, data.ChecksumIEEE, db.olderFiles[0].Checksum)
+	assert.Nil(t, db.Verify())
+	assert.Nil(t, db.Close())
+
+	//跳过读取时的校验
+	opts.SkipChecksumOnRead = true
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	for i := 0; i < 200; i++ {
+		val, err := db.Get(testKey(i))
+		assert.Nil(t, err)
+		assert.Equal(t, testValue(i), val)
+	}
+	assert.Nil(t, db.Close())
+
+	opts.Checksum = 10
+	_, err = Open(opts)
+	assert.Equal(t, data.ErrUnsupportedChecksum, err)
+}
+
+func TestDB_Verify(t *testing.T) {
+	t.Parallel()
+	db, opts := openInMemoryDB(t)
+	inj := fio.NewFaultInjector()
+	opts.IOOpener = inj.Opener()
+	assert.Nil(t, db.Close())
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, db.Put(testKey(i), testValue(i)))
+	}
+	assert.Nil(t, db.Verify())
+
+	//读取到的header和key都损坏了
+	inj.CorruptReads(2)
+	err = db.Verify()
+	assert.True(t, errors.Is(err, data.ErrInvalidCRC))
+	assert.Nil(t, db.Close())
+}
+
+func TestOpen_IndexLoadParallelism(t *testing.T) {
+	t.Parallel()
+	db, opts := openInMemoryDB(t)
+	for round := 0; round < 3; round++ {
+		for i := 0; i < 1000; i++ {
+			assert.Nil(t, db.Put(testKey(i), []byte(fmt.Sprintf("%s-%d", testValue(i), round))))
+		}
+		wb := db.NewWriteBatch(DefaultWriteBatchOptions)
+		for i := round * 100; i < round*100+300; i++ {
+			assert.Nil(t, wb.Delete(testKey(i)))
+		}
+		assert.Nil(t, wb.Commit())
+	}
+	activeFid := db.activeFile.FileId
+	assert.Nil(t, db.Close())
+	assert.Nil(t, fio.MemFileSystem.Remove(filepath.Join(opts.DirPath, data.IndexCheckpointName)))
+	opts.IndexCheckpoint = false
+	//一半的文件没有hint文件，需要读取数据文件
+	for fid := uint32(0); fid < activeFid; fid += 2 {
+		assert.Nil(t, fio.MemFileSystem.Remove(data.GetDataHintFileName(opts.DirPath, fid)))
+	}
+
+	var expected map[string]string
+	var expectedReclaim int64
+	var expectedSeqNo uint64
+	//为0时使用默认值
+	for _, parallelism := range []int{1, 3, 16, 0} {
+		opts.IndexLoadParallelism = parallelism
+		db, err := Open(opts)
+		assert.Nil(t, err)
+		values := make(map[string]string)
+		assert.Nil(t, db.Fold(func(key []byte, value []byte) bool {
+			values[string(key)] = string(value)
+			return true
+		}))
+		if expected == nil {
+			expected, expectedReclaim, expectedSeqNo = values, db.reclaimSize, db.seqNo
+			assert.Equal(t, 700, len(values))
+			assert.Equal(t, uint64(3), db.seqNo)
+		} else {
+			assert.Equal(t, expected, values)
+			assert.Equal(t, expectedReclaim, db.reclaimSize)
+			assert.Equal(t, expectedSeqNo, db.seqNo)
+		}
+		stat, err := db.Stat()
+		assert.Nil(t, err)
+		assert.Greater(t, stat.Startup.Total, stat.Startup.LoadIndexFromDataFiles)
+		assert.Nil(t, db.Close())
+	}
+
+	opts.IndexLoadParallelism = -1
+	_, err := Open(opts)
+	assert.NotNil(t, err)
+}
+
+func TestWriteBatch_BPTreeUncleanShutdown(t *testing.T) {
+	opts := DefaultOptions
+	opts.DirPath = filepath.Join(t.TempDir(), "lovedb")
+	opts.IndexType = index.BPTree
+	opts.DataFileSize = 32 * 1024
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	for i := 0; i < 2; i++ {
+		wb := db.NewWriteBatch(DefaultWriteBatchOptions)
+		assert.Nil(t, wb.Put(testKey(i), testValue(i)))
+		assert.Nil(t, wb.Commit())
+	}
+	assert.Nil(t, db.Close())
+
+	//没有正常关闭，不存在seq-no文件，从b+树索引中取出序列号
+	seqNoFileName := filepath.Join(opts.DirPath, data.SeqNoFileName)
+	assert.Nil(t, os.Remove(seqNoFileName))
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(2), db.seqNo)
+	wb := db.NewWriteBatch(DefaultWriteBatchOptions)
+	assert.Nil(t, wb.Put(testKey(2), testValue(2)))
+	assert.Nil(t, wb.Commit())
+	//之后的写入切换了活跃文件，活跃文件中没有事务记录
+	for i := 3; i < 2000; i++ {
+		assert.Nil(t, db.Put(testKey(i), testValue(i)))
+	}
+	//b+树中的序列号也丢失了，只能从旧的数据文件中查找
+	assert.Nil(t, db.index.(index.SeqNoStore).SaveSeqNo(0))
+	assert.Nil(t, db.Close())
+
+	assert.Nil(t, os.Remove(seqNoFileName))
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(3), db.seqNo)
+	wb = db.NewWriteBatch(DefaultWriteBatchOptions)
+	assert.Nil(t, wb.Delete(testKey(0)))
+	assert.Nil(t, wb.Commit())
+	assert.Equal(t, uint64(4), db.seqNo)
+	_, err = db.Get(testKey(0))
+	assert.Equal(t, ErrKeyNotFound, err)
+	assert.Nil(t, db.Close())
+}
+
+func TestMerge_BPTree(t *testing.T) {
+	opts := DefaultOptions
+	opts.DirPath = filepath.Join(t.TempDir(), "lovedb")
+	opts.IndexType = index.BPTree
+	opts.DataFileSize = 32 * 1024
+	opts.DataFileMergeRatio = 0
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	for i := 0; i < 1000; i++ {
+		assert.Nil(t, db.Put(testKey(i), testValue(i)))
+	}
+	for i := 0; i < 500; i++ {
+		assert.Nil(t, db.Delete(testKey(i)))
+	}
+	assert.Nil(t, db.Merge())
+	//merge之后的写入和删除不能被merge的结果覆盖
+	assert.Nil(t, db.Put(testKey(500), []byte("new-value")))
+	assert.Nil(t, db.Delete(testKey(501)))
+	assert.Nil(t, db.Close())
+
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, 499, len(db.ListKeys()))
+	val, err := db.Get(testKey(500))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("new-value"), val)
+	_, err = db.Get(testKey(501))
+	assert.Equal(t, ErrKeyNotFound, err)
+	for i := 502; i < 1000; i++ {
+		val, err := db.Get(testKey(i))
+		assert.Nil(t, err)
+		assert.Equal(t, testValue(i), val)
+	}
+	assert.Nil(t, db.Close())
+}
+
+func TestOpen_SkipList(t *testing.T) {
+	t.Parallel()
+	db, opts := openInMemoryDB(t)
+	assert.Nil(t, db.Close())
+	opts.IndexType = index.SkipList
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	for i := 0; i < 1000; i++ {
+		assert.Nil(t, db.Put(testKey(i), testValue(i)))
+	}
+	for i := 0; i < 1000; i += 2 {
+		assert.Nil(t, db.Delete(testKey(i)))
+	}
+	assert.Nil(t, db.Close())
+
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	keys := db.ListKeys()
+	assert.Equal(t, 500, len(keys))
+	assert.Equal(t, testKey(1), keys[0])
+	val, err := db.Get(testKey(999))
+	assert.Nil(t, err)
+	assert.Equal(t, testValue(999), val)
+	assert.Nil(t, db.Close())
+}
+
+func TestOpen_CompactIndex(t *testing.T) {
+	t.Parallel()
+	db, opts := openInMemoryDB(t)
+	assert.Nil(t, db.Close())
+	opts.IndexType = index.Compact
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	for i := 0; i < 10000; i++ {
+		assert.Nil(t, db.Put(testKey(i), testValue(i)))
+	}
+	for i := 0; i < 10000; i += 2 {
+		assert.Nil(t, db.Delete(testKey(i)))
+	}
+	stat, err := db.Stat()
+	assert.Nil(t, err)
+	assert.True(t, stat.IndexMemory > 0)
+	assert.True(t, stat.IndexMemoryPerKey > 0)
+	assert.Nil(t, db.Close())
+
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	keys := db.ListKeys()
+	assert.Equal(t, 5000, len(keys))
+	assert.Equal(t, testKey(1), keys[0])
+	val, err := db.Get(testKey(9999))
+	assert.Nil(t, err)
+	assert.Equal(t, testValue(9999), val)
+	assert.Nil(t, db.Close())
+}
+
+func TestDB_Metrics(t *testing.T) {
+	t.Parallel()
+	db, _ := openInMemoryDB(t)
+	defer func() {
+		assert.Nil(t, db.Close())
+	}()
+	for i := 0; i < 2000; i++ {
+		assert.Nil(t, db.Put(testKey(i), testValue(i)))
+	}
+	_, err := db.Get(testKey(1))
+	assert.Nil(t, err)
+	_, err = db.Get([]byte("not-exist"))
+	assert.Equal(t, ErrKeyNotFound, err)
+	assert.Equal(t, ErrKeyIsEmpty, db.Delete(nil))
+	wb := db.NewWriteBatch(DefaultWriteBatchOptions)
+	assert.Nil(t, wb.Put(testKey(1), testValue(1)))
+	assert.Nil(t, wb.Commit())
+	assert.Nil(t, db.Sync())
+
+	values := db.Metrics().Snapshot()
+	assert.Equal(t, uint64(2000), values["lovedb_put_total"])
+	assert.Equal(t, uint64(2), values["lovedb_get_total"])
+	assert.Equal(t, uint64(0), values["lovedb_get_errors_total"])
+	assert.Equal(t, uint64(1), values["lovedb_delete_errors_total"])
+	assert.Equal(t, uint64(1), values["lovedb_batch_commit_total"])
+	assert.True(t, values["lovedb_file_rotation_total"].(uint64) > 0)
+	assert.True(t, values["lovedb_sync_total"].(uint64) > 0)
+	assert.Equal(t, float64(2000), values["lovedb_keys"])
+
+	var buf bytes.Buffer
+	assert.Nil(t, db.Metrics().WritePrometheus(&buf))
+	assert.Contains(t, buf.String(), "lovedb_put_duration_seconds_count 2000\n")
+	assert.Contains(t, buf.String(), "lovedb_bytes_written_total ")
+}
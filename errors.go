@@ -15,4 +15,11 @@ var (
 	ErrDatabaseIsUsing        = errors.New("the database directory is used by another process")
 	ErrMergeRatioUnreached    = errors.New("the merge ratio do not reach the options")
 	ErrNoEnoughSpaceForMerge  = errors.New("no enough disk space for merge")
+	ErrInvalidValueSize       = errors.New("the value size is invalid")
+	ErrInvalidRange           = errors.New("the range of value is invalid")
+	ErrMigrateUnfinished      = errors.New("the migration of database directory is unfinished, run migrate again")
+	ErrIndexTypeMismatch      = errors.New("the index type of database directory does not match the options, run reindex first")
+	ErrUnsupportedIndexType   = errors.New("unsupported index type")
+	ErrIteratorKeysOnly       = errors.New("the iterator only iterates keys")
+	ErrInvalidContinuation    = errors.New("the continuation token is invalid")
 )
@@ -0,0 +1,263 @@
+package lovedb
+
+import (
+	"bytes"
+	"lovedb/data"
+	"lovedb/index"
+	"math/rand"
+	"sort"
+	"time"
+)
+
+// 索引抽样的桶数量，每个桶的边界key都保存在内存中
+const keySketchBuckets = 4096
+
+// 哈希索引每个桶抽取的key数量
+const keySketchSamplesPerBucket = 8
+
+// 上次抽样以后写入的次数超过抽样时key数量的1/8时重新抽样
+const keySketchStaleRatio = 8
+
+// 随机抽取的key数量超过key总数的1/8时，直接遍历一遍索引做蓄水池抽样
+const randomSampleScanRatio = 8
+
+// keySketch 索引的抽样，等深的直方图：按key的顺序每隔一定数量的key记录一个桶的边界
+// 估算范围时只需要在边界中二分查找，不需要遍历索引
+type keySketch struct {
+	bounds [][]byte  //每个桶的第一个key，按顺序排列
+	ranks  []float64 //第i个边界之前key的数量，最后一个元素是key的总数
+	sizes  []float64 //第i个边界之前记录大小之和，最后一个元素是所有记录的大小
+	keys   int       //抽样时key的数量
+	writes uint64    //抽样时累计的写入次数
+	step   int       //有序遍历时每个桶中key的数量，哈希索引抽样得到的边界为0
+}
+
+// EstimateRange 估算[start, end)范围内key的数量和占用的磁盘空间，start或end为nil表示没有对应的边界
+// 根据索引的抽样估算，不会遍历范围内的key，也不会读取value。抽样把所有的key按顺序等分成最多4096个桶，
+// 写入的次数超过key数量的1/8时才重新抽样，重新抽样需要遍历一遍索引，但不会复制索引
+// 误差：key的数量不超过4096时结果是准确的；否则范围的两端各自最多有一个桶的误差，即key总数的1/4096，
+// 加上上次抽样以后写入的key（最多key总数的1/8，key总数的变化会按比例修正）；
+// 哈希索引的边界是随机抽样得到的，两端的误差大约是key总数的1/4096的3倍
+func (db *DB) EstimateRange(start, end []byte) (int, int64) {
+	if start != nil && end != nil && bytes.Compare(start, end) >= 0 {
+		return 0, 0
+	}
+	sketch := db.loadKeySketch()
+	if sketch.keys == 0 {
+		return 0, 0
+	}
+	lowRank, lowSize := 0.0, 0.0
+	if start != nil {
+		lowRank, lowSize = sketch.rank(start)
+	}
+	highRank, highSize := sketch.ranks[len(sketch.ranks)-1], sketch.sizes[len(sketch.sizes)-1]
+	if end != nil {
+		highRank, highSize = sketch.rank(end)
+	}
+	//抽样以后key的数量变化了，按比例修正
+	scale := float64(db.index.Size()) / float64(sketch.keys)
+	keys := int((highRank-lowRank)*scale + 0.5)
+	size := int64((highSize-lowSize)*scale + 0.5)
+	if keys <= 0 || size < 0 {
+		return 0, 0
+	}
+	return keys, size
+}
+
+// RandomSample 从所有的key中随机地取出n个不重复的key，key的数量不超过n时返回所有的key
+// 有序的索引根据抽样的桶先随机选择一个桶，再从桶的边界向后随机走若干个key，每个key平均需要走key总数/8192步，
+// 上次抽样以后写入的key被选中的概率和其他key略有不同；n超过key总数的1/8，以及哈希索引和art索引（不能直接定位到边界）时，
+// 遍历一遍索引做蓄水池抽样，只保存抽到的key。重复抽到同一个key太多次时也改为遍历一遍索引，保证返回n个key
+func (db *DB) RandomSample(n int) [][]byte {
+	if n <= 0 {
+		return nil
+	}
+	r := rand.New(rand.NewSource(time.Now().UnixNano()))
+	size := db.index.Size()
+	if sampler, ok := db.index.(index.Sampler); ok {
+		return sampler.SampleKeys(n, r)
+	}
+	if _, ok := db.index.(*index.AdaptiveRadixTree); ok || n*randomSampleScanRatio >= size {
+		return db.scanSample(n, r)
+	}
+
+	sketch := db.loadKeySketch()
+	if sketch.step == 0 || len(sketch.bounds) == 0 {
+		return db.scanSample(n, r)
+	}
+	seen := make(map[string]struct{}, n)
+	sample := make([][]byte, 0, n)
+	//btree的迭代器会复制所有的key，支持Ascend的索引不需要迭代器
+	var it index.Iterator
+	if _, ok := db.index.(index.Ascender); !ok {
+		it = db.index.Iterator(false)
+		defer it.Close()
+	}
+	//已经抽到的key比较多时重复的概率变大，限制尝试的次数
+	for attempts := 0; len(sample) < n && attempts < 4*n; attempts++ {
+		bucket := r.Intn(len(sketch.bounds))
+		skip := r.Intn(sketch.step)
+		key := db.keyAfter(it, sketch.bounds[bucket], skip)
+		if key == nil {
+			continue
+		}
+		if _, ok := seen[string(key)]; ok {
+			continue
+		}
+		seen[string(key)] = struct{}{}
+		sample = append(sample, key)
+	}
+	//抽样以后删除了很多key时可能抽不够，索引中的key超过n个就遍历一遍索引
+	if len(sample) < n && db.index.Size() > len(sample) {
+		return db.scanSample(n, r)
+	}
+	return sample
+}
+
+// 从第一个大于等于start的key开始向后走skip个key，返回这个key的拷贝，超过末尾时返回nil
+// it用于不支持Ascend的有序索引，这些索引的迭代器不会复制所有的key，支持Ascend的索引传nil
+func (db *DB) keyAfter(it index.Iterator, start []byte, skip int) []byte {
+	var key []byte
+	if ascender, ok := db.index.(index.Ascender); ok {
+		ascender.Ascend(start, func(k []byte, _ *data.LogRecordPos) bool {
+			if skip > 0 {
+				skip--
+				return true
+			}
+			key = append([]byte{}, k...)
+			return false
+		})
+		return key
+	}
+	for it.Seek(start); it.Valid(); it.Next() {
+		if skip > 0 {
+			skip--
+			continue
+		}
+		//b+树迭代器的key只在事务中有效，需要拷贝
+		return append([]byte{}, it.Key()...)
+	}
+	return nil
+}
+
+// 遍历一遍索引做蓄水池抽样，均匀随机地取出n个key
+func (db *DB) scanSample(n int, r *rand.Rand) [][]byte {
+	sample := make([][]byte, 0, n)
+	var seen int
+	db.walkIndex(func(key []byte, _ *data.LogRecordPos) bool {
+		seen++
+		//前n个key直接放入，之后第seen个key以n/seen的概率替换其中一个
+		idx := len(sample)
+		if idx == n {
+			if idx = r.Intn(seen); idx >= n {
+				return true
+			}
+		}
+		//b+树迭代器的key只在事务中有效，需要拷贝
+		key = append([]byte{}, key...)
+		if idx == len(sample) {
+			sample = append(sample, key)
+		} else {
+			sample[idx] = key
+		}
+		return true
+	})
+	return sample
+}
+
+// 按key的顺序遍历索引，btree和art索引不复制key，其他有序索引的迭代器本身不会复制所有的key
+func (db *DB) walkIndex(fn func(key []byte, pos *data.LogRecordPos) bool) {
+	if ascender, ok := db.index.(index.Ascender); ok {
+		ascender.Ascend(nil, fn)
+		return
+	}
+	it := db.index.Iterator(false)
+	defer it.Close()
+	for it.Rewind(); it.Valid() && fn(it.Key(), it.Value()); it.Next() {
+	}
+}
+
+// 返回索引的抽样，没有抽样过或者抽样以后写入了太多的数据时重新抽样
+func (db *DB) loadKeySketch() *keySketch {
+	writes := db.ops.puts.Load() + db.ops.deletes.Load()
+	if sketch := db.sketch.Load(); sketch != nil && (writes-sketch.writes)*keySketchStaleRatio <= uint64(sketch.keys) {
+		return sketch
+	}
+	sketch := db.buildKeySketch(writes)
+	db.sketch.Store(sketch)
+	return sketch
+}
+
+// 抽样：有序的索引按顺序遍历一遍，每隔keys/4096个key记录一个边界；哈希索引随机抽取一部分key排序以后选出边界
+func (db *DB) buildKeySketch(writes uint64) *keySketch {
+	sketch := &keySketch{writes: writes}
+	if sampler, ok := db.index.(index.Sampler); ok {
+		db.sampleKeySketch(sketch, sampler)
+		return sketch
+	}
+
+	sketch.step = (db.index.Size() + keySketchBuckets - 1) / keySketchBuckets
+	if sketch.step == 0 {
+		sketch.step = 1
+	}
+	var size float64
+	db.walkIndex(func(key []byte, pos *data.LogRecordPos) bool {
+		if sketch.keys%sketch.step == 0 {
+			//b+树迭代器的key只在事务中有效，需要拷贝
+			sketch.bounds = append(sketch.bounds, append([]byte{}, key...))
+			sketch.ranks = append(sketch.ranks, float64(sketch.keys))
+			sketch.sizes = append(sketch.sizes, size)
+		}
+		sketch.keys++
+		size += float64(pos.Size)
+		return true
+	})
+	sketch.ranks = append(sketch.ranks, float64(sketch.keys))
+	sketch.sizes = append(sketch.sizes, size)
+	return sketch
+}
+
+// 哈希索引的抽样，抽到的每个key代表keys/len(sample)个key，记录的大小也按照抽到的key估算
+func (db *DB) sampleKeySketch(sketch *keySketch, sampler index.Sampler) {
+	sketch.keys = db.index.Size()
+	r := rand.New(rand.NewSource(time.Now().UnixNano()))
+	sample := sampler.SampleKeys(keySketchBuckets*keySketchSamplesPerBucket, r)
+	sort.Slice(sample, func(i, j int) bool {
+		return bytes.Compare(sample[i], sample[j]) < 0
+	})
+	weight := 0.0
+	if len(sample) > 0 {
+		weight = float64(sketch.keys) / float64(len(sample))
+	}
+	var size float64
+	for i, key := range sample {
+		if i%keySketchSamplesPerBucket == 0 {
+			sketch.bounds = append(sketch.bounds, key)
+			sketch.ranks = append(sketch.ranks, float64(i)*weight)
+			sketch.sizes = append(sketch.sizes, size)
+		}
+		//抽样以后key可能已经被删除了
+		if pos := db.index.Get(key); pos != nil {
+			size += float64(pos.Size) * weight
+		}
+	}
+	sketch.ranks = append(sketch.ranks, float64(sketch.keys))
+	sketch.sizes = append(sketch.sizes, size)
+}
+
+// 估算小于key的key数量和记录大小之和：key所在的桶之前的部分是准确的，key正好是边界时也是准确的，
+// 否则认为key在桶的中间
+func (s *keySketch) rank(key []byte) (float64, float64) {
+	//第一个大于key的边界，key在它前面的那个桶中
+	i := sort.Search(len(s.bounds), func(i int) bool {
+		return bytes.Compare(s.bounds[i], key) > 0
+	})
+	if i == 0 {
+		return 0, 0
+	}
+	bucket := i - 1
+	if bytes.Equal(s.bounds[bucket], key) {
+		return s.ranks[bucket], s.sizes[bucket]
+	}
+	return (s.ranks[bucket] + s.ranks[bucket+1]) / 2, (s.sizes[bucket] + s.sizes[bucket+1]) / 2
+}
@@ -0,0 +1,128 @@
+package lovedb
+
+import (
+	"github.com/stretchr/testify/assert"
+	"lovedb/index"
+	"path/filepath"
+	"testing"
+)
+
+func TestDB_EstimateRange(t *testing.T) {
+	for _, typ := range []index.IndexerType{index.BTree, index.ART, index.BPTree} {
+		opts := DefaultOptions
+		opts.DirPath = filepath.Join(t.TempDir(), "lovedb")
+		opts.IndexType = typ
+		db, err := Open(opts)
+		assert.Nil(t, err)
+		keys, size := db.EstimateRange(nil, nil)
+		assert.Equal(t, 0, keys)
+		assert.Equal(t, int64(0), size)
+
+		for i := 0; i < 1000; i++ {
+			assert.Nil(t, db.Put(testKey(i), testValue(i)))
+		}
+		keys, size = db.EstimateRange(nil, nil)
+		assert.Equal(t, 1000, keys)
+		assert.Equal(t, db.activeFile.WriteOff-db.activeFile.HeaderSize(), size)
+
+		keys, size = db.EstimateRange(testKey(100), testKey(200))
+		assert.Equal(t, 100, keys)
+		assert.True(t, size > 0)
+		keys, _ = db.EstimateRange(testKey(990), nil)
+		assert.Equal(t, 10, keys)
+		keys, _ = db.EstimateRange(nil, testKey(10))
+		assert.Equal(t, 10, keys)
+		assert.Nil(t, db.Close())
+	}
+}
+
+func TestDB_RandomSample(t *testing.T) {
+	t.Parallel()
+	db, _ := openInMemoryDB(t)
+	defer func() {
+		assert.Nil(t, db.Close())
+	}()
+	assert.Equal(t, 0, len(db.RandomSample(10)))
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, db.Put(testKey(i), testValue(i)))
+	}
+	assert.Nil(t, db.RandomSample(0))
+	assert.Equal(t, 100, len(db.RandomSample(1000)))
+
+	//每个key被抽中的概率相同
+	counts := make(map[string]int)
+	for round := 0; round < 1000; round++ {
+		sample := db.RandomSample(10)
+		assert.Equal(t, 10, len(sample))
+		seen := make(map[string]bool)
+		for _, key := range sample {
+			assert.False(t, seen[string(key)])
+			seen[string(key)] = true
+			counts[string(key)]++
+		}
+	}
+	assert.Equal(t, 100, len(counts))
+	for _, count := range counts {
+		//期望是100次
+		assert.True(t, count > 40 && count < 180, count)
+	}
+}
+
+func TestDB_EstimateRange_Sketch(t *testing.T) {
+	for _, typ := range []index.IndexerType{index.BTree, index.SkipList, index.Hash} {
+		opts := DefaultOptions
+		opts.DirPath = filepath.Join(t.TempDir(), "lovedb")
+		opts.IndexType = typ
+		db, err := Open(opts)
+		assert.Nil(t, err)
+		const total = 20000
+		for i := 0; i < total; i++ {
+			assert.Nil(t, db.Put(testKey(i), testValue(i)))
+		}
+		keys, _ := db.EstimateRange(nil, nil)
+		assert.Equal(t, total, keys)
+
+		//两端各自最多差一个桶，哈希索引的边界是抽样得到的，误差放宽
+		bound := 2 * (total/keySketchBuckets + 1)
+		if typ == index.Hash {
+			bound = total / 20
+		}
+		keys, size := db.EstimateRange(testKey(5000), testKey(12000))
+		assert.True(t, keys >= 7000-bound && keys <= 7000+bound, keys)
+		assert.True(t, size > 0)
+		keys, _ = db.EstimateRange(testKey(12000), testKey(5000))
+		assert.Equal(t, 0, keys)
+
+		//写入的数据不多时继续使用原来的抽样，key总数的变化按比例修正
+		for i := total; i < total+total/10; i++ {
+			assert.Nil(t, db.Put(testKey(i), testValue(i)))
+		}
+		keys, _ = db.EstimateRange(nil, nil)
+		assert.Equal(t, total+total/10, keys)
+		assert.Nil(t, db.Close())
+	}
+}
+
+func TestDB_RandomSample_Sketch(t *testing.T) {
+	for _, typ := range []index.IndexerType{index.BTree, index.SkipList} {
+		opts := DefaultOptions
+		opts.DirPath = filepath.Join(t.TempDir(), "lovedb")
+		opts.IndexType = typ
+		db, err := Open(opts)
+		assert.Nil(t, err)
+		for i := 0; i < 10000; i++ {
+			assert.Nil(t, db.Put(testKey(i), testValue(i)))
+		}
+		//抽样的key都存在并且不重复，总能抽够n个
+		sample := db.RandomSample(1000)
+		assert.Equal(t, 1000, len(sample))
+		seen := make(map[string]bool)
+		for _, key := range sample {
+			assert.False(t, seen[string(key)])
+			seen[string(key)] = true
+			_, err := db.Get(key)
+			assert.Nil(t, err)
+		}
+		assert.Nil(t, db.Close())
+	}
+}
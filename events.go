@@ -0,0 +1,92 @@
+package lovedb
+
+import "time"
+
+// EventListener 存储引擎内部事件的回调，通过Options.EventListener设置
+// 回调可能在持有db的锁时调用，也可能在多个协程中并发调用，实现需要是并发安全的，并且不能调用db的方法，
+// 耗时的操作应该放到其他协程中执行，否则会阻塞读写
+// 只关心部分事件时可以嵌入NoopEventListener
+type EventListener interface {
+	// OnFileRotated 活跃文件写满或者merge开始时切换了活跃文件，旧的文件之后不会再写入
+	OnFileRotated(info FileRotatedInfo)
+	// OnSyncCompleted 活跃文件持久化完成，失败时Err不为nil
+	OnSyncCompleted(info SyncInfo)
+	// OnMergeStarted merge开始，没有达到阈值或者正在merge时不会开始
+	OnMergeStarted(info MergeStartedInfo)
+	// OnMergeFinished merge结束，和OnMergeStarted成对调用，失败时Err不为nil
+	OnMergeFinished(info MergeFinishedInfo)
+	// OnHintFileWritten 写入了数据文件的hint文件，或者启动时启用了merge生成的hint文件
+	OnHintFileWritten(info HintFileInfo)
+	// OnCorruptionDetected 读取记录时发现数据损坏，包括启动时加载索引、Verify以及读取value
+	OnCorruptionDetected(info CorruptionInfo)
+	// OnRecoveryTruncated 启动时发现活跃文件末尾有崩溃时写了一半的记录，已经截断掉
+	OnRecoveryTruncated(info RecoveryTruncatedInfo)
+}
+
+// FileRotatedInfo 活跃文件切换的信息
+type FileRotatedInfo struct {
+	FileId    uint32 //切换为旧文件的数据文件id
+	Path      string //切换为旧文件的数据文件路径
+	Size      int64  //切换为旧文件的数据文件大小
+	NewFileId uint32 //新的活跃文件id
+}
+
+// SyncInfo 持久化的信息
+type SyncInfo struct {
+	FileId   uint32
+	Duration time.Duration
+	Err      error
+}
+
+// MergeStartedInfo merge开始时的信息
+type MergeStartedInfo struct {
+	TotalSize       int64 //数据目录的大小
+	ReclaimableSize int64 //可以回收的数据量
+}
+
+// MergeFinishedInfo merge结束时的信息
+type MergeFinishedInfo struct {
+	Duration time.Duration
+	Err      error
+}
+
+// HintFileInfo 写入的hint文件的信息
+type HintFileInfo struct {
+	Path    string
+	FileId  uint32 //对应的数据文件id，Merge为true时没有意义
+	Entries int    //hint文件中记录的数量，Merge为true时为0
+	Merge   bool   //是否是merge生成的hint文件，对应所有参与merge的数据文件
+}
+
+// CorruptionInfo 损坏的数据的位置
+type CorruptionInfo struct {
+	FileId uint32
+	Offset int64
+	Err    error
+}
+
+// RecoveryTruncatedInfo 启动时截断活跃文件的信息
+type RecoveryTruncatedInfo struct {
+	FileId uint32
+	Offset int64 //截断以后的文件大小，即最后一条完整记录的末尾
+	Size   int64 //截断之前的文件大小
+}
+
+// NoopEventListener 忽略所有事件，Options.EventListener为nil时使用
+type NoopEventListener struct{}
+
+func (NoopEventListener) OnFileRotated(FileRotatedInfo)             {}
+func (NoopEventListener) OnSyncCompleted(SyncInfo)                  {}
+func (NoopEventListener) OnMergeStarted(MergeStartedInfo)           {}
+func (NoopEventListener) OnMergeFinished(MergeFinishedInfo)         {}
+func (NoopEventListener) OnHintFileWritten(HintFileInfo)            {}
+func (NoopEventListener) OnCorruptionDetected(CorruptionInfo)       {}
+func (NoopEventListener) OnRecoveryTruncated(RecoveryTruncatedInfo) {}
+
+// 读取记录出错时，如果是数据损坏就记录日志并通知监听者
+func (db *DB) checkCorruption(fileId uint32, offset int64, err error) {
+	if isCorruptRecord(err) {
+		db.logger.Errorf("corrupted record in data file %d at offset %d: %v", fileId, offset, err)
+		db.events.OnCorruptionDetected(CorruptionInfo{FileId: fileId, Offset: offset, Err: err})
+	}
+}
@@ -0,0 +1,198 @@
+package lovedb
+
+import (
+	"github.com/stretchr/testify/assert"
+	"lovedb/data"
+	"lovedb/fio"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// 记录收到的所有事件
+type recordingListener struct {
+	mu          sync.Mutex
+	rotated     []FileRotatedInfo
+	syncs       []SyncInfo
+	mergeStart  []MergeStartedInfo
+	mergeFinish []MergeFinishedInfo
+	hints       []HintFileInfo
+	corruptions []CorruptionInfo
+	truncations []RecoveryTruncatedInfo
+}
+
+func (l *recordingListener) OnFileRotated(info FileRotatedInfo) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.rotated = append(l.rotated, info)
+}
+
+func (l *recordingListener) OnSyncCompleted(info SyncInfo) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.syncs = append(l.syncs, info)
+}
+
+func (l *recordingListener) OnMergeStarted(info MergeStartedInfo) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.mergeStart = append(l.mergeStart, info)
+}
+
+func (l *recordingListener) OnMergeFinished(info MergeFinishedInfo) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.mergeFinish = append(l.mergeFinish, info)
+}
+
+func (l *recordingListener) OnHintFileWritten(info HintFileInfo) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.hints = append(l.hints, info)
+}
+
+func (l *recordingListener) OnCorruptionDetected(info CorruptionInfo) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.corruptions = append(l.corruptions, info)
+}
+
+func (l *recordingListener) OnRecoveryTruncated(info RecoveryTruncatedInfo) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.truncations = append(l.truncations, info)
+}
+
+func TestDB_EventListener(t *testing.T) {
+	t.Parallel()
+	listener := &recordingListener{}
+	opts := DefaultOptions
+	opts.DirPath = filepath.Join("/lovedb-mem", t.Name())
+	opts.InMemory = true
+	opts.DataFileSize = 32 * 1024
+	opts.DataFileMergeRatio = 0
+	opts.EventListener = listener
+	t.Cleanup(func() {
+		_ = fio.MemFileSystem.RemoveAll(opts.DirPath)
+	})
+	db, err := Open(opts)
+	assert.Nil(t, err)
+
+	for i := 0; i < 2000; i++ {
+		assert.Nil(t, db.Put(testKey(i), testValue(i)))
+	}
+	assert.True(t, len(listener.rotated) > 0)
+	for i, info := range listener.rotated {
+		assert.Equal(t, uint32(i), info.FileId)
+		assert.Equal(t, info.FileId+1, info.NewFileId)
+		assert.Equal(t, data.GetDataFileName(opts.DirPath, info.FileId), info.Path)
+		assert.True(t, info.Size > 0)
+	}
+	//每次切换都会持久化旧的活跃文件并写入hint文件
+	assert.Equal(t, len(listener.rotated), len(listener.syncs))
+	assert.Equal(t, len(listener.rotated), len(listener.hints))
+	assert.True(t, listener.hints[0].Entries > 0)
+
+	syncs := len(listener.syncs)
+	assert.Nil(t, db.Sync())
+	assert.Equal(t, syncs+1, len(listener.syncs))
+	assert.Nil(t, listener.syncs[syncs].Err)
+	assert.Equal(t, db.activeFile.FileId, listener.syncs[syncs].FileId)
+
+	assert.Nil(t, db.Merge())
+	assert.Equal(t, 1, len(listener.mergeStart))
+	assert.Equal(t, 1, len(listener.mergeFinish))
+	assert.Nil(t, listener.mergeFinish[0].Err)
+	assert.True(t, listener.mergeStart[0].TotalSize > 0)
+	assert.Nil(t, db.Close())
+
+	//重新打开时启用merge生成的hint文件
+	hints := len(listener.hints)
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, hints+1, len(listener.hints))
+	assert.True(t, listener.hints[hints].Merge)
+	assert.Equal(t, filepath.Join(opts.DirPath, data.HintFileName), listener.hints[hints].Path)
+
+	//数据损坏
+	inj := fio.NewFaultInjector()
+	opts.IOOpener = inj.Opener()
+	assert.Nil(t, db.Close())
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	inj.CorruptReads(2)
+	assert.NotNil(t, db.Verify())
+	assert.Equal(t, 1, len(listener.corruptions))
+	assert.Equal(t, data.ErrInvalidCRC, listener.corruptions[0].Err)
+	assert.Nil(t, db.Close())
+}
+
+func TestDB_EventListener_RecoveryTruncated(t *testing.T) {
+	listener := &recordingListener{}
+	opts := DefaultOptions
+	opts.DirPath = filepath.Join(t.TempDir(), "lovedb")
+	opts.EventListener = listener
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, db.Put(testKey(i), testValue(i)))
+	}
+	fileId, end := db.activeFile.FileId, db.activeFile.WriteOff
+	assert.Nil(t, db.Close())
+
+	//正常关闭以后重新打开不会截断
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	assert.Nil(t, db.Close())
+	assert.Equal(t, 0, len(listener.truncations))
+
+	//模拟崩溃时活跃文件末尾写了一半的记录
+	encRecord, _ := data.EncodeLogRecord(&data.LogRecord{Key: testKey(100), Value: testValue(100)}, opts.Checksum)
+	file, err := os.OpenFile(data.GetDataFileName(opts.DirPath, fileId), os.O_WRONLY|os.O_APPEND, 0644)
+	assert.Nil(t, err)
+	_, err = file.Write(encRecord[:len(encRecord)/2])
+	assert.Nil(t, err)
+	assert.Nil(t, file.Close())
+
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, []RecoveryTruncatedInfo{{
+		FileId: fileId,
+		Offset: end,
+		Size:   end + int64(len(encRecord)/2),
+	}}, listener.truncations)
+	assert.Equal(t, end, db.activeFile.WriteOff)
+	assert.Nil(t, db.Close())
+}
+
+func TestDB_EventListener_CorruptionInActiveFile(t *testing.T) {
+	listener := &recordingListener{}
+	opts := DefaultOptions
+	opts.DirPath = filepath.Join(t.TempDir(), "lovedb")
+	opts.EventListener = listener
+	//从数据文件的开头加载索引
+	opts.IndexCheckpoint = false
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, db.Put(testKey(i), testValue(i)))
+	}
+	pos := db.index.Get(testKey(50))
+	fileName := data.GetDataFileName(opts.DirPath, pos.Fid)
+	assert.Nil(t, db.Close())
+
+	//活跃文件中间的记录损坏，后面还有已经提交的记录，不能当作写了一半的记录截断
+	content, err := os.ReadFile(fileName)
+	assert.Nil(t, err)
+	content[pos.Offset+int64(pos.Size)-1] ^= 0x01
+	assert.Nil(t, os.WriteFile(fileName, content, 0644))
+
+	_, err = Open(opts)
+	assert.Equal(t, data.ErrInvalidCRC, err)
+	assert.Equal(t, 0, len(listener.truncations))
+	assert.Equal(t, []CorruptionInfo{{FileId: pos.Fid, Offset: pos.Offset, Err: data.ErrInvalidCRC}}, listener.corruptions)
+	after, err := os.ReadFile(fileName)
+	assert.Nil(t, err)
+	assert.Equal(t, len(content), len(after))
+}
@@ -0,0 +1,235 @@
+package fio
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"time"
+)
+
+// BufferedIO 带写缓冲的IO，包装了一个底层的IO
+// 追加写入的数据先放在内存缓冲区中，缓冲区满了、定时器到期、Sync或者Close时才一次性写入底层文件，
+// 把多次小的write系统调用合并成一次。还没有写入底层文件的数据直接从缓冲区中读取
+// 注意：缓冲区中的数据在写入底层文件之前如果进程崩溃就会丢失，需要持久化保证时要调用Sync
+type BufferedIO struct {
+	mu      *sync.Mutex
+	file    IoManager     //底层的IO
+	buf     []byte        //写缓冲区
+	flushed int64         //已经写入底层文件的数据大小
+	err     error         //后台刷缓冲失败的错误，下一次写入或者持久化时返回
+	done    chan struct{} //通知后台刷缓冲的协程退出
+	closed  bool          //已经关闭，重复关闭时直接返回
+}
+
+// NewBufferedIOManager 初始化带写缓冲的IO，flushInterval大于0时会定时把缓冲区写入底层文件
+func NewBufferedIOManager(file IoManager, bufferSize int, flushInterval time.Duration) (*BufferedIO, error) {
+	size, err := file.Size()
+	if err != nil {
+		return nil, err
+	}
+	bio := &BufferedIO{
+		mu:      new(sync.Mutex),
+		file:    file,
+		buf:     make([]byte, 0, bufferSize),
+		flushed: size,
+	}
+	if flushInterval > 0 {
+		bio.done = make(chan struct{})
+		go bio.flushLoop(flushInterval)
+	}
+	return bio, nil
+}
+
+func (b *BufferedIO) Read(p []byte, offset int64) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	//要读的数据全部已经在底层文件中
+	if offset+int64(len(p)) <= b.flushed {
+		return b.file.Read(p, offset)
+	}
+
+	//前一部分在底层文件中，后一部分在缓冲区中
+	var n int
+	if offset < b.flushed {
+		var err error
+		n, err = b.file.Read(p[:b.flushed-offset], offset)
+		if err != nil {
+			return n, err
+		}
+	}
+	bufOff := offset + int64(n) - b.flushed
+	if bufOff >= int64(len(b.buf)) {
+		return n, io.EOF
+	}
+	n += copy(p[n:], b.buf[bufOff:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (b *BufferedIO) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.err != nil {
+		return 0, b.err
+	}
+
+	//缓冲区放不下了，先把缓冲区写入文件
+	if len(b.buf)+len(p) > cap(b.buf) {
+		if err := b.flush(); err != nil {
+			return 0, err
+		}
+	}
+	//比缓冲区还大的数据直接写入文件
+	if len(p) >= cap(b.buf) {
+		n, err := b.file.Write(p)
+		if err != nil {
+			b.discardPartialWrite(n, err)
+			return 0, err
+		}
+		b.flushed += int64(n)
+		return n, nil
+	}
+	b.buf = append(b.buf, p...)
+	return len(p), nil
+}
+
+// Flush 把缓冲区中的数据写入底层文件，不保证持久化
+func (b *BufferedIO) Flush() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.flush()
+}
+
+// Sync 先把缓冲区写入底层文件，再对底层文件持久化
+func (b *BufferedIO) Sync() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err := b.flush(); err != nil {
+		return err
+	}
+	return b.file.Sync()
+}
+
+func (b *BufferedIO) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return nil
+	}
+	b.closed = true
+	if b.done != nil {
+		close(b.done)
+	}
+	if err := b.flush(); err != nil {
+		_ = b.file.Close()
+		return err
+	}
+	return b.file.Close()
+}
+
+func (b *BufferedIO) Size() (int64, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.flushed + int64(len(b.buf)), nil
+}
+
+// Buffered 缓冲区中还没有写入底层文件的数据大小
+func (b *BufferedIO) Buffered() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.buf)
+}
+
+// Preallocate 底层IO支持预分配时进行预分配
+func (b *BufferedIO) Preallocate(size int64) error {
+	if p, ok := b.file.(Preallocator); ok {
+		return p.Preallocate(size)
+	}
+	return nil
+}
+
+// Resize 先把缓冲区写入底层文件，再修正底层IO的逻辑大小
+func (b *BufferedIO) Resize(size int64) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err := b.flush(); err != nil {
+		return err
+	}
+	if r, ok := b.file.(Resizer); ok {
+		if err := r.Resize(size); err != nil {
+			return err
+		}
+		b.flushed = size
+	}
+	return nil
+}
+
+// Truncate 先把缓冲区写入底层文件，再截断底层文件
+func (b *BufferedIO) Truncate(size int64) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err := b.flush(); err != nil {
+		return err
+	}
+	t, ok := b.file.(Truncater)
+	if !ok {
+		return errors.New("io does not support truncate")
+	}
+	if err := t.Truncate(size); err != nil {
+		return err
+	}
+	b.flushed = size
+	return nil
+}
+
+// 把缓冲区写入底层文件，需要在持有锁的情况下调用
+// 只写入了一部分时，剩下的数据保留在缓冲区中
+func (b *BufferedIO) flush() error {
+	if b.err != nil {
+		return b.err
+	}
+	if len(b.buf) == 0 {
+		return nil
+	}
+	n, err := b.file.Write(b.buf)
+	b.flushed += int64(n)
+	b.buf = b.buf[:copy(b.buf, b.buf[n:])]
+	return err
+}
+
+// 直接写入底层文件失败时调用方认为一个字节都没有写入，之后的数据会接着原来的末尾写，
+// 已经写入的一部分需要截断掉，否则后面写入的数据位置和调用方记录的不一致
+// 截断失败或者底层IO不支持截断时，之后的写入都返回这次的错误
+func (b *BufferedIO) discardPartialWrite(n int, err error) {
+	if n == 0 {
+		return
+	}
+	if t, ok := b.file.(Truncater); ok && t.Truncate(b.flushed) == nil {
+		return
+	}
+	b.err = err
+}
+
+// 定时把缓冲区写入底层文件
+func (b *BufferedIO) flushLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			b.mu.Lock()
+			if err := b.flush(); err != nil && b.err == nil {
+				b.err = err
+			}
+			b.mu.Unlock()
+		case <-b.done:
+			return
+		}
+	}
+}
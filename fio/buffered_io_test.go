@@ -0,0 +1,105 @@
+package fio
+
+import (
+	"github.com/stretchr/testify/assert"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBufferedIO_WriteRead(t *testing.T) {
+	path := filepath.Join("../data/", "buffered.data")
+	fio, err := NewFileIoManager(path)
+	defer DestroyTmpFile(path)
+	assert.Nil(t, err)
+	bio, err := NewBufferedIOManager(fio, 16, 0)
+	assert.Nil(t, err)
+
+	_, err = bio.Write([]byte("key-a"))
+	assert.Nil(t, err)
+	_, err = bio.Write([]byte("key-b"))
+	assert.Nil(t, err)
+	//还在缓冲区中，没有写入文件
+	assert.Equal(t, 10, bio.Buffered())
+	fileSize, _ := fio.Size()
+	assert.Equal(t, int64(0), fileSize)
+	size, _ := bio.Size()
+	assert.Equal(t, int64(10), size)
+
+	//缓冲区放不下，先把缓冲区写入文件
+	_, err = bio.Write([]byte("key-c-long"))
+	assert.Nil(t, err)
+	assert.Equal(t, 10, bio.Buffered())
+	fileSize, _ = fio.Size()
+	assert.Equal(t, int64(10), fileSize)
+
+	//跨越文件和缓冲区读取
+	b := make([]byte, 10)
+	n, err := bio.Read(b, 5)
+	assert.Nil(t, err)
+	assert.Equal(t, 10, n)
+	assert.Equal(t, []byte("key-bkey-c"), b)
+
+	//读取超过末尾
+	c := make([]byte, 10)
+	n, err = bio.Read(c, 15)
+	assert.Equal(t, 5, n)
+	assert.NotNil(t, err)
+
+	assert.Nil(t, bio.Sync())
+	assert.Equal(t, 0, bio.Buffered())
+	fileSize, _ = fio.Size()
+	assert.Equal(t, int64(20), fileSize)
+	assert.Nil(t, bio.Close())
+}
+
+func TestBufferedIO_FlushInterval(t *testing.T) {
+	path := filepath.Join("../data/", "buffered.data")
+	fio, err := NewFileIoManager(path)
+	defer DestroyTmpFile(path)
+	assert.Nil(t, err)
+	bio, err := NewBufferedIOManager(fio, 1024, 10*time.Millisecond)
+	assert.Nil(t, err)
+
+	_, err = bio.Write([]byte("bitcask kv"))
+	assert.Nil(t, err)
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, 0, bio.Buffered())
+	fileSize, _ := fio.Size()
+	assert.Equal(t, int64(10), fileSize)
+	assert.Nil(t, bio.Close())
+}
+
+// 每次Write只写入一半就返回错误
+type shortWriteIO struct {
+	*MemoryFile
+}
+
+func (s shortWriteIO) Write(b []byte) (int, error) {
+	n, _ := s.MemoryFile.Write(b[:len(b)/2])
+	return n, ErrInjectedFault
+}
+
+func TestBufferedIO_ShortWrite(t *testing.T) {
+	path := filepath.Join("/lovedb-mem", t.Name(), "buffered.data")
+	defer func() {
+		_ = MemFileSystem.RemoveAll(filepath.Dir(path))
+	}()
+	file, err := NewMemoryIOManager(path)
+	assert.Nil(t, err)
+	bio, err := NewBufferedIOManager(shortWriteIO{file}, 16, 10*time.Millisecond)
+	assert.Nil(t, err)
+
+	//比缓冲区大的数据直接写入文件，只写入一部分时截断回写入之前的大小
+	n, err := bio.Write([]byte("a-very-long-record-1234"))
+	assert.Equal(t, ErrInjectedFault, err)
+	assert.Equal(t, 0, n)
+	size, _ := bio.Size()
+	assert.Equal(t, int64(0), size)
+	fileSize, _ := file.Size()
+	assert.Equal(t, int64(0), fileSize)
+
+	//重复关闭不会panic
+	assert.Nil(t, bio.Close())
+	assert.Nil(t, bio.Close())
+}
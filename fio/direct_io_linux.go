@@ -0,0 +1,173 @@
+//go:build linux
+
+package fio
+
+import (
+	"io"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// directIOBlockSize O_DIRECT要求读写的偏移、长度以及内存地址都按块对齐
+const directIOBlockSize = 4096
+
+// DirectIOFile 直接IO，读写绕过操作系统的页缓存
+// 追加写入的数据不一定是块大小的整数倍，所以内存中保存最后一个没写满的块，
+// 每次写入都把这个块连同新数据一起按块对齐写到磁盘，块中没用到的部分用零填充
+type DirectIOFile struct {
+	fd   *os.File
+	size int64  //逻辑大小，即真正写入的数据的末尾
+	tail []byte //最后一个没有写满的块，长度为directIOBlockSize
+}
+
+// NewDirectIOManager 初始化直接IO,打开文件
+func NewDirectIOManager(fileName string) (*DirectIOFile, error) {
+	fd, err := os.OpenFile(
+		fileName,
+		os.O_CREATE|os.O_RDWR|syscall.O_DIRECT, //写入位置自己维护，所以不使用O_APPEND
+		DataFilePerm,
+	)
+	if err != nil {
+		return nil, err
+	}
+	stat, err := fd.Stat()
+	if err != nil {
+		_ = fd.Close()
+		return nil, err
+	}
+	dio := &DirectIOFile{fd: fd, tail: alignedBlock(directIOBlockSize)}
+	//刚打开时只能以文件大小作为逻辑大小，其中可能包含对齐填充的零值，
+	//加载数据文件时会通过Resize修正
+	if err := dio.Resize(stat.Size()); err != nil {
+		_ = fd.Close()
+		return nil, err
+	}
+	return dio, nil
+}
+
+func (d *DirectIOFile) Read(b []byte, offset int64) (int, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+	if offset >= d.size {
+		return 0, io.EOF
+	}
+	end := offset + int64(len(b))
+	if end > d.size {
+		end = d.size
+	}
+	//读取覆盖[offset, end)的所有块
+	start := alignDown(offset)
+	buf := alignedBlock(int(alignUp(end) - start))
+	n, err := d.fd.ReadAt(buf, start)
+	if err != nil && err != io.EOF {
+		return 0, err
+	}
+	if int64(n) < end-start {
+		return 0, io.ErrUnexpectedEOF
+	}
+	c := copy(b, buf[offset-start:end-start])
+	if c < len(b) {
+		return c, io.EOF
+	}
+	return c, nil
+}
+
+func (d *DirectIOFile) Write(b []byte) (int, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+	//从最后一个没写满的块开始，连同新的数据一起写入
+	start := alignDown(d.size)
+	used := int(d.size - start)
+	end := d.size + int64(len(b))
+	buf := alignedBlock(int(alignUp(end) - start))
+	copy(buf, d.tail[:used])
+	copy(buf[used:], b)
+	if _, err := d.fd.WriteAt(buf, start); err != nil {
+		return 0, err
+	}
+	d.size = end
+
+	//保存新的最后一个块
+	last := alignDown(end)
+	for i := range d.tail {
+		d.tail[i] = 0
+	}
+	copy(d.tail, buf[last-start:end-start])
+	return len(b), nil
+}
+
+// Sync 数据在Write时就已经写到磁盘上了，这里只需要持久化文件的元数据
+func (d *DirectIOFile) Sync() error {
+	return d.fd.Sync()
+}
+
+func (d *DirectIOFile) Close() error {
+	return d.fd.Close()
+}
+
+func (d *DirectIOFile) Size() (int64, error) {
+	return d.size, nil
+}
+
+// Preallocate 预分配文件空间
+func (d *DirectIOFile) Preallocate(size int64) error {
+	return fallocate(d.fd, size)
+}
+
+// Resize 设置文件的逻辑大小，并重新载入最后一个没写满的块
+// 比这个位置更靠后的块都是无效的数据（对齐填充或者崩溃时写了一半的数据），直接截断
+func (d *DirectIOFile) Resize(size int64) error {
+	stat, err := d.fd.Stat()
+	if err != nil {
+		return err
+	}
+	if stat.Size() > alignUp(size) {
+		if err := d.fd.Truncate(alignUp(size)); err != nil {
+			return err
+		}
+	}
+
+	for i := range d.tail {
+		d.tail[i] = 0
+	}
+	start := alignDown(size)
+	if size > start {
+		buf := alignedBlock(directIOBlockSize)
+		n, err := d.fd.ReadAt(buf, start)
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if int64(n) < size-start {
+			return io.ErrUnexpectedEOF
+		}
+		copy(d.tail, buf[:size-start])
+	}
+	d.size = size
+	return nil
+}
+
+// Truncate 截断文件，直接IO的截断就是修正逻辑大小
+func (d *DirectIOFile) Truncate(size int64) error {
+	return d.Resize(size)
+}
+
+// alignedBlock 分配一段起始地址按块对齐的内存
+func alignedBlock(size int) []byte {
+	buf := make([]byte, size+directIOBlockSize)
+	shift := 0
+	if rem := int(uintptr(unsafe.Pointer(&buf[0])) & (directIOBlockSize - 1)); rem != 0 {
+		shift = directIOBlockSize - rem
+	}
+	return buf[shift : shift+size : shift+size]
+}
+
+func alignDown(n int64) int64 {
+	return n &^ (directIOBlockSize - 1)
+}
+
+func alignUp(n int64) int64 {
+	return (n + directIOBlockSize - 1) &^ (directIOBlockSize - 1)
+}
@@ -0,0 +1,17 @@
+//go:build !linux
+
+package fio
+
+import "errors"
+
+var ErrDirectIONotSupported = errors.New("direct io is not supported on this platform")
+
+// DirectIOFile 非linux平台不支持直接IO
+type DirectIOFile struct {
+	FileIO
+}
+
+// NewDirectIOManager 非linux平台不支持直接IO
+func NewDirectIOManager(_ string) (*DirectIOFile, error) {
+	return nil, ErrDirectIONotSupported
+}
@@ -0,0 +1,85 @@
+//go:build linux
+
+package fio
+
+import (
+	"github.com/stretchr/testify/assert"
+	"path/filepath"
+	"testing"
+)
+
+func openDirectIO(t *testing.T, path string) *DirectIOFile {
+	dio, err := NewDirectIOManager(path)
+	if err != nil {
+		t.Skipf("direct io not available: %v", err)
+	}
+	return dio
+}
+
+func TestDirectIO_WriteRead(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "direct.data")
+	dio := openDirectIO(t, path)
+
+	n, err := dio.Write([]byte("key-a"))
+	assert.Nil(t, err)
+	assert.Equal(t, 5, n)
+	n, err = dio.Write([]byte("key-b"))
+	assert.Nil(t, err)
+	assert.Equal(t, 5, n)
+
+	size, err := dio.Size()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(10), size)
+
+	b := make([]byte, 5)
+	n, err = dio.Read(b, 5)
+	assert.Nil(t, err)
+	assert.Equal(t, 5, n)
+	assert.Equal(t, []byte("key-b"), b)
+
+	//读取超过逻辑末尾
+	c := make([]byte, 8)
+	n, err = dio.Read(c, 5)
+	assert.Equal(t, 5, n)
+	assert.NotNil(t, err)
+
+	//跨越多个块的写入
+	big := make([]byte, 3*directIOBlockSize+100)
+	for i := range big {
+		big[i] = byte(i)
+	}
+	_, err = dio.Write(big)
+	assert.Nil(t, err)
+	d := make([]byte, len(big))
+	_, err = dio.Read(d, 10)
+	assert.Nil(t, err)
+	assert.Equal(t, big, d)
+	assert.Nil(t, dio.Close())
+}
+
+func TestDirectIO_Resize(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "direct.data")
+	dio := openDirectIO(t, path)
+
+	_, err := dio.Write([]byte("bitcask kv"))
+	assert.Nil(t, err)
+	assert.Nil(t, dio.Preallocate(1024*1024))
+	assert.Nil(t, dio.Sync())
+	assert.Nil(t, dio.Close())
+
+	//重新打开后文件大小包含了对齐填充的零值
+	dio = openDirectIO(t, path)
+	size, err := dio.Size()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(directIOBlockSize), size)
+
+	//修正逻辑末尾以后继续追加写
+	assert.Nil(t, dio.Resize(10))
+	_, err = dio.Write([]byte(" storage"))
+	assert.Nil(t, err)
+	b := make([]byte, 18)
+	_, err = dio.Read(b, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("bitcask kv storage"), b)
+	assert.Nil(t, dio.Close())
+}
@@ -0,0 +1,29 @@
+//go:build linux
+
+package fio
+
+import (
+	"os"
+	"syscall"
+)
+
+// fallocKeepSize FALLOC_FL_KEEP_SIZE，只分配磁盘块，不改变文件大小
+const fallocKeepSize = 0x1
+
+// fallocate 为文件预分配磁盘空间，文件大小保持不变，所以O_APPEND的写入和读取文件大小都不受影响
+func fallocate(fd *os.File, size int64) error {
+	if size <= 0 {
+		return nil
+	}
+	for {
+		err := syscall.Fallocate(int(fd.Fd()), fallocKeepSize, 0, size)
+		if err == syscall.EINTR {
+			continue
+		}
+		//文件系统不支持预分配就直接忽略，只是少了优化
+		if err == syscall.EOPNOTSUPP {
+			return nil
+		}
+		return err
+	}
+}
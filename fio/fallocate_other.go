@@ -0,0 +1,10 @@
+//go:build !linux
+
+package fio
+
+import "os"
+
+// fallocate 非linux平台不支持预分配，直接忽略
+func fallocate(_ *os.File, _ int64) error {
+	return nil
+}
@@ -0,0 +1,211 @@
+package fio
+
+import (
+	"errors"
+	"math/rand"
+	"sync"
+)
+
+var (
+	ErrInjectedFault = errors.New("injected io fault")
+	ErrInjectedCrash = errors.New("injected crash, io is not available")
+)
+
+// FaultInjector 故障注入器，用于测试崩溃恢复
+// 通过Opener打开的文件都会被包装成FaultFile，把Opener设置到数据库的Options.IOOpener中，
+// 这个数据库打开的所有文件（包括merge时的临时实例）都会被包装，不会影响其他数据库
+// 可以让第N次Write失败或者只写入一半，模拟掉电丢失没有持久化的数据，以及在Read时损坏数据
+type FaultInjector struct {
+	mu           *sync.Mutex
+	writes       int                     //累计的Write次数
+	failAt       int                     //第failAt次Write直接返回错误，为0表示不注入
+	shortAt      int                     //第shortAt次Write只写入一半然后返回错误，为0表示不注入
+	crashed      bool                    //注入过写入故障以后，所有的写入都会失败，相当于进程已经崩溃
+	corruptReads int                     //接下来多少次Read返回的数据会被损坏
+	files        map[*FaultFile]struct{} //所有打开着的文件
+}
+
+// NewFaultInjector 初始化故障注入器
+func NewFaultInjector() *FaultInjector {
+	return &FaultInjector{
+		mu:    new(sync.Mutex),
+		files: make(map[*FaultFile]struct{}),
+	}
+}
+
+// Opener 返回打开文件时包装成FaultFile的IOOpener
+func (inj *FaultInjector) Opener() IOOpener {
+	return func(fileName string, ioType FileIOType) (IoManager, error) {
+		file, err := NewIOManager(fileName, ioType)
+		if err != nil {
+			return nil, err
+		}
+		return inj.wrap(file), nil
+	}
+}
+
+// FailWriteAt 从现在开始计数，第n次Write返回错误
+func (inj *FaultInjector) FailWriteAt(n int) {
+	inj.mu.Lock()
+	defer inj.mu.Unlock()
+	inj.writes, inj.failAt, inj.shortAt = 0, n, 0
+}
+
+// ShortWriteAt 从现在开始计数，第n次Write只写入一半的数据然后返回错误
+func (inj *FaultInjector) ShortWriteAt(n int) {
+	inj.mu.Lock()
+	defer inj.mu.Unlock()
+	inj.writes, inj.failAt, inj.shortAt = 0, 0, n
+}
+
+// CorruptReads 接下来n次Read返回的数据中翻转一个比特
+func (inj *FaultInjector) CorruptReads(n int) {
+	inj.mu.Lock()
+	defer inj.mu.Unlock()
+	inj.corruptReads = n
+}
+
+// Crashed 是否已经注入过写入故障
+func (inj *FaultInjector) Crashed() bool {
+	inj.mu.Lock()
+	defer inj.mu.Unlock()
+	return inj.crashed
+}
+
+// PowerLoss 模拟掉电：所有文件都截断到最后一次持久化时的大小，然后关闭（进程已经退出）
+// rnd不为空时每个文件随机保留一部分没有持久化的数据，模拟操作系统已经把一部分页缓存写到了磁盘上
+// 之后清除所有注入的故障；数据目录的锁需要调用方释放，之后可以重新打开数据库
+func (inj *FaultInjector) PowerLoss(rnd *rand.Rand) error {
+	inj.mu.Lock()
+	defer inj.mu.Unlock()
+	for f := range inj.files {
+		t, ok := f.file.(Truncater)
+		if !ok {
+			continue
+		}
+		size, err := f.file.Size()
+		if err != nil {
+			return err
+		}
+		if size > f.synced {
+			keep := f.synced
+			if rnd != nil {
+				keep += rnd.Int63n(size - f.synced + 1)
+			}
+			if err := t.Truncate(keep); err != nil {
+				return err
+			}
+		}
+	}
+	//崩溃之前打开的文件都已经失效了，磁盘上的文件需要关闭文件描述符
+	for f := range inj.files {
+		_ = f.file.Close()
+	}
+	inj.files = make(map[*FaultFile]struct{})
+	inj.writes, inj.failAt, inj.shortAt, inj.crashed, inj.corruptReads = 0, 0, 0, false, 0
+	return nil
+}
+
+func (inj *FaultInjector) wrap(file IoManager) IoManager {
+	inj.mu.Lock()
+	defer inj.mu.Unlock()
+	//打开时文件中已有的数据视为已经持久化
+	size, _ := file.Size()
+	f := &FaultFile{inj: inj, file: file, synced: size}
+	inj.files[f] = struct{}{}
+	return f
+}
+
+// FaultFile 被注入故障的IO
+type FaultFile struct {
+	inj    *FaultInjector
+	file   IoManager
+	synced int64 //最后一次持久化时的文件大小
+}
+
+func (f *FaultFile) Read(b []byte, offset int64) (int, error) {
+	n, err := f.file.Read(b, offset)
+	f.inj.mu.Lock()
+	defer f.inj.mu.Unlock()
+	if n > 0 && f.inj.corruptReads > 0 {
+		f.inj.corruptReads--
+		b[n/2] ^= 0x01
+	}
+	return n, err
+}
+
+func (f *FaultFile) Write(b []byte) (int, error) {
+	f.inj.mu.Lock()
+	defer f.inj.mu.Unlock()
+	if f.inj.crashed {
+		return 0, ErrInjectedCrash
+	}
+	f.inj.writes++
+	if f.inj.writes == f.inj.failAt {
+		f.inj.crashed = true
+		return 0, ErrInjectedFault
+	}
+	if f.inj.writes == f.inj.shortAt {
+		f.inj.crashed = true
+		n, err := f.file.Write(b[:len(b)/2])
+		if err != nil {
+			return n, err
+		}
+		return n, ErrInjectedFault
+	}
+	return f.file.Write(b)
+}
+
+// Sync 持久化成功以后记录文件大小，掉电时不会丢失这之前的数据
+func (f *FaultFile) Sync() error {
+	f.inj.mu.Lock()
+	defer f.inj.mu.Unlock()
+	if f.inj.crashed {
+		return ErrInjectedCrash
+	}
+	if err := f.file.Sync(); err != nil {
+		return err
+	}
+	size, err := f.file.Size()
+	if err != nil {
+		return err
+	}
+	f.synced = size
+	return nil
+}
+
+func (f *FaultFile) Close() error {
+	f.inj.mu.Lock()
+	delete(f.inj.files, f)
+	f.inj.mu.Unlock()
+	return f.file.Close()
+}
+
+func (f *FaultFile) Size() (int64, error) {
+	return f.file.Size()
+}
+
+// Resize 修正底层IO的逻辑大小
+func (f *FaultFile) Resize(size int64) error {
+	if r, ok := f.file.(Resizer); ok {
+		return r.Resize(size)
+	}
+	return nil
+}
+
+// Truncate 截断底层文件
+func (f *FaultFile) Truncate(size int64) error {
+	t, ok := f.file.(Truncater)
+	if !ok {
+		return ErrInjectedFault
+	}
+	if err := t.Truncate(size); err != nil {
+		return err
+	}
+	f.inj.mu.Lock()
+	defer f.inj.mu.Unlock()
+	if f.synced > size {
+		f.synced = size
+	}
+	return nil
+}
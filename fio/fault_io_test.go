@@ -0,0 +1,75 @@
+package fio
+
+import (
+	"github.com/stretchr/testify/assert"
+	"path/filepath"
+	"testing"
+)
+
+func TestFaultInjector_Write(t *testing.T) {
+	dir := "/fault-test"
+	defer MemFileSystem.RemoveAll(dir)
+	inj := NewFaultInjector()
+	open := inj.Opener()
+
+	f, err := open(filepath.Join(dir, "a.data"), MemoryIO)
+	assert.Nil(t, err)
+	_, ok := f.(*FaultFile)
+	assert.True(t, ok)
+
+	//第2次写入失败，之后的写入也都失败
+	inj.FailWriteAt(2)
+	_, err = f.Write([]byte("key-a"))
+	assert.Nil(t, err)
+	_, err = f.Write([]byte("key-b"))
+	assert.Equal(t, ErrInjectedFault, err)
+	_, err = f.Write([]byte("key-c"))
+	assert.Equal(t, ErrInjectedCrash, err)
+	assert.True(t, inj.Crashed())
+
+	//掉电以后没有持久化的数据丢失
+	assert.Nil(t, inj.PowerLoss(nil))
+	size, _ := f.Size()
+	assert.Equal(t, int64(0), size)
+
+	//重新打开，只写入一半
+	f, err = open(filepath.Join(dir, "a.data"), MemoryIO)
+	assert.Nil(t, err)
+	inj.ShortWriteAt(2)
+	_, err = f.Write([]byte("key-a"))
+	assert.Nil(t, err)
+	assert.Nil(t, f.Sync())
+	n, err := f.Write([]byte("key-b"))
+	assert.Equal(t, ErrInjectedFault, err)
+	assert.Equal(t, 2, n)
+	size, _ = f.Size()
+	assert.Equal(t, int64(7), size)
+	assert.Nil(t, inj.PowerLoss(nil))
+	size, _ = f.Size()
+	assert.Equal(t, int64(5), size)
+}
+
+func TestFaultInjector_CorruptRead(t *testing.T) {
+	dir := "/fault-test"
+	defer MemFileSystem.RemoveAll(dir)
+	inj := NewFaultInjector()
+
+	f, err := inj.Opener()(filepath.Join(dir, "a.data"), MemoryIO)
+	assert.Nil(t, err)
+	_, err = f.Write([]byte("bitcask kv"))
+	assert.Nil(t, err)
+
+	inj.CorruptReads(1)
+	b := make([]byte, 10)
+	_, err = f.Read(b, 0)
+	assert.Nil(t, err)
+	assert.NotEqual(t, []byte("bitcask kv"), b)
+	_, err = f.Read(b, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("bitcask kv"), b)
+
+	//不通过Opener打开的文件不会被包装
+	f2, _ := NewIOManager(filepath.Join(dir, "a.data"), MemoryIO)
+	_, ok := f2.(*FaultFile)
+	assert.False(t, ok)
+}
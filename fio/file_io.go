@@ -44,3 +44,13 @@ func (f FileIO) Size() (int64, error) {
 	}
 	return stat.Size(), err
 }
+
+// Truncate 截断文件，O_APPEND模式下之后的写入从新的末尾开始
+func (f FileIO) Truncate(size int64) error {
+	return f.fd.Truncate(size)
+}
+
+// Preallocate 预分配文件空间
+func (f FileIO) Preallocate(size int64) error {
+	return fallocate(f.fd, size)
+}
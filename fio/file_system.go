@@ -0,0 +1,102 @@
+package fio
+
+import (
+	"context"
+	"github.com/gofrs/flock"
+	"lovedb/utils"
+	"os"
+)
+
+// FileSystem 数据目录相关的文件系统操作的抽象，有磁盘和内存两种实现
+type FileSystem interface {
+	// MkdirAll 创建目录
+	MkdirAll(dir string) error
+
+	// ReadDir 返回目录下所有文件的名称
+	ReadDir(dir string) ([]string, error)
+
+	// Exists 文件或目录是否存在
+	Exists(name string) bool
+
+	// Remove 删除文件
+	Remove(name string) error
+
+	// RemoveAll 删除目录以及目录下的所有文件
+	RemoveAll(dir string) error
+
+	// Rename 移动文件
+	Rename(oldName, newName string) error
+
+	// DirSize 目录下所有文件的大小
+	DirSize(dir string) (int64, error)
+
+	// CopyDir 把目录拷贝到磁盘上的目标目录，排除掉匹配exclude的文件，每个文件之前检查ctx是否已经取消
+	CopyDir(ctx context.Context, src, dest string, exclude []string) error
+
+	// TryLock 尝试对锁文件加锁，拿到锁返回释放锁的函数，锁被占用则返回nil
+	TryLock(name string) (func() error, error)
+}
+
+var (
+	// OSFileSystem 磁盘文件系统
+	OSFileSystem FileSystem = osFileSystem{}
+
+	// MemFileSystem 进程内的内存文件系统，和MemoryIO共享同一份数据
+	MemFileSystem FileSystem = memFileSystem{}
+)
+
+type osFileSystem struct{}
+
+func (osFileSystem) MkdirAll(dir string) error {
+	return os.MkdirAll(dir, os.ModePerm)
+}
+
+func (osFileSystem) ReadDir(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, len(entries))
+	for i, entry := range entries {
+		names[i] = entry.Name()
+	}
+	return names, nil
+}
+
+func (osFileSystem) Exists(name string) bool {
+	_, err := os.Stat(name)
+	return err == nil
+}
+
+func (osFileSystem) Remove(name string) error {
+	return os.Remove(name)
+}
+
+func (osFileSystem) RemoveAll(dir string) error {
+	return os.RemoveAll(dir)
+}
+
+func (osFileSystem) Rename(oldName, newName string) error {
+	return os.Rename(oldName, newName)
+}
+
+func (osFileSystem) DirSize(dir string) (int64, error) {
+	return utils.DirSize(dir)
+}
+
+func (osFileSystem) CopyDir(ctx context.Context, src, dest string, exclude []string) error {
+	return utils.CopyFile(ctx, src, dest, exclude)
+}
+
+// TryLock 使用flock保证多进程之间的互斥
+func (osFileSystem) TryLock(name string) (func() error, error) {
+	fileLock := flock.New(name)
+	hold, err := fileLock.TryLock()
+	if err != nil {
+		return nil, err
+	}
+	if !hold {
+		return nil, nil
+	}
+	return fileLock.Close, nil
+}
@@ -9,6 +9,10 @@ const (
 	StandardFIO FileIOType = iota
 	// MemoryMap mmap
 	MemoryMap
+	// DirectIO 绕过页缓存的直接IO(O_DIRECT)
+	DirectIO
+	// MemoryIO 内存IO，不访问磁盘
+	MemoryIO
 )
 
 // IoManager 抽象IO管理接口，可以接入不同的IO类型，目前支持标准文件IO
@@ -28,6 +32,36 @@ type IoManager interface {
 	Size() (int64, error)
 }
 
+// Preallocator 支持预分配磁盘空间的IO，预分配以后追加写不需要每次都去更新文件系统的元数据
+type Preallocator interface {
+	// Preallocate 预分配size大小的空间，不改变文件的逻辑大小
+	Preallocate(size int64) error
+}
+
+// Resizer 物理大小和实际数据大小可能不一致的IO（比如direct io按块对齐写入会有零值填充），
+// 加载数据文件时找到了真正的数据末尾后，通过该接口告诉IO层
+type Resizer interface {
+	// Resize 设置文件的逻辑大小，之后的写入从这个位置开始
+	Resize(size int64) error
+}
+
+// Truncater 支持截断的IO，用于丢弃崩溃时写了一半的数据
+type Truncater interface {
+	// Truncate 把文件截断到size大小，之后的写入从这个位置开始
+	Truncate(size int64) error
+}
+
+// IOOpener 打开文件的IO，可以在打开时包装IO，比如测试崩溃恢复时注入故障
+type IOOpener func(fileName string, ioType FileIOType) (IoManager, error)
+
+// OpenIO 用opener打开文件的IO，opener为nil时使用NewIOManager
+func OpenIO(opener IOOpener, fileName string, ioType FileIOType) (IoManager, error) {
+	if opener == nil {
+		return NewIOManager(fileName, ioType)
+	}
+	return opener(fileName, ioType)
+}
+
 // NewIOManager 初始化IO Manager
 func NewIOManager(fileName string, ioType FileIOType) (IoManager, error) {
 	switch ioType {
@@ -35,6 +69,10 @@ func NewIOManager(fileName string, ioType FileIOType) (IoManager, error) {
 		return NewFileIoManager(fileName)
 	case MemoryMap:
 		return NewMMapIOManager(fileName)
+	case DirectIO:
+		return NewDirectIOManager(fileName)
+	case MemoryIO:
+		return NewMemoryIOManager(fileName)
 	default:
 		panic("unsupported io type")
 	}
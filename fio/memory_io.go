@@ -0,0 +1,260 @@
+package fio
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var ErrMemFileNotExist = errors.New("memory file does not exist")
+
+// MemoryFile 内存IO，文件内容完全保存在内存中，不会访问磁盘
+// 同一个路径打开的是同一份数据，Close之后数据仍然保留，直到通过MemFileSystem删除（DB.Destroy会删除整个目录），
+// 相当于进程内的一个内存文件系统
+type MemoryFile struct {
+	file *memData
+}
+
+type memData struct {
+	mu   *sync.RWMutex
+	data []byte
+}
+
+// memStore 进程内所有的内存文件和目录，key为清理过的路径
+type memStore struct {
+	mu    *sync.Mutex
+	files map[string]*memData
+	dirs  map[string]struct{}
+	locks map[string]struct{}
+}
+
+var mem = &memStore{
+	mu:    new(sync.Mutex),
+	files: make(map[string]*memData),
+	dirs:  make(map[string]struct{}),
+	locks: make(map[string]struct{}),
+}
+
+// NewMemoryIOManager 打开内存文件，不存在则创建
+func NewMemoryIOManager(fileName string) (*MemoryFile, error) {
+	fileName = filepath.Clean(fileName)
+	mem.mu.Lock()
+	defer mem.mu.Unlock()
+	file, ok := mem.files[fileName]
+	if !ok {
+		file = &memData{mu: new(sync.RWMutex)}
+		mem.files[fileName] = file
+		mem.dirs[filepath.Dir(fileName)] = struct{}{}
+	}
+	return &MemoryFile{file: file}, nil
+}
+
+func (m *MemoryFile) Read(b []byte, offset int64) (int, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+	m.file.mu.RLock()
+	defer m.file.mu.RUnlock()
+	if offset >= int64(len(m.file.data)) {
+		return 0, io.EOF
+	}
+	n := copy(b, m.file.data[offset:])
+	if n < len(b) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (m *MemoryFile) Write(b []byte) (int, error) {
+	m.file.mu.Lock()
+	defer m.file.mu.Unlock()
+	m.file.data = append(m.file.data, b...)
+	return len(b), nil
+}
+
+// Truncate 截断内存文件
+func (m *MemoryFile) Truncate(size int64) error {
+	m.file.mu.Lock()
+	defer m.file.mu.Unlock()
+	if size < int64(len(m.file.data)) {
+		m.file.data = m.file.data[:size]
+	}
+	return nil
+}
+
+// Sync 内存文件不需要持久化
+func (m *MemoryFile) Sync() error {
+	return nil
+}
+
+// Close 内存文件关闭以后数据仍然保留
+func (m *MemoryFile) Close() error {
+	return nil
+}
+
+func (m *MemoryFile) Size() (int64, error) {
+	m.file.mu.RLock()
+	defer m.file.mu.RUnlock()
+	return int64(len(m.file.data)), nil
+}
+
+// 内存文件系统
+type memFileSystem struct{}
+
+func (memFileSystem) MkdirAll(dir string) error {
+	mem.mu.Lock()
+	defer mem.mu.Unlock()
+	mem.dirs[filepath.Clean(dir)] = struct{}{}
+	return nil
+}
+
+func (memFileSystem) ReadDir(dir string) ([]string, error) {
+	dir = filepath.Clean(dir)
+	mem.mu.Lock()
+	defer mem.mu.Unlock()
+	if _, ok := mem.dirs[dir]; !ok {
+		return nil, os.ErrNotExist
+	}
+	var names []string
+	for name := range mem.files {
+		if filepath.Dir(name) == dir {
+			names = append(names, filepath.Base(name))
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (memFileSystem) Exists(name string) bool {
+	name = filepath.Clean(name)
+	mem.mu.Lock()
+	defer mem.mu.Unlock()
+	if _, ok := mem.files[name]; ok {
+		return true
+	}
+	_, ok := mem.dirs[name]
+	return ok
+}
+
+func (memFileSystem) Remove(name string) error {
+	name = filepath.Clean(name)
+	mem.mu.Lock()
+	defer mem.mu.Unlock()
+	if _, ok := mem.files[name]; !ok {
+		return ErrMemFileNotExist
+	}
+	delete(mem.files, name)
+	return nil
+}
+
+func (memFileSystem) RemoveAll(dir string) error {
+	dir = filepath.Clean(dir)
+	prefix := dir + string(filepath.Separator)
+	mem.mu.Lock()
+	defer mem.mu.Unlock()
+	for name := range mem.files {
+		if name == dir || strings.HasPrefix(name, prefix) {
+			delete(mem.files, name)
+		}
+	}
+	for name := range mem.dirs {
+		if name == dir || strings.HasPrefix(name, prefix) {
+			delete(mem.dirs, name)
+		}
+	}
+	return nil
+}
+
+func (memFileSystem) Rename(oldName, newName string) error {
+	oldName, newName = filepath.Clean(oldName), filepath.Clean(newName)
+	mem.mu.Lock()
+	defer mem.mu.Unlock()
+	file, ok := mem.files[oldName]
+	if !ok {
+		return ErrMemFileNotExist
+	}
+	delete(mem.files, oldName)
+	mem.files[newName] = file
+	mem.dirs[filepath.Dir(newName)] = struct{}{}
+	return nil
+}
+
+func (memFileSystem) DirSize(dir string) (int64, error) {
+	dir = filepath.Clean(dir)
+	prefix := dir + string(filepath.Separator)
+	mem.mu.Lock()
+	defer mem.mu.Unlock()
+	var size int64
+	for name, file := range mem.files {
+		if strings.HasPrefix(name, prefix) {
+			file.mu.RLock()
+			size += int64(len(file.data))
+			file.mu.RUnlock()
+		}
+	}
+	return size, nil
+}
+
+// CopyDir 把内存目录拷贝到磁盘上的目录
+func (memFileSystem) CopyDir(ctx context.Context, src, dest string, exclude []string) error {
+	names, err := MemFileSystem.ReadDir(src)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dest, os.ModePerm); err != nil {
+		return err
+	}
+	for _, name := range names {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if excluded(name, exclude) {
+			continue
+		}
+		mem.mu.Lock()
+		file := mem.files[filepath.Join(filepath.Clean(src), name)]
+		mem.mu.Unlock()
+		if file == nil {
+			continue
+		}
+		file.mu.RLock()
+		err := os.WriteFile(filepath.Join(dest, name), file.data, DataFilePerm)
+		file.mu.RUnlock()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// TryLock 内存目录的锁只在进程内互斥
+func (memFileSystem) TryLock(name string) (func() error, error) {
+	name = filepath.Clean(name)
+	mem.mu.Lock()
+	defer mem.mu.Unlock()
+	if _, ok := mem.locks[name]; ok {
+		return nil, nil
+	}
+	mem.locks[name] = struct{}{}
+	return func() error {
+		mem.mu.Lock()
+		defer mem.mu.Unlock()
+		delete(mem.locks, name)
+		return nil
+	}, nil
+}
+
+// 文件名是否匹配需要排除的模式
+func excluded(name string, exclude []string) bool {
+	for _, e := range exclude {
+		if matched, _ := filepath.Match(e, name); matched {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,79 @@
+package fio
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMemoryIO_WriteRead(t *testing.T) {
+	path := filepath.Join("/mem-test", "a.data")
+	defer MemFileSystem.RemoveAll("/mem-test")
+	mio, err := NewMemoryIOManager(path)
+	assert.Nil(t, err)
+
+	_, err = mio.Write([]byte("key-a"))
+	assert.Nil(t, err)
+	_, err = mio.Write([]byte("key-b"))
+	assert.Nil(t, err)
+
+	b := make([]byte, 5)
+	n, err := mio.Read(b, 5)
+	assert.Nil(t, err)
+	assert.Equal(t, 5, n)
+	assert.Equal(t, []byte("key-b"), b)
+
+	c := make([]byte, 5)
+	n, err = mio.Read(c, 8)
+	assert.Equal(t, 2, n)
+	assert.NotNil(t, err)
+	assert.Nil(t, mio.Close())
+
+	//重新打开同一个路径可以读到之前的数据
+	mio2, err := NewMemoryIOManager(path)
+	assert.Nil(t, err)
+	size, _ := mio2.Size()
+	assert.Equal(t, int64(10), size)
+}
+
+func TestMemFileSystem(t *testing.T) {
+	dir := "/mem-test"
+	defer MemFileSystem.RemoveAll(dir)
+	assert.False(t, MemFileSystem.Exists(dir))
+	assert.Nil(t, MemFileSystem.MkdirAll(dir))
+	assert.True(t, MemFileSystem.Exists(dir))
+
+	mio, _ := NewMemoryIOManager(filepath.Join(dir, "b.data"))
+	_, _ = mio.Write([]byte("bitcask kv"))
+	_, _ = NewMemoryIOManager(filepath.Join(dir, "a.data"))
+
+	names, err := MemFileSystem.ReadDir(dir)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"a.data", "b.data"}, names)
+	size, _ := MemFileSystem.DirSize(dir)
+	assert.Equal(t, int64(10), size)
+
+	assert.Nil(t, MemFileSystem.Rename(filepath.Join(dir, "b.data"), filepath.Join(dir, "c.data")))
+	assert.False(t, MemFileSystem.Exists(filepath.Join(dir, "b.data")))
+	assert.Nil(t, MemFileSystem.Remove(filepath.Join(dir, "a.data")))
+	names, _ = MemFileSystem.ReadDir(dir)
+	assert.Equal(t, []string{"c.data"}, names)
+
+	//目录锁进程内互斥
+	unlock, err := MemFileSystem.TryLock(filepath.Join(dir, "flock"))
+	assert.Nil(t, err)
+	assert.NotNil(t, unlock)
+	unlock2, _ := MemFileSystem.TryLock(filepath.Join(dir, "flock"))
+	assert.Nil(t, unlock2)
+	assert.Nil(t, unlock())
+
+	//拷贝到磁盘
+	dest, _ := os.MkdirTemp("", "mem-backup")
+	defer DestroyTmpFile(dest)
+	assert.Nil(t, MemFileSystem.CopyDir(context.Background(), dir, dest, nil))
+	content, err := os.ReadFile(filepath.Join(dest, "c.data"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("bitcask kv"), content)
+}
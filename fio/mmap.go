@@ -12,10 +12,13 @@ type MMap struct {
 
 // NewMMapIOManager 初始化MMap IO
 func NewMMapIOManager(fileName string) (*MMap, error) {
-	_, err := os.OpenFile(fileName, os.O_CREATE, DataFilePerm)
+	file, err := os.OpenFile(fileName, os.O_CREATE, DataFilePerm)
 	if err != nil {
 		return nil, err
 	}
+	if err := file.Close(); err != nil {
+		return nil, err
+	}
 	//读取文件到虚拟内存空间中
 	readerAt, err := mmap.Open(fileName)
 	if err != nil {
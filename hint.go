@@ -0,0 +1,134 @@
+package lovedb
+
+import (
+	"lovedb/data"
+	"strconv"
+)
+
+// 每个数据文件在切换为旧文件时会写一个hint文件，记录文件中每条记录的key、类型、事务序列号和位置，
+// 启动时读取hint文件就能构建索引，不需要再读取数据文件中的value
+// hint文件的最后是一条结束记录，value为对应数据文件的大小，没有结束记录的hint文件是写了一半的，不能使用
+
+const dataHintEndKey = "hint-end"
+
+// 一次写入hint文件的最大字节数
+const dataHintWriteSize = 1024 * 1024
+
+// 数据文件中一条记录的索引信息，record中只有key、类型和事务序列号
+type hintEntry struct {
+	record *data.LogRecord
+	pos    *data.LogRecordPos
+}
+
+// 记录活跃文件中写入的记录，切换活跃文件时写入hint文件
+// pos和调用方共用，分块存储的value写入以后修改的大小也会记录下来
+func (db *DB) addHintEntry(logRecord *data.LogRecord, pos *data.LogRecordPos) {
+	if !db.hintComplete || logRecord.Type == data.LogRecordChunk {
+		return
+	}
+	db.hintEntries = append(db.hintEntries, &hintEntry{
+		record: &data.LogRecord{
+			Key:   append([]byte{}, logRecord.Key...),
+			Type:  logRecord.Type,
+			SeqNo: logRecord.SeqNo,
+		},
+		pos: pos,
+	})
+}
+
+// 写入数据文件的hint文件，end为数据文件的大小
+func (db *DB) writeDataHint(fileId uint32, entries []*hintEntry, end int64) (err error) {
+	fileName := data.GetDataHintFileName(db.options.DirPath, fileId)
+	//之前写了一半的hint文件
+	if db.fs.Exists(fileName) {
+		if err := db.fs.Remove(fileName); err != nil {
+			return err
+		}
+	}
+	hintFile, err := data.OpenDataHintFile(db.options.DirPath, fileId, db.fileIOType(), db.options.Checksum, db.options.IOOpener)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = hintFile.Close()
+		if err != nil {
+			_ = db.fs.Remove(fileName)
+		}
+	}()
+
+	var buf []byte
+	for _, entry := range entries {
+		encRecord, _ := data.EncodeLogRecord(&data.LogRecord{
+			Key:   entry.record.Key,
+			Value: data.EncodeLogRecordPos(entry.pos),
+			Type:  entry.record.Type,
+			SeqNo: entry.record.SeqNo,
+		}, hintFile.Checksum)
+		buf = append(buf, encRecord...)
+		if len(buf) >= dataHintWriteSize {
+			if err := hintFile.Write(buf); err != nil {
+				return err
+			}
+			buf = buf[:0]
+		}
+	}
+	//结束记录使用fin类型，事务的fin记录总是带有事务序列号，不会混淆
+	endRecord, _ := data.EncodeLogRecord(&data.LogRecord{
+		Key:   []byte(dataHintEndKey),
+		Value: []byte(strconv.FormatInt(end, 10)),
+		Type:  data.LogRecordFinished,
+		SeqNo: nonTxSeqNo,
+	}, hintFile.Checksum)
+	buf = append(buf, endRecord...)
+	if err := hintFile.Write(buf); err != nil {
+		return err
+	}
+	if err := hintFile.Sync(); err != nil {
+		return err
+	}
+	db.events.OnHintFileWritten(HintFileInfo{Path: fileName, FileId: fileId, Entries: len(entries)})
+	return nil
+}
+
+// 读取数据文件的hint文件，hint文件不存在、没有写完或者已经损坏时返回false
+func (db *DB) loadDataHint(dataFile *data.DataFile) ([]*hintEntry, bool) {
+	fileName := data.GetDataHintFileName(db.options.DirPath, dataFile.FileId)
+	if !db.fs.Exists(fileName) {
+		return nil, false
+	}
+	hintFile, err := data.OpenDataHintFile(db.options.DirPath, dataFile.FileId, db.fileIOType(), db.options.Checksum, db.options.IOOpener)
+	if err != nil {
+		return nil, false
+	}
+	defer func() {
+		_ = hintFile.Close()
+	}()
+
+	var entries []*hintEntry
+	offset := hintFile.HeaderSize()
+	for {
+		logRecord, n, err := hintFile.ReadLogRecord(offset)
+		if err != nil {
+			return nil, false
+		}
+		//结束记录，hint文件记录的数据文件大小需要和数据文件对得上
+		if logRecord.Type == data.LogRecordFinished && logRecord.SeqNo == nonTxSeqNo {
+			end, err := strconv.ParseInt(string(logRecord.Value), 10, 64)
+			if err != nil {
+				return nil, false
+			}
+			size, err := dataFile.IoManager.Size()
+			if err != nil || end < dataFile.HeaderSize() || end > size {
+				return nil, false
+			}
+			return entries, true
+		}
+		pos := data.DecodeLogRecordPos(logRecord.Value)
+		if pos.Fid != dataFile.FileId || pos.Offset < dataFile.HeaderSize() {
+			return nil, false
+		}
+		logRecord.Value = nil
+		entries = append(entries, &hintEntry{record: logRecord, pos: pos})
+		offset += n
+	}
+}
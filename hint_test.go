@@ -0,0 +1,83 @@
+package lovedb
+
+import (
+	"github.com/stretchr/testify/assert"
+	"lovedb/data"
+	"lovedb/fio"
+	"path/filepath"
+	"testing"
+)
+
+func TestDB_DataHint(t *testing.T) {
+	t.Parallel()
+	db, opts := openInMemoryDB(t)
+	for i := 0; i < 2000; i++ {
+		assert.Nil(t, db.Put(testKey(i), testValue(i)))
+	}
+	for i := 0; i < 500; i++ {
+		assert.Nil(t, db.Delete(testKey(i)))
+	}
+	//跨越多个数据文件的事务
+	wb := db.NewWriteBatch(DefaultWriteBatchOptions)
+	for i := 2000; i < 3000; i++ {
+		assert.Nil(t, wb.Put(testKey(i), testValue(i)))
+	}
+	assert.Nil(t, wb.Commit())
+	activeFid := db.activeFile.FileId
+	assert.Greater(t, activeFid, uint32(2))
+	assert.Nil(t, db.Close())
+	//不使用索引快照，启动时从hint文件加载
+	assert.Nil(t, fio.MemFileSystem.Remove(filepath.Join(opts.DirPath, data.IndexCheckpointName)))
+	opts.IndexCheckpoint = false
+
+	//除了活跃文件，每个数据文件都有hint文件
+	for fid := uint32(0); fid <= activeFid; fid++ {
+		assert.Equal(t, fid != activeFid, fio.MemFileSystem.Exists(data.GetDataHintFileName(opts.DirPath, fid)))
+	}
+
+	check := func() {
+		db, err := Open(opts)
+		assert.Nil(t, err)
+		for i := 0; i < 3000; i++ {
+			val, err := db.Get(testKey(i))
+			if i < 500 {
+				assert.Equal(t, ErrKeyNotFound, err)
+			} else {
+				assert.Nil(t, err)
+				assert.Equal(t, testValue(i), val)
+			}
+		}
+		assert.Nil(t, db.Close())
+	}
+	check()
+
+	//hint文件没有写完，读取数据文件，并重新生成hint文件
+	hintFile, err := fio.NewMemoryIOManager(data.GetDataHintFileName(opts.DirPath, 1))
+	assert.Nil(t, err)
+	hintSize, err := hintFile.Size()
+	assert.Nil(t, err)
+	assert.Nil(t, hintFile.Truncate(hintSize-3))
+	check()
+	hintFile, err = fio.NewMemoryIOManager(data.GetDataHintFileName(opts.DirPath, 1))
+	assert.Nil(t, err)
+	size, err := hintFile.Size()
+	assert.Nil(t, err)
+	assert.Equal(t, hintSize, size)
+
+	//损坏数据文件中最后一个value，从hint文件加载索引时不会读取value
+	dataFile, err := fio.NewMemoryIOManager(data.GetDataFileName(opts.DirPath, 0))
+	assert.Nil(t, err)
+	dataSize, err := dataFile.Size()
+	assert.Nil(t, err)
+	assert.Nil(t, dataFile.Truncate(dataSize-1))
+	_, err = dataFile.Write([]byte{0})
+	assert.Nil(t, err)
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	assert.Nil(t, db.Close())
+
+	//没有hint文件时读取数据文件，可以发现数据损坏
+	assert.Nil(t, fio.MemFileSystem.Remove(data.GetDataHintFileName(opts.DirPath, 0)))
+	_, err = Open(opts)
+	assert.Equal(t, data.ErrInvalidCRC, err)
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"expvar"
 	"fmt"
 	"github.com/gin-gonic/gin"
 	"log"
@@ -33,6 +34,10 @@ func main() {
 		v1.GET("/listkeys", HandleListKeys)
 		v1.GET("/stat", HandleStat)
 	}
+	//Prometheus抓取的指标，同样的指标也发布到了expvar
+	db.Metrics().PublishExpvar("lovedb")
+	r.GET("/metrics", gin.WrapH(db.Metrics().Handler()))
+	r.GET("/debug/vars", gin.WrapH(expvar.Handler()))
 	//启动web服务器
 	err := r.Run(":8083")
 	if err != nil {
@@ -83,7 +88,12 @@ func HandleDelete(c *gin.Context) {
 }
 
 func HandleListKeys(c *gin.Context) {
-	keys := db.ListKeys()
+	//请求被取消或者超时时停止遍历
+	keys, err := db.ListKeysCtx(c.Request.Context())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list keys in db"})
+		return
+	}
 	var res []string
 	for _, v := range keys {
 		res = append(res, string(v))
@@ -92,6 +102,10 @@ func HandleListKeys(c *gin.Context) {
 }
 
 func HandleStat(c *gin.Context) {
-	Stat := db.Stat()
-	c.JSON(http.StatusOK, gin.H{"stat": Stat})
+	stat, err := db.Stat()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get stat of db"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"stat": stat})
 }
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	goart "github.com/plar/go-adaptive-radix-tree"
 	"lovedb/data"
+	"sort"
 	"sync"
 )
 
@@ -68,6 +69,41 @@ func (art *AdaptiveRadixTree) Iterator(reverse bool) Iterator {
 	defer art.lock.RUnlock()
 	return NewArtIterator(art.tree, reverse)
 }
+
+// RangeIterator 只复制范围内的key，art树不能直接定位到start，需要从头开始跳过前面的key
+func (art *AdaptiveRadixTree) RangeIterator(start, end []byte, reverse bool) Iterator {
+	var values []*Item
+	art.lock.RLock()
+	art.tree.ForEach(func(node goart.Node) bool {
+		key := node.Key()
+		if end != nil && bytes.Compare(key, end) >= 0 {
+			return false
+		}
+		if inRange(key, start, end) {
+			values = append(values, &Item{key: key, pos: node.Value().(*data.LogRecordPos)})
+		}
+		return true
+	})
+	art.lock.RUnlock()
+	if reverse {
+		reverseItems(values)
+	}
+	return &artIterator{reverse: reverse, values: values}
+}
+
+// Ascend 不复制key按顺序遍历，和RangeIterator一样需要从头开始跳过小于start的key
+func (art *AdaptiveRadixTree) Ascend(start []byte, fn func(key []byte, pos *data.LogRecordPos) bool) {
+	art.lock.RLock()
+	defer art.lock.RUnlock()
+	art.tree.ForEach(func(node goart.Node) bool {
+		key := node.Key()
+		if start != nil && bytes.Compare(key, start) < 0 {
+			return true
+		}
+		return fn(key, node.Value().(*data.LogRecordPos))
+	})
+}
+
 func (art *AdaptiveRadixTree) Close() error {
 	return nil
 }
@@ -123,31 +159,15 @@ func (art *artIterator) Seek(key []byte) {
 	art.binarySearch(key)
 }
 
-// binarySearch
+// binarySearch values是按遍历顺序排好的，正向遍历找到第一个大于等于key的位置，反向遍历找到第一个小于等于key的位置
+// 没有符合条件的key时停在末尾，迭代器无效
 func (art *artIterator) binarySearch(key []byte) {
-	n := len(art.values)
-	l, r := 0, n-1
-	if !art.reverse {
-		for l < r {
-			mid := (l + r) / 2
-			if bytes.Compare(art.values[mid].key, key) >= 0 {
-				r = mid
-			} else {
-				l = mid + 1
-			}
-		}
-	} else {
-		for l < r {
-			mid := (l + r) / 2
-			if bytes.Compare(art.values[mid].key, key) >= 0 {
-				l = mid
-			} else {
-				r = mid - 1
-			}
+	art.currIndex = sort.Search(len(art.values), func(i int) bool {
+		if art.reverse {
+			return bytes.Compare(art.values[i].key, key) <= 0
 		}
-	}
-
-	art.currIndex = l
+		return bytes.Compare(art.values[i].key, key) >= 0
+	})
 }
 
 func (art *artIterator) Next() {
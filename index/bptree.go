@@ -1,15 +1,26 @@
 package index
 
 import (
+	"bytes"
+	"encoding/binary"
+	"errors"
 	"go.etcd.io/bbolt"
 	"lovedb/data"
 	"path/filepath"
 )
 
-const bptreeIndexFileName = "bptree-index"
+// BPTreeIndexFileName b+树索引持久化的文件名
+const BPTreeIndexFileName = "bptree-index"
 
 var indexBucketName = []byte("bitcask-index")
 
+// 保存事务序列号等元数据的bucket
+var metaBucketName = []byte("bitcask-meta")
+
+var seqNoMetaKey = []byte("seq-no")
+
+var ErrInvalidSeqNo = errors.New("invalid seq no in bptree index")
+
 //b+树索引
 //封装了go.etcd.io/bbolt库
 
@@ -21,14 +32,17 @@ type BplusTree struct {
 func NewBplusTree(dirPath string, syncWrites bool) *BplusTree {
 	opts := bbolt.DefaultOptions
 	opts.NoSync = !syncWrites
-	bptree, err := bbolt.Open(filepath.Join(dirPath, bptreeIndexFileName), 0644, opts)
+	bptree, err := bbolt.Open(filepath.Join(dirPath, BPTreeIndexFileName), 0644, opts)
 	if err != nil {
 		panic("failed to open bptree")
 	}
 	//创建对应的bucket
 	//update 是一个读写事务，里面进行对bucket的读写,结束会自动提交事务
 	if err := bptree.Update(func(tx *bbolt.Tx) error {
-		_, err := tx.CreateBucketIfNotExists(indexBucketName)
+		if _, err := tx.CreateBucketIfNotExists(indexBucketName); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucketIfNotExists(metaBucketName)
 		return err
 	}); err != nil {
 		panic("failed to create bucket in bptree")
@@ -100,8 +114,67 @@ func (bp *BplusTree) Size() int {
 }
 
 func (bp *BplusTree) Iterator(reverse bool) Iterator {
-	//TODO implement me
-	panic("implement me")
+	return newBptreeIterator(bp.tree, reverse)
+}
+
+// ApplyBatch 在一个bbolt事务中执行所有操作，只需要一次fsync
+func (bp *BplusTree) ApplyBatch(ops []BatchOp, seqNo uint64) ([]*data.LogRecordPos, error) {
+	oldPositions := make([]*data.LogRecordPos, len(ops))
+	if err := bp.tree.Update(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(indexBucketName)
+		for i, op := range ops {
+			//Get返回的内存只在事务中有效，需要先解码
+			if oldValue := bucket.Get(op.Key); len(oldValue) != 0 {
+				oldPositions[i] = data.DecodeLogRecordPos(oldValue)
+			}
+			var err error
+			if op.Delete {
+				err = bucket.Delete(op.Key)
+			} else {
+				err = bucket.Put(op.Key, data.EncodeLogRecordPos(op.Pos))
+			}
+			if err != nil {
+				return err
+			}
+		}
+		if seqNo == 0 {
+			return nil
+		}
+		return putSeqNo(tx, seqNo)
+	}); err != nil {
+		return nil, err
+	}
+	return oldPositions, nil
+}
+
+// SaveSeqNo 持久化最新的事务序列号
+func (bp *BplusTree) SaveSeqNo(seqNo uint64) error {
+	return bp.tree.Update(func(tx *bbolt.Tx) error {
+		return putSeqNo(tx, seqNo)
+	})
+}
+
+func putSeqNo(tx *bbolt.Tx, seqNo uint64) error {
+	buf := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutUvarint(buf, seqNo)
+	return tx.Bucket(metaBucketName).Put(seqNoMetaKey, buf[:n])
+}
+
+// LoadSeqNo 读取持久化的事务序列号，没有时返回0
+func (bp *BplusTree) LoadSeqNo() (uint64, error) {
+	var seqNo uint64
+	err := bp.tree.View(func(tx *bbolt.Tx) error {
+		value := tx.Bucket(metaBucketName).Get(seqNoMetaKey)
+		if len(value) == 0 {
+			return nil
+		}
+		var n int
+		if seqNo, n = binary.Uvarint(value); n <= 0 {
+			return ErrInvalidSeqNo
+		}
+		return nil
+	})
+	return seqNo, err
 }
 
 func (bp *BplusTree) Close() error {
@@ -146,6 +219,15 @@ func (b *BptreeIterator) Rewind() {
 // Seek 根据传入的 key 查找到第一个大于(或小于)等于的目标 key，根据从这个 key 开始遍历
 func (b *BptreeIterator) Seek(key []byte) {
 	b.curKey, b.curValue = b.cursor.Seek(key)
+	if !b.reverse {
+		return
+	}
+	//cursor只能找到第一个大于等于key的位置，反向遍历需要退回到第一个小于等于key的位置
+	if b.curKey == nil {
+		b.curKey, b.curValue = b.cursor.Last()
+	} else if !bytes.Equal(b.curKey, key) {
+		b.curKey, b.curValue = b.cursor.Prev()
+	}
 }
 
 func (b *BptreeIterator) Next() {
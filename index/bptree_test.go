@@ -1,6 +1,7 @@
 package index
 
 import (
+	"github.com/stretchr/testify/assert"
 	"lovedb/data"
 	"os"
 	"path/filepath"
@@ -11,7 +12,7 @@ func TestBplusTree_Put(t *testing.T) {
 	path := filepath.Join("../tmp")
 	defer func() {
 		//fixme 无法删除掉该文件
-		err := os.RemoveAll(filepath.Join(path, bptreeIndexFileName))
+		err := os.RemoveAll(filepath.Join(path, BPTreeIndexFileName))
 		if err != nil {
 			t.Log(err)
 		}
@@ -31,3 +32,36 @@ func TestBplusTree_Get(t *testing.T) {
 	value := tree.Get([]byte("aaaa"))
 	t.Log(value)
 }
+
+func TestBplusTree_ApplyBatch(t *testing.T) {
+	tree := NewBplusTree(t.TempDir(), false)
+	defer func() {
+		assert.Nil(t, tree.Close())
+	}()
+	tree.Put([]byte("a"), &data.LogRecordPos{Fid: 1, Offset: 10})
+	tree.Put([]byte("b"), &data.LogRecordPos{Fid: 1, Offset: 20})
+
+	oldPositions, err := tree.ApplyBatch([]BatchOp{
+		{Key: []byte("a"), Pos: &data.LogRecordPos{Fid: 2, Offset: 30}},
+		{Key: []byte("b"), Delete: true},
+		{Key: []byte("c"), Pos: &data.LogRecordPos{Fid: 2, Offset: 40}},
+		{Key: []byte("d"), Delete: true},
+	}, 5)
+	assert.Nil(t, err)
+	assert.Equal(t, []*data.LogRecordPos{{Fid: 1, Offset: 10}, {Fid: 1, Offset: 20}, nil, nil}, oldPositions)
+	assert.Equal(t, &data.LogRecordPos{Fid: 2, Offset: 30}, tree.Get([]byte("a")))
+	assert.Nil(t, tree.Get([]byte("b")))
+	assert.Equal(t, &data.LogRecordPos{Fid: 2, Offset: 40}, tree.Get([]byte("c")))
+	assert.Equal(t, 2, tree.Size())
+	seqNo, err := tree.LoadSeqNo()
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(5), seqNo)
+}
+
+func TestBplusTree_Iterator(t *testing.T) {
+	tree := NewBplusTree(t.TempDir(), false)
+	defer func() {
+		assert.Nil(t, tree.Close())
+	}()
+	testIndexerIterator(t, tree)
+}
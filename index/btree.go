@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"github.com/google/btree"
 	"lovedb/data"
+	"sort"
 	"sync"
 )
 
@@ -34,7 +35,10 @@ func (b *Btree) Put(key []byte, pos *data.LogRecordPos) *data.LogRecordPos {
 
 func (b *Btree) Get(key []byte) *data.LogRecordPos {
 	it := &Item{key: key}
+	//写操作会修改树的结构，读也需要加读锁
+	b.lock.RLock()
 	bTreeItem := b.tree.Get(it)
+	b.lock.RUnlock()
 	//读取到为空则返回空
 	if bTreeItem == nil {
 		return nil
@@ -44,6 +48,8 @@ func (b *Btree) Get(key []byte) *data.LogRecordPos {
 }
 
 func (b *Btree) Size() int {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
 	return b.tree.Len()
 }
 
@@ -61,9 +67,50 @@ func (b *Btree) Delete(key []byte) (*data.LogRecordPos, bool) {
 
 // Iterator 初始化迭代器
 func (b *Btree) Iterator(reverse bool) Iterator {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
 	return NewBTreeIterator(b.tree, reverse)
 }
 
+// RangeIterator 只复制范围内的key
+func (b *Btree) RangeIterator(start, end []byte, reverse bool) Iterator {
+	var values []*Item
+	saveValues := func(it btree.Item) bool {
+		item := it.(*Item)
+		if end != nil && bytes.Compare(item.key, end) >= 0 {
+			return false
+		}
+		values = append(values, item)
+		return true
+	}
+	b.lock.RLock()
+	if start == nil {
+		b.tree.Ascend(saveValues)
+	} else {
+		b.tree.AscendGreaterOrEqual(&Item{key: start}, saveValues)
+	}
+	b.lock.RUnlock()
+	if reverse {
+		reverseItems(values)
+	}
+	return &BtreeIterator{reverse: reverse, values: values}
+}
+
+// Ascend 不复制key按顺序遍历
+func (b *Btree) Ascend(start []byte, fn func(key []byte, pos *data.LogRecordPos) bool) {
+	visit := func(it btree.Item) bool {
+		item := it.(*Item)
+		return fn(item.key, item.pos)
+	}
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	if start == nil {
+		b.tree.Ascend(visit)
+	} else {
+		b.tree.AscendGreaterOrEqual(&Item{key: start}, visit)
+	}
+}
+
 func (b *Btree) Close() error {
 	return nil
 }
@@ -114,31 +161,15 @@ func (b *BtreeIterator) Seek(key []byte) {
 	b.binarySearch(key)
 }
 
-// binarySearch
+// binarySearch values是按遍历顺序排好的，正向遍历找到第一个大于等于key的位置，反向遍历找到第一个小于等于key的位置
+// 没有符合条件的key时停在末尾，迭代器无效
 func (b *BtreeIterator) binarySearch(key []byte) {
-	n := len(b.values)
-	l, r := 0, n-1
-	if !b.reverse {
-		for l < r {
-			mid := (l + r) / 2
-			if bytes.Compare(b.values[mid].key, key) >= 0 {
-				r = mid
-			} else {
-				l = mid + 1
-			}
+	b.currIndex = sort.Search(len(b.values), func(i int) bool {
+		if b.reverse {
+			return bytes.Compare(b.values[i].key, key) <= 0
 		}
-	} else {
-		for l < r {
-			mid := (l + r) / 2
-			if bytes.Compare(b.values[mid].key, key) >= 0 {
-				l = mid
-			} else {
-				r = mid - 1
-			}
-		}
-	}
-
-	b.currIndex = l
+		return bytes.Compare(b.values[i].key, key) >= 0
+	})
 }
 
 func (b *BtreeIterator) Next() {
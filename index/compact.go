@@ -0,0 +1,609 @@
+package index
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/google/btree"
+	"lovedb/data"
+	"sort"
+	"sync"
+	"unsafe"
+)
+
+const (
+	// 每个arena块的大小，key都连续存放在arena块中，不会为每个key单独分配内存
+	compactArenaSize = 4 << 20
+
+	// 每个前缀压缩块中key的数量，块的第一个key保存完整的key，后面的key只保存和前一个key不同的部分
+	compactBlockEntries = 32
+
+	// 增量索引中的key数量超过这个值并且超过基础索引的1/8时，合并到基础索引中
+	compactMinDelta = 4096
+)
+
+// packedPos 紧凑的位置信息，固定16个字节，不包含指针，GC不需要扫描
+type packedPos struct {
+	Offset int64
+	Fid    uint32
+	Size   uint32
+}
+
+func packPos(pos *data.LogRecordPos) packedPos {
+	return packedPos{Offset: pos.Offset, Fid: pos.Fid, Size: pos.Size}
+}
+
+func (p packedPos) unpack() *data.LogRecordPos {
+	return &data.LogRecordPos{Fid: p.Fid, Offset: p.Offset, Size: p.Size}
+}
+
+// CompactIndex 内存紧凑的索引，适合key数量非常多的场景
+// 大部分key保存在不可变的基础索引中：key按顺序前缀压缩后存放在大的arena块中，位置信息保存在连续的数组中，
+// 每个key没有单独的指针和对象。新的写入先放在一个小的Btree增量索引中，增量足够大时冻结起来，
+// 在后台和基础索引合并生成新的基础索引，合并期间的写入放在新的增量索引中，合并完成后再替换基础索引
+type CompactIndex struct {
+	base       *compactBase
+	frozen     *btree.BTree //正在后台合并到基础索引中的增量索引，不会再修改，没有合并时为nil
+	delta      *btree.BTree //最近写入的key，删除基础索引或者frozen中的key时记录一个删除标记
+	size       int
+	minDelta   int //增量索引合并的最小阈值
+	lock       *sync.RWMutex
+	compacting sync.WaitGroup //后台合并的协程
+}
+
+// compactItem 增量索引中的一条记录
+type compactItem struct {
+	key     []byte
+	pos     packedPos
+	deleted bool //基础索引中的key已经删除
+}
+
+func (ci *compactItem) Less(b btree.Item) bool {
+	return bytes.Compare(ci.key, b.(*compactItem).key) < 0
+}
+
+// compactBase 不可变的基础索引，生成以后不会再修改，迭代器可以直接引用
+type compactBase struct {
+	arenas    [][]byte
+	blocks    []compactBlock
+	positions []packedPos //第i个key的位置信息
+	count     int
+}
+
+// compactBlock 一个前缀压缩块在arena中的位置
+type compactBlock struct {
+	arena  uint32
+	offset uint32
+	start  uint32 //块中第一个key在positions中的下标
+	n      uint32 //块中key的数量
+}
+
+// NewCompactIndex 初始化内存紧凑的索引
+func NewCompactIndex() *CompactIndex {
+	return &CompactIndex{
+		base:     &compactBase{},
+		delta:    btree.New(32),
+		minDelta: compactMinDelta,
+		lock:     new(sync.RWMutex),
+	}
+}
+
+func (c *CompactIndex) Put(key []byte, pos *data.LogRecordPos) *data.LogRecordPos {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	oldPos := c.get(key)
+	c.delta.ReplaceOrInsert(&compactItem{key: key, pos: packPos(pos)})
+	if oldPos == nil {
+		c.size++
+	}
+	c.maybeCompact()
+	return oldPos
+}
+
+func (c *CompactIndex) Get(key []byte) *data.LogRecordPos {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.get(key)
+}
+
+// 依次查增量索引、正在合并的增量索引和基础索引，调用方需要持有锁
+func (c *CompactIndex) get(key []byte) *data.LogRecordPos {
+	for _, delta := range [2]*btree.BTree{c.delta, c.frozen} {
+		if delta == nil {
+			continue
+		}
+		if item := delta.Get(&compactItem{key: key}); item != nil {
+			ci := item.(*compactItem)
+			if ci.deleted {
+				return nil
+			}
+			return ci.pos.unpack()
+		}
+	}
+	if i, ok := c.base.find(key); ok {
+		return c.base.positions[i].unpack()
+	}
+	return nil
+}
+
+func (c *CompactIndex) Delete(key []byte) (*data.LogRecordPos, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	oldPos := c.get(key)
+	if oldPos == nil {
+		return nil, false
+	}
+	//基础索引或者正在合并的增量索引中存在的key需要留下删除标记，只在增量索引中的key直接删除
+	if c.inFrozenOrBase(key) {
+		c.delta.ReplaceOrInsert(&compactItem{key: key, deleted: true})
+	} else {
+		c.delta.Delete(&compactItem{key: key})
+	}
+	c.size--
+	c.maybeCompact()
+	return oldPos, true
+}
+
+// key是否在正在合并的增量索引或者基础索引中，调用方需要持有锁
+func (c *CompactIndex) inFrozenOrBase(key []byte) bool {
+	if c.frozen != nil && c.frozen.Has(&compactItem{key: key}) {
+		return true
+	}
+	_, ok := c.base.find(key)
+	return ok
+}
+
+func (c *CompactIndex) Size() int {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.size
+}
+
+func (c *CompactIndex) Iterator(reverse bool) Iterator {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	//基础索引不可变，直接引用；增量索引比较小，和正在合并的增量索引一起复制一份快照
+	items := make([]*compactItem, 0, c.delta.Len())
+	c.delta.Ascend(func(item btree.Item) bool {
+		items = append(items, item.(*compactItem))
+		return true
+	})
+	if c.frozen != nil {
+		items = mergeDelta(items, c.frozen)
+	}
+	it := &compactIterator{
+		reverse: reverse,
+		base:    &compactCursor{base: c.base},
+		delta:   items,
+	}
+	it.Rewind()
+	return it
+}
+
+// 按顺序合并两个增量索引，newer中的记录覆盖older中相同的key
+func mergeDelta(newer []*compactItem, older *btree.BTree) []*compactItem {
+	items := make([]*compactItem, 0, len(newer)+older.Len())
+	older.Ascend(func(item btree.Item) bool {
+		ci := item.(*compactItem)
+		for len(newer) > 0 && bytes.Compare(newer[0].key, ci.key) < 0 {
+			items = append(items, newer[0])
+			newer = newer[1:]
+		}
+		if len(newer) > 0 && bytes.Equal(newer[0].key, ci.key) {
+			return true
+		}
+		items = append(items, ci)
+		return true
+	})
+	return append(items, newer...)
+}
+
+// Close 等待后台的合并结束
+func (c *CompactIndex) Close() error {
+	c.compacting.Wait()
+	return nil
+}
+
+// MemoryUsage 索引占用的内存字节数
+func (c *CompactIndex) MemoryUsage() int64 {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	var usage int64
+	for _, arena := range c.base.arenas {
+		usage += int64(cap(arena))
+	}
+	usage += int64(cap(c.base.positions)) * int64(unsafe.Sizeof(packedPos{}))
+	usage += int64(cap(c.base.blocks)) * int64(unsafe.Sizeof(compactBlock{}))
+	//增量索引的每条记录还有对象头、key的切片头和Btree中的接口值
+	for _, delta := range [2]*btree.BTree{c.delta, c.frozen} {
+		if delta == nil {
+			continue
+		}
+		delta.Ascend(func(item btree.Item) bool {
+			usage += int64(len(item.(*compactItem).key)) + int64(unsafe.Sizeof(compactItem{})) + 16
+			return true
+		})
+	}
+	return usage
+}
+
+// 增量索引足够大并且没有正在进行的合并时，冻结增量索引，在后台合并到基础索引中，调用方需要持有写锁
+// 合并在锁外面进行，写入不会因为重建基础索引而停顿
+func (c *CompactIndex) maybeCompact() {
+	limit := c.base.count / 8
+	if limit < c.minDelta {
+		limit = c.minDelta
+	}
+	if c.frozen != nil || c.delta.Len() < limit {
+		return
+	}
+	c.frozen = c.delta
+	c.delta = btree.New(32)
+	base, frozen := c.base, c.frozen
+	c.compacting.Add(1)
+	go func() {
+		defer c.compacting.Done()
+		newBase := compact(base, frozen, base.count+frozen.Len())
+		c.lock.Lock()
+		defer c.lock.Unlock()
+		c.base = newBase
+		c.frozen = nil
+		//合并期间写入的数据可能已经超过阈值了
+		c.maybeCompact()
+	}()
+}
+
+// 把增量索引和基础索引按顺序合并，生成新的基础索引，两者都不会被修改，不需要持有锁
+func compact(base *compactBase, delta *btree.BTree, count int) *compactBase {
+	builder := newCompactBuilder(count)
+	cursor := &compactCursor{base: base}
+	cursor.first()
+	delta.Ascend(func(item btree.Item) bool {
+		ci := item.(*compactItem)
+		for cursor.valid && bytes.Compare(cursor.key(), ci.key) < 0 {
+			builder.add(cursor.key(), cursor.pos())
+			cursor.next()
+		}
+		//增量索引中的记录覆盖基础索引中相同的key
+		if cursor.valid && bytes.Equal(cursor.key(), ci.key) {
+			cursor.next()
+		}
+		if !ci.deleted {
+			builder.add(ci.key, ci.pos)
+		}
+		return true
+	})
+	for ; cursor.valid; cursor.next() {
+		builder.add(cursor.key(), cursor.pos())
+	}
+	return builder.base
+}
+
+// compactBuilder 按顺序添加key，生成基础索引
+type compactBuilder struct {
+	base    *compactBase
+	arena   []byte
+	lastKey []byte
+	buf     [2 * binary.MaxVarintLen32]byte
+}
+
+func newCompactBuilder(count int) *compactBuilder {
+	return &compactBuilder{base: &compactBase{positions: make([]packedPos, 0, count)}}
+}
+
+// 添加一个key，key必须大于之前添加的所有key
+// 块中每条记录的格式：共享前缀长度 | 剩余部分长度 | 剩余部分
+func (b *compactBuilder) add(key []byte, pos packedPos) {
+	base := b.base
+	newBlock := len(base.blocks) == 0 || base.blocks[len(base.blocks)-1].n == compactBlockEntries
+	shared := 0
+	if !newBlock {
+		shared = commonPrefix(b.lastKey, key)
+	}
+	//当前arena放不下时换一个新的arena，块不会跨arena，新块从完整的key开始
+	if len(b.arena)+len(b.buf)+len(key)-shared > cap(b.arena) {
+		size := compactArenaSize
+		if len(b.buf)+len(key) > size {
+			size = len(b.buf) + len(key)
+		}
+		b.arena = make([]byte, 0, size)
+		base.arenas = append(base.arenas, b.arena)
+		newBlock, shared = true, 0
+	}
+	if newBlock {
+		base.blocks = append(base.blocks, compactBlock{
+			arena:  uint32(len(base.arenas) - 1),
+			offset: uint32(len(b.arena)),
+			start:  uint32(base.count),
+		})
+	}
+	n := binary.PutUvarint(b.buf[:], uint64(shared))
+	n += binary.PutUvarint(b.buf[n:], uint64(len(key)-shared))
+	b.arena = append(b.arena, b.buf[:n]...)
+	b.arena = append(b.arena, key[shared:]...)
+	base.arenas[len(base.arenas)-1] = b.arena
+
+	base.blocks[len(base.blocks)-1].n++
+	base.positions = append(base.positions, pos)
+	base.count++
+	b.lastKey = append(b.lastKey[:0], key...)
+}
+
+// 两个key的公共前缀长度
+func commonPrefix(a, b []byte) int {
+	n := len(a)
+	if len(b) < n {
+		n = len(b)
+	}
+	for i := 0; i < n; i++ {
+		if a[i] != b[i] {
+			return i
+		}
+	}
+	return n
+}
+
+// 块中的第一个key，保存的是完整的key，不需要复制
+func (cb *compactBase) firstKey(block int) []byte {
+	blk := cb.blocks[block]
+	buf := cb.arenas[blk.arena][blk.offset:]
+	_, n := binary.Uvarint(buf)
+	length, m := binary.Uvarint(buf[n:])
+	return buf[n+m : n+m+int(length)]
+}
+
+// 最后一个第一个key小于等于key的块，没有时返回-1
+func (cb *compactBase) searchBlock(key []byte) int {
+	return sort.Search(len(cb.blocks), func(i int) bool {
+		return bytes.Compare(cb.firstKey(i), key) > 0
+	}) - 1
+}
+
+// 依次解码块中的key，fn返回false时停止
+func (cb *compactBase) decodeBlock(block int, keyBuf []byte, fn func(i int, key []byte) bool) {
+	blk := cb.blocks[block]
+	buf := cb.arenas[blk.arena][blk.offset:]
+	key := keyBuf[:0]
+	for i := 0; i < int(blk.n); i++ {
+		shared, n := binary.Uvarint(buf)
+		length, m := binary.Uvarint(buf[n:])
+		buf = buf[n+m:]
+		key = append(key[:shared], buf[:length]...)
+		buf = buf[length:]
+		if !fn(int(blk.start)+i, key) {
+			return
+		}
+	}
+}
+
+// 查找key在positions中的下标
+func (cb *compactBase) find(key []byte) (int, bool) {
+	block := cb.searchBlock(key)
+	if block < 0 {
+		return 0, false
+	}
+	var keyBuf [64]byte
+	index, found := 0, false
+	cb.decodeBlock(block, keyBuf[:], func(i int, k []byte) bool {
+		cmp := bytes.Compare(k, key)
+		if cmp == 0 {
+			index, found = i, true
+		}
+		return cmp < 0
+	})
+	return index, found
+}
+
+// compactCursor 在基础索引上双向移动的游标，进入一个块时解码块中所有的key
+type compactCursor struct {
+	base  *compactBase
+	block int
+	keys  [][]byte
+	idx   int
+	valid bool
+}
+
+// 加载块中所有的key，每个key单独分配，调用方可以持有返回的key
+func (cc *compactCursor) load(block int) bool {
+	if block < 0 || block >= len(cc.base.blocks) {
+		cc.valid = false
+		return false
+	}
+	cc.block = block
+	cc.keys = cc.keys[:0]
+	cc.base.decodeBlock(block, nil, func(_ int, key []byte) bool {
+		cc.keys = append(cc.keys, append([]byte(nil), key...))
+		return true
+	})
+	cc.valid = true
+	return true
+}
+
+func (cc *compactCursor) first() {
+	if cc.load(0) {
+		cc.idx = 0
+	}
+}
+
+func (cc *compactCursor) last() {
+	if cc.load(len(cc.base.blocks) - 1) {
+		cc.idx = len(cc.keys) - 1
+	}
+}
+
+func (cc *compactCursor) next() {
+	cc.idx++
+	if cc.idx == len(cc.keys) {
+		cc.load(cc.block + 1)
+		cc.idx = 0
+	}
+}
+
+func (cc *compactCursor) prev() {
+	cc.idx--
+	if cc.idx < 0 && cc.load(cc.block-1) {
+		cc.idx = len(cc.keys) - 1
+	}
+}
+
+// 移动到第一个大于等于key的位置
+func (cc *compactCursor) seekGE(key []byte) {
+	block := cc.base.searchBlock(key)
+	if block < 0 {
+		block = 0
+	}
+	if !cc.load(block) {
+		return
+	}
+	cc.idx = sort.Search(len(cc.keys), func(i int) bool {
+		return bytes.Compare(cc.keys[i], key) >= 0
+	})
+	if cc.idx == len(cc.keys) {
+		cc.load(block + 1)
+		cc.idx = 0
+	}
+}
+
+// 移动到最后一个小于等于key的位置
+func (cc *compactCursor) seekLE(key []byte) {
+	if !cc.load(cc.base.searchBlock(key)) {
+		return
+	}
+	cc.idx = sort.Search(len(cc.keys), func(i int) bool {
+		return bytes.Compare(cc.keys[i], key) > 0
+	}) - 1
+}
+
+func (cc *compactCursor) key() []byte {
+	return cc.keys[cc.idx]
+}
+
+func (cc *compactCursor) pos() packedPos {
+	return cc.base.positions[int(cc.base.blocks[cc.block].start)+cc.idx]
+}
+
+// compactIterator 紧凑索引迭代器，合并基础索引和增量索引的快照，增量索引中的记录覆盖基础索引中相同的key
+type compactIterator struct {
+	reverse bool
+	base    *compactCursor
+	delta   []*compactItem
+	di      int //当前在增量索引快照中的下标，超出范围表示遍历完了
+
+	key      []byte
+	pos      packedPos
+	valid    bool
+	curBase  bool //当前key来自基础索引
+	curDelta bool //当前key来自增量索引
+}
+
+// Rewind 重新回到迭代器的起点
+func (it *compactIterator) Rewind() {
+	if it.reverse {
+		it.base.last()
+		it.di = len(it.delta) - 1
+	} else {
+		it.base.first()
+		it.di = 0
+	}
+	it.settle()
+}
+
+// Seek 正向遍历时找到第一个大于等于key的位置，反向遍历时找到第一个小于等于key的位置
+func (it *compactIterator) Seek(key []byte) {
+	if it.reverse {
+		it.base.seekLE(key)
+		it.di = sort.Search(len(it.delta), func(i int) bool {
+			return bytes.Compare(it.delta[i].key, key) > 0
+		}) - 1
+	} else {
+		it.base.seekGE(key)
+		it.di = sort.Search(len(it.delta), func(i int) bool {
+			return bytes.Compare(it.delta[i].key, key) >= 0
+		})
+	}
+	it.settle()
+}
+
+func (it *compactIterator) Next() {
+	if !it.valid {
+		return
+	}
+	if it.curBase {
+		it.stepBase()
+	}
+	if it.curDelta {
+		it.stepDelta()
+	}
+	it.settle()
+}
+
+func (it *compactIterator) stepBase() {
+	if it.reverse {
+		it.base.prev()
+	} else {
+		it.base.next()
+	}
+}
+
+func (it *compactIterator) stepDelta() {
+	if it.reverse {
+		it.di--
+	} else {
+		it.di++
+	}
+}
+
+// 从两个来源中选出下一个key，跳过增量索引中的删除标记
+func (it *compactIterator) settle() {
+	for {
+		baseValid := it.base.valid
+		deltaValid := it.di >= 0 && it.di < len(it.delta)
+		it.curBase, it.curDelta = false, false
+		switch {
+		case baseValid && deltaValid:
+			cmp := bytes.Compare(it.base.key(), it.delta[it.di].key)
+			if it.reverse {
+				cmp = -cmp
+			}
+			it.curBase = cmp <= 0
+			it.curDelta = cmp >= 0
+		case baseValid:
+			it.curBase = true
+		case deltaValid:
+			it.curDelta = true
+		default:
+			it.valid = false
+			return
+		}
+		if !it.curDelta {
+			it.key, it.pos, it.valid = it.base.key(), it.base.pos(), true
+			return
+		}
+		item := it.delta[it.di]
+		if !item.deleted {
+			it.key, it.pos, it.valid = item.key, item.pos, true
+			return
+		}
+		if it.curBase {
+			it.stepBase()
+		}
+		it.stepDelta()
+	}
+}
+
+func (it *compactIterator) Valid() bool {
+	return it.valid
+}
+
+func (it *compactIterator) Key() []byte {
+	return it.key
+}
+
+func (it *compactIterator) Value() *data.LogRecordPos {
+	return it.pos.unpack()
+}
+
+func (it *compactIterator) Close() {
+	it.delta = nil
+	it.base = &compactCursor{base: &compactBase{}}
+	it.valid = false
+}
@@ -0,0 +1,196 @@
+package index
+
+import (
+	"bytes"
+	"hash/fnv"
+	"lovedb/data"
+	"math/rand"
+	"sort"
+	"sync"
+)
+
+// 哈希索引的分片数量，不同分片的读写互不影响
+const hashIndexShards = 64
+
+// HashIndex 分片的哈希表索引，Put、Get、Delete都是O(1)的，适合只做点查不需要遍历的场景
+// 位置直接保存在map中，不需要为每个key额外分配一个LogRecordPos
+// 哈希表是无序的，迭代器在第一次使用时对所有key排序生成一个快照
+type HashIndex struct {
+	shards [hashIndexShards]*hashShard
+}
+
+type hashShard struct {
+	lock  *sync.RWMutex
+	items map[string]data.LogRecordPos
+}
+
+// NewHashIndex 初始化哈希索引
+func NewHashIndex() *HashIndex {
+	h := &HashIndex{}
+	for i := range h.shards {
+		h.shards[i] = &hashShard{
+			lock:  new(sync.RWMutex),
+			items: make(map[string]data.LogRecordPos),
+		}
+	}
+	return h
+}
+
+// 根据key的哈希值找到对应的分片
+func (h *HashIndex) shard(key []byte) *hashShard {
+	hash := fnv.New32a()
+	_, _ = hash.Write(key)
+	return h.shards[hash.Sum32()%hashIndexShards]
+}
+
+func (h *HashIndex) Put(key []byte, pos *data.LogRecordPos) *data.LogRecordPos {
+	shard := h.shard(key)
+	shard.lock.Lock()
+	defer shard.lock.Unlock()
+	oldPos, ok := shard.items[string(key)]
+	shard.items[string(key)] = *pos
+	if !ok {
+		return nil
+	}
+	return &oldPos
+}
+
+func (h *HashIndex) Get(key []byte) *data.LogRecordPos {
+	shard := h.shard(key)
+	shard.lock.RLock()
+	defer shard.lock.RUnlock()
+	pos, ok := shard.items[string(key)]
+	if !ok {
+		return nil
+	}
+	return &pos
+}
+
+func (h *HashIndex) Delete(key []byte) (*data.LogRecordPos, bool) {
+	shard := h.shard(key)
+	shard.lock.Lock()
+	defer shard.lock.Unlock()
+	oldPos, ok := shard.items[string(key)]
+	if !ok {
+		return nil, false
+	}
+	delete(shard.items, string(key))
+	return &oldPos, true
+}
+
+func (h *HashIndex) Size() int {
+	var size int
+	for _, shard := range h.shards {
+		shard.lock.RLock()
+		size += len(shard.items)
+		shard.lock.RUnlock()
+	}
+	return size
+}
+
+func (h *HashIndex) Iterator(reverse bool) Iterator {
+	return &hashIterator{index: h, reverse: reverse}
+}
+
+// SampleKeys 均匀随机地取出最多n个不重复的key，遍历一遍所有的分片做蓄水池抽样，只保存取出的key
+func (h *HashIndex) SampleKeys(n int, r *rand.Rand) [][]byte {
+	if n <= 0 {
+		return nil
+	}
+	sample := make([][]byte, 0, n)
+	var seen int
+	for _, shard := range h.shards {
+		shard.lock.RLock()
+		for key := range shard.items {
+			seen++
+			//前n个key直接放入，之后第seen个key以n/seen的概率替换其中一个
+			idx := len(sample)
+			if idx == n {
+				if idx = r.Intn(seen); idx >= n {
+					continue
+				}
+			}
+			if idx == len(sample) {
+				sample = append(sample, []byte(key))
+			} else {
+				sample[idx] = []byte(key)
+			}
+		}
+		shard.lock.RUnlock()
+	}
+	return sample
+}
+
+func (h *HashIndex) Close() error {
+	return nil
+}
+
+// hashIterator 哈希索引迭代器，第一次使用时才生成排好序的快照
+type hashIterator struct {
+	index     *HashIndex
+	reverse   bool
+	values    []*Item //排好序的快照，为nil表示还没有生成
+	currIndex int
+}
+
+// 生成所有key排好序的快照，每个分片各自加锁复制
+func (h *hashIterator) snapshot() {
+	if h.values != nil {
+		return
+	}
+	values := make([]*Item, 0, h.index.Size())
+	for _, shard := range h.index.shards {
+		shard.lock.RLock()
+		for key, pos := range shard.items {
+			pos := pos
+			values = append(values, &Item{key: []byte(key), pos: &pos})
+		}
+		shard.lock.RUnlock()
+	}
+	sort.Slice(values, func(i, j int) bool {
+		if h.reverse {
+			return bytes.Compare(values[i].key, values[j].key) > 0
+		}
+		return bytes.Compare(values[i].key, values[j].key) < 0
+	})
+	h.values = values
+}
+
+// Rewind 重新回到迭代器的起点
+func (h *hashIterator) Rewind() {
+	h.snapshot()
+	h.currIndex = 0
+}
+
+// Seek 正向遍历时找到第一个大于等于key的位置，反向遍历时找到第一个小于等于key的位置
+func (h *hashIterator) Seek(key []byte) {
+	h.snapshot()
+	h.currIndex = sort.Search(len(h.values), func(i int) bool {
+		if h.reverse {
+			return bytes.Compare(h.values[i].key, key) <= 0
+		}
+		return bytes.Compare(h.values[i].key, key) >= 0
+	})
+}
+
+func (h *hashIterator) Next() {
+	h.currIndex++
+}
+
+func (h *hashIterator) Valid() bool {
+	h.snapshot()
+	return h.currIndex < len(h.values)
+}
+
+func (h *hashIterator) Key() []byte {
+	return h.values[h.currIndex].key
+}
+
+func (h *hashIterator) Value() *data.LogRecordPos {
+	return h.values[h.currIndex].pos
+}
+
+func (h *hashIterator) Close() {
+	//空的快照，关闭以后不会再重新生成
+	h.values = []*Item{}
+}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"github.com/google/btree"
 	"lovedb/data"
+	"math/rand"
 )
 
 // Indexer 抽象索引接口（内存中），后续若想在内存中实现别的数据结构，直接实现这个接口就可以
@@ -20,6 +21,54 @@ type Indexer interface {
 	// Close 关闭索引
 	Close() error
 }
+
+// SeqNoStore 可以和索引一起持久化事务序列号的索引，目前只有b+树索引
+type SeqNoStore interface {
+	// SaveSeqNo 持久化最新的事务序列号
+	SaveSeqNo(seqNo uint64) error
+
+	// LoadSeqNo 读取持久化的事务序列号，没有时返回0
+	LoadSeqNo() (uint64, error)
+}
+
+// BatchOp 批量更新索引中的一个操作
+type BatchOp struct {
+	Key    []byte
+	Pos    *data.LogRecordPos //删除时为nil
+	Delete bool
+}
+
+// BatchIndexer 可以把一批更新在一个事务中完成的索引，目前只有b+树索引
+type BatchIndexer interface {
+	// ApplyBatch 依次执行所有操作，返回每个操作之前key对应的位置，seqNo不为0时一起持久化事务序列号
+	ApplyBatch(ops []BatchOp, seqNo uint64) ([]*data.LogRecordPos, error)
+}
+
+// RangeIndexer 可以只遍历一个范围的索引，迭代器只保存范围内的key
+type RangeIndexer interface {
+	// RangeIterator 返回遍历[start, end)的迭代器，start或end为nil表示没有对应的边界
+	RangeIterator(start, end []byte, reverse bool) Iterator
+}
+
+// Ascender 迭代器会复制所有key的有序索引（btree、art），可以通过这个接口不复制key按顺序遍历
+type Ascender interface {
+	// Ascend 从第一个大于等于start的key开始按顺序遍历，start为nil时从头开始，fn返回false时停止
+	// 遍历期间持有索引的读锁，fn中不能修改索引，key和pos只在fn中有效
+	Ascend(start []byte, fn func(key []byte, pos *data.LogRecordPos) bool)
+}
+
+// Sampler 无序的索引（哈希索引），不排序、不复制所有的key就能随机取出一部分key
+type Sampler interface {
+	// SampleKeys 均匀随机地取出最多n个不重复的key，返回key的拷贝
+	SampleKeys(n int, r *rand.Rand) [][]byte
+}
+
+// MemoryReporter 可以统计自身内存占用的索引
+type MemoryReporter interface {
+	// MemoryUsage 索引占用的内存字节数
+	MemoryUsage() int64
+}
+
 type IndexerType = int8
 
 const (
@@ -31,6 +80,15 @@ const (
 
 	// BPTree B+树索引类型
 	BPTree
+
+	// SkipList 并发跳表索引，读操作不加锁
+	SkipList
+
+	// Hash 分片哈希表索引，只适合点查，遍历时需要先排序
+	Hash
+
+	// Compact 内存紧凑的索引，key前缀压缩后存放在arena中，适合key数量非常多的场景
+	Compact
 )
 
 // NewIndexer 根据用户传递的不同类型而实例化不同的内存数据结构,dirpath代表b+树存储的硬盘位置
@@ -42,11 +100,29 @@ func NewIndexer(typ IndexerType, dirPath string, sync bool) Indexer {
 		return NewART()
 	case BPTree:
 		return NewBplusTree(dirPath, sync)
+	case SkipList:
+		return NewSkiplist()
+	case Hash:
+		return NewHashIndex()
+	case Compact:
+		return NewCompactIndex()
 	default:
 		panic("unsupported index type")
 	}
 }
 
+// 判断key是否在[start, end)范围内
+func inRange(key, start, end []byte) bool {
+	return (start == nil || bytes.Compare(key, start) >= 0) && (end == nil || bytes.Compare(key, end) < 0)
+}
+
+// 把按顺序保存的快照反转成倒序
+func reverseItems(values []*Item) {
+	for l, r := 0, len(values)-1; l < r; l, r = l+1, r-1 {
+		values[l], values[r] = values[r], values[l]
+	}
+}
+
 // Item 1.需要实现Btree中Item的方法less,才能作为接口传入方法中
 // Item是树的每一个节点，只包含一个键值对
 type Item struct {
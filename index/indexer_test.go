@@ -0,0 +1,398 @@
+package index
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"lovedb/data"
+	"math/rand"
+	"sort"
+	"sync"
+	"testing"
+)
+
+// 内存索引的通用测试，每种索引都需要通过
+var memIndexers = []struct {
+	name string
+	new  func() Indexer
+}{
+	{"BTree", func() Indexer { return NewBtree() }},
+	{"ART", func() Indexer { return NewART() }},
+	{"SkipList", func() Indexer { return NewSkiplist() }},
+	{"Hash", func() Indexer { return NewHashIndex() }},
+	{"Compact", func() Indexer { return NewCompactIndex() }},
+}
+
+func indexKey(i int) []byte {
+	return []byte(fmt.Sprintf("index-key-%09d", i))
+}
+
+func TestIndexer(t *testing.T) {
+	for _, tt := range memIndexers {
+		t.Run(tt.name, func(t *testing.T) {
+			idx := tt.new()
+			assert.Nil(t, idx.Get([]byte("a")))
+			_, ok := idx.Delete([]byte("a"))
+			assert.False(t, ok)
+
+			assert.Nil(t, idx.Put([]byte("a"), &data.LogRecordPos{Fid: 1, Offset: 10}))
+			assert.Nil(t, idx.Put([]byte("c"), &data.LogRecordPos{Fid: 1, Offset: 20}))
+			assert.Nil(t, idx.Put([]byte("b"), &data.LogRecordPos{Fid: 1, Offset: 30}))
+			oldPos := idx.Put([]byte("a"), &data.LogRecordPos{Fid: 2, Offset: 40})
+			assert.Equal(t, &data.LogRecordPos{Fid: 1, Offset: 10}, oldPos)
+			assert.Equal(t, &data.LogRecordPos{Fid: 2, Offset: 40}, idx.Get([]byte("a")))
+			assert.Equal(t, 3, idx.Size())
+
+			oldPos, ok = idx.Delete([]byte("c"))
+			assert.True(t, ok)
+			assert.Equal(t, &data.LogRecordPos{Fid: 1, Offset: 20}, oldPos)
+			assert.Nil(t, idx.Get([]byte("c")))
+			assert.Equal(t, 2, idx.Size())
+			assert.Nil(t, idx.Close())
+		})
+	}
+}
+
+func TestIndexer_Iterator(t *testing.T) {
+	for _, tt := range memIndexers {
+		t.Run(tt.name, func(t *testing.T) {
+			testIndexerIterator(t, tt.new())
+		})
+	}
+}
+
+// 迭代器的通用测试，b+树索引也需要通过
+func testIndexerIterator(t *testing.T, idx Indexer) {
+	it := idx.Iterator(false)
+	assert.False(t, it.Valid())
+	it.Close()
+
+	var keys []string
+	for _, i := range rand.Perm(100) {
+		idx.Put(indexKey(i*2), &data.LogRecordPos{Fid: 1, Offset: int64(i)})
+		keys = append(keys, string(indexKey(i*2)))
+	}
+	sort.Strings(keys)
+
+	it = idx.Iterator(false)
+	var got []string
+	for it.Rewind(); it.Valid(); it.Next() {
+		got = append(got, string(it.Key()))
+		assert.NotNil(t, it.Value())
+	}
+	assert.Equal(t, keys, got)
+	it.Seek(indexKey(50))
+	assert.Equal(t, indexKey(50), it.Key())
+	it.Seek(indexKey(51))
+	assert.Equal(t, indexKey(52), it.Key())
+	it.Seek(indexKey(-1))
+	assert.Equal(t, indexKey(0), it.Key())
+	it.Seek(indexKey(199))
+	assert.False(t, it.Valid())
+	it.Close()
+
+	it = idx.Iterator(true)
+	got = got[:0]
+	for it.Rewind(); it.Valid(); it.Next() {
+		got = append(got, string(it.Key()))
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(keys)))
+	assert.Equal(t, keys, got)
+	//反向遍历，seek找到第一个小于等于key的位置
+	it.Seek(indexKey(50))
+	assert.Equal(t, indexKey(50), it.Key())
+	it.Seek(indexKey(51))
+	assert.Equal(t, indexKey(50), it.Key())
+	it.Next()
+	assert.Equal(t, indexKey(48), it.Key())
+	it.Seek(indexKey(1000))
+	assert.Equal(t, indexKey(198), it.Key())
+	it.Seek(indexKey(-1))
+	assert.False(t, it.Valid())
+	it.Close()
+}
+
+func TestRangeIndexer(t *testing.T) {
+	for _, idx := range []Indexer{NewBtree(), NewART()} {
+		for i := 0; i < 100; i++ {
+			idx.Put(indexKey(i), &data.LogRecordPos{Fid: 1, Offset: int64(i)})
+		}
+		rangeIndexer := idx.(RangeIndexer)
+		it := rangeIndexer.RangeIterator(indexKey(10), indexKey(20), false)
+		var got [][]byte
+		for it.Rewind(); it.Valid(); it.Next() {
+			got = append(got, it.Key())
+		}
+		assert.Equal(t, 10, len(got))
+		assert.Equal(t, indexKey(10), got[0])
+		assert.Equal(t, indexKey(19), got[9])
+
+		it = rangeIndexer.RangeIterator(nil, indexKey(20), true)
+		it.Seek(indexKey(50))
+		assert.Equal(t, indexKey(19), it.Key())
+		it = rangeIndexer.RangeIterator(indexKey(90), nil, false)
+		it.Seek(indexKey(95))
+		assert.Equal(t, indexKey(95), it.Key())
+	}
+}
+
+func TestAscender(t *testing.T) {
+	for _, idx := range []Indexer{NewBtree(), NewART()} {
+		for i := 0; i < 100; i++ {
+			idx.Put(indexKey(i), &data.LogRecordPos{Fid: 1, Offset: int64(i)})
+		}
+		ascender := idx.(Ascender)
+		var got []int64
+		ascender.Ascend(indexKey(10), func(key []byte, pos *data.LogRecordPos) bool {
+			got = append(got, pos.Offset)
+			return len(got) < 5
+		})
+		assert.Equal(t, []int64{10, 11, 12, 13, 14}, got)
+
+		var count int
+		ascender.Ascend(nil, func(key []byte, pos *data.LogRecordPos) bool {
+			count++
+			return true
+		})
+		assert.Equal(t, 100, count)
+	}
+}
+
+func TestHashIndex_SampleKeys(t *testing.T) {
+	h := NewHashIndex()
+	r := rand.New(rand.NewSource(1))
+	assert.Equal(t, 0, len(h.SampleKeys(10, r)))
+	for i := 0; i < 1000; i++ {
+		h.Put(indexKey(i), &data.LogRecordPos{Fid: 1, Offset: int64(i)})
+	}
+	sample := h.SampleKeys(100, r)
+	assert.Equal(t, 100, len(sample))
+	seen := make(map[string]bool)
+	for _, key := range sample {
+		assert.NotNil(t, h.Get(key))
+		assert.False(t, seen[string(key)])
+		seen[string(key)] = true
+	}
+	//key的数量不超过n时返回所有的key
+	assert.Equal(t, 1000, len(h.SampleKeys(2000, r)))
+}
+
+func TestSkiplist_Iterator(t *testing.T) {
+	sl := NewSkiplist()
+	for i := 0; i < 10; i++ {
+		sl.Put(indexKey(i*2), &data.LogRecordPos{Fid: 1, Offset: int64(i)})
+	}
+	it := sl.Iterator(false)
+	it.Seek(indexKey(19))
+	assert.False(t, it.Valid())
+	it.Seek(indexKey(-1))
+	assert.Equal(t, indexKey(0), it.Key())
+
+	//反向遍历，seek找到第一个小于等于key的位置
+	it = sl.Iterator(true)
+	var got [][]byte
+	for it.Rewind(); it.Valid(); it.Next() {
+		got = append(got, it.Key())
+	}
+	assert.Equal(t, 10, len(got))
+	assert.Equal(t, indexKey(18), got[0])
+	assert.Equal(t, indexKey(0), got[9])
+	it.Seek(indexKey(5))
+	assert.Equal(t, indexKey(4), it.Key())
+	it.Next()
+	assert.Equal(t, indexKey(2), it.Key())
+	it.Seek(indexKey(100))
+	assert.Equal(t, indexKey(18), it.Key())
+	it.Seek([]byte("a"))
+	assert.False(t, it.Valid())
+
+	//遍历时删除的节点会被跳过
+	it = sl.Iterator(false)
+	sl.Delete(indexKey(0))
+	sl.Delete(indexKey(2))
+	it.Next()
+	assert.Equal(t, indexKey(4), it.Key())
+}
+
+func TestHashIndex_Iterator(t *testing.T) {
+	h := NewHashIndex()
+	for i := 0; i < 10; i++ {
+		h.Put(indexKey(i*2), &data.LogRecordPos{Fid: 1, Offset: int64(i)})
+	}
+	it := h.Iterator(false)
+	it.Seek(indexKey(19))
+	assert.False(t, it.Valid())
+	//快照生成以后的写入看不到
+	h.Put(indexKey(100), &data.LogRecordPos{Fid: 1, Offset: 100})
+	it.Seek(indexKey(3))
+	assert.Equal(t, indexKey(4), it.Key())
+	it.Seek(indexKey(99))
+	assert.False(t, it.Valid())
+	it.Close()
+	assert.False(t, it.Valid())
+
+	it = h.Iterator(true)
+	it.Seek(indexKey(5))
+	assert.Equal(t, indexKey(4), it.Key())
+	it.Next()
+	assert.Equal(t, indexKey(2), it.Key())
+	it.Seek([]byte("a"))
+	assert.False(t, it.Valid())
+	it.Rewind()
+	assert.Equal(t, indexKey(100), it.Key())
+}
+
+func TestCompactIndex(t *testing.T) {
+	c := NewCompactIndex()
+	//阈值调小，让增量索引频繁合并到基础索引中
+	c.minDelta = 16
+	expected := make(map[string]*data.LogRecordPos)
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 5000; i++ {
+		//合并在后台进行，时不时等待合并结束，让增量索引多次合并到基础索引中
+		if i%100 == 99 {
+			c.compacting.Wait()
+		}
+		key := indexKey(r.Intn(2000))
+		if r.Intn(4) == 0 {
+			oldPos, ok := c.Delete(key)
+			assert.Equal(t, expected[string(key)] != nil, ok)
+			assert.Equal(t, expected[string(key)], oldPos)
+			delete(expected, string(key))
+			continue
+		}
+		pos := &data.LogRecordPos{Fid: uint32(i), Offset: int64(i) << 33, Size: uint32(i)}
+		assert.Equal(t, expected[string(key)], c.Put(key, pos))
+		expected[string(key)] = pos
+	}
+	c.compacting.Wait()
+	assert.True(t, c.base.count > 0)
+	assert.True(t, c.delta.Len() > 0)
+	assert.Equal(t, len(expected), c.Size())
+
+	keys := make([]string, 0, len(expected))
+	for key, pos := range expected {
+		keys = append(keys, key)
+		assert.Equal(t, pos, c.Get([]byte(key)))
+	}
+	sort.Strings(keys)
+
+	//迭代器合并基础索引和增量索引
+	it := c.Iterator(false)
+	var i int
+	for it.Rewind(); it.Valid(); it.Next() {
+		assert.Equal(t, keys[i], string(it.Key()))
+		assert.Equal(t, expected[keys[i]], it.Value())
+		i++
+	}
+	assert.Equal(t, len(keys), i)
+	it = c.Iterator(true)
+	for it.Rewind(); it.Valid(); it.Next() {
+		i--
+		assert.Equal(t, keys[i], string(it.Key()))
+	}
+	assert.Equal(t, 0, i)
+
+	//Seek不存在的key
+	for _, n := range []int{-1, 7, 999, 1999, 2000} {
+		target := indexKey(n)
+		first := sort.SearchStrings(keys, string(target))
+		it = c.Iterator(false)
+		it.Seek(target)
+		if first < len(keys) {
+			assert.Equal(t, keys[first], string(it.Key()))
+		} else {
+			assert.False(t, it.Valid())
+		}
+		last := first - 1
+		if first < len(keys) && keys[first] == string(target) {
+			last = first
+		}
+		it = c.Iterator(true)
+		it.Seek(target)
+		if last >= 0 {
+			assert.Equal(t, keys[last], string(it.Key()))
+		} else {
+			assert.False(t, it.Valid())
+		}
+	}
+	assert.True(t, c.MemoryUsage() > 0)
+}
+
+func TestSkiplist_Concurrent(t *testing.T) {
+	sl := NewSkiplist()
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := w; i < 4000; i += 4 {
+				sl.Put(indexKey(i), &data.LogRecordPos{Fid: 1, Offset: int64(i)})
+				if i%3 == 0 {
+					sl.Delete(indexKey(i))
+				}
+			}
+		}(w)
+	}
+	//读操作和迭代器不加锁，与写操作并发执行
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 4000; i++ {
+				if pos := sl.Get(indexKey(i)); pos != nil {
+					assert.Equal(t, int64(i), pos.Offset)
+				}
+			}
+			it := sl.Iterator(false)
+			var prev []byte
+			for it.Rewind(); it.Valid(); it.Next() {
+				assert.True(t, prev == nil || string(prev) < string(it.Key()))
+				prev = it.Key()
+			}
+		}()
+	}
+	wg.Wait()
+
+	expected := 0
+	for i := 0; i < 4000; i++ {
+		if i%3 != 0 {
+			expected++
+			assert.NotNil(t, sl.Get(indexKey(i)))
+		} else {
+			assert.Nil(t, sl.Get(indexKey(i)))
+		}
+	}
+	assert.Equal(t, expected, sl.Size())
+}
+
+func BenchmarkIndexer_Put(b *testing.B) {
+	for _, tt := range memIndexers {
+		b.Run(tt.name, func(b *testing.B) {
+			idx := tt.new()
+			pos := &data.LogRecordPos{Fid: 1, Offset: 100}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				idx.Put(indexKey(rand.Intn(1000000)), pos)
+			}
+		})
+	}
+}
+
+func BenchmarkIndexer_Get(b *testing.B) {
+	for _, tt := range memIndexers {
+		b.Run(tt.name, func(b *testing.B) {
+			idx := tt.new()
+			pos := &data.LogRecordPos{Fid: 1, Offset: 100}
+			for i := 0; i < 100000; i++ {
+				idx.Put(indexKey(i), pos)
+			}
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				r := rand.New(rand.NewSource(rand.Int63()))
+				for pb.Next() {
+					idx.Get(indexKey(r.Intn(100000)))
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,252 @@
+package index
+
+import (
+	"bytes"
+	"lovedb/data"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 跳表的最大层数，每一层的节点数约为下一层的1/4，足够容纳上亿个key
+const (
+	skiplistMaxLevel = 16
+	skiplistBranch   = 4
+)
+
+// Skiplist 并发跳表索引
+// 写操作之间用互斥锁串行，读操作和迭代器不加锁：节点之间的指针都是原子读写的，
+// 新节点从最底层开始向上链接，读操作总能看到一个完整的链表
+type Skiplist struct {
+	head  *skiplistNode
+	level atomic.Int32 //当前的层数
+	size  atomic.Int64
+	lock  *sync.Mutex //写操作之间互斥
+	rand  *rand.Rand  //生成新节点的层数，只在持有锁时使用
+}
+
+type skiplistNode struct {
+	key     []byte
+	pos     atomic.Pointer[data.LogRecordPos]
+	deleted atomic.Bool //已经从跳表中删除，正在遍历的读操作可能还会访问到
+	next    []atomic.Pointer[skiplistNode]
+}
+
+// NewSkiplist 初始化跳表索引
+func NewSkiplist() *Skiplist {
+	s := &Skiplist{
+		head: &skiplistNode{next: make([]atomic.Pointer[skiplistNode], skiplistMaxLevel)},
+		lock: new(sync.Mutex),
+		rand: rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+	s.level.Store(1)
+	return s
+}
+
+func (s *Skiplist) Put(key []byte, pos *data.LogRecordPos) *data.LogRecordPos {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	var preds [skiplistMaxLevel]*skiplistNode
+	node := s.findGreaterOrEqual(key, preds[:])
+	//key已经存在，直接替换位置
+	if node != nil && bytes.Equal(node.key, key) {
+		return node.pos.Swap(pos)
+	}
+
+	level := s.randomLevel()
+	if curLevel := int(s.level.Load()); level > curLevel {
+		for i := curLevel; i < level; i++ {
+			preds[i] = s.head
+		}
+		s.level.Store(int32(level))
+	}
+	node = &skiplistNode{key: key, next: make([]atomic.Pointer[skiplistNode], level)}
+	node.pos.Store(pos)
+	//从最底层开始链接，读操作在上层找不到新节点时会在下层找到
+	for i := 0; i < level; i++ {
+		node.next[i].Store(preds[i].next[i].Load())
+		preds[i].next[i].Store(node)
+	}
+	s.size.Add(1)
+	return nil
+}
+
+func (s *Skiplist) Get(key []byte) *data.LogRecordPos {
+	node := s.findGreaterOrEqual(key, nil)
+	if node == nil || node.deleted.Load() || !bytes.Equal(node.key, key) {
+		return nil
+	}
+	return node.pos.Load()
+}
+
+func (s *Skiplist) Delete(key []byte) (*data.LogRecordPos, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	var preds [skiplistMaxLevel]*skiplistNode
+	node := s.findGreaterOrEqual(key, preds[:])
+	if node == nil || !bytes.Equal(node.key, key) {
+		return nil, false
+	}
+	node.deleted.Store(true)
+	//从最上层开始摘除，被删除节点自己的指针不变，正在遍历它的读操作可以继续往后走
+	for i := len(node.next) - 1; i >= 0; i-- {
+		preds[i].next[i].Store(node.next[i].Load())
+	}
+	s.size.Add(-1)
+	return node.pos.Load(), true
+}
+
+func (s *Skiplist) Size() int {
+	return int(s.size.Load())
+}
+
+func (s *Skiplist) Iterator(reverse bool) Iterator {
+	it := &skiplistIterator{list: s, reverse: reverse}
+	it.Rewind()
+	return it
+}
+
+func (s *Skiplist) Close() error {
+	return nil
+}
+
+// 随机生成新节点的层数
+func (s *Skiplist) randomLevel() int {
+	level := 1
+	for level < skiplistMaxLevel && s.rand.Intn(skiplistBranch) == 0 {
+		level++
+	}
+	return level
+}
+
+// 查找第一个大于等于key的节点，preds不为nil时记录每一层最后一个小于key的节点
+func (s *Skiplist) findGreaterOrEqual(key []byte, preds []*skiplistNode) *skiplistNode {
+	x := s.head
+	level := int(s.level.Load()) - 1
+	for {
+		next := x.next[level].Load()
+		if next != nil && bytes.Compare(next.key, key) < 0 {
+			x = next
+			continue
+		}
+		if preds != nil {
+			preds[level] = x
+		}
+		if level == 0 {
+			return next
+		}
+		level--
+	}
+}
+
+// 查找最后一个小于key的节点，没有时返回nil
+func (s *Skiplist) findLessThan(key []byte) *skiplistNode {
+	x := s.head
+	level := int(s.level.Load()) - 1
+	for {
+		next := x.next[level].Load()
+		if next != nil && bytes.Compare(next.key, key) < 0 {
+			x = next
+			continue
+		}
+		if level == 0 {
+			break
+		}
+		level--
+	}
+	if x == s.head {
+		return nil
+	}
+	return x
+}
+
+// 查找最后一个节点，没有时返回nil
+func (s *Skiplist) findLast() *skiplistNode {
+	x := s.head
+	level := int(s.level.Load()) - 1
+	for {
+		next := x.next[level].Load()
+		if next != nil {
+			x = next
+			continue
+		}
+		if level == 0 {
+			break
+		}
+		level--
+	}
+	if x == s.head {
+		return nil
+	}
+	return x
+}
+
+// skiplistIterator 跳表索引迭代器
+// 不是快照，遍历时可以看到并发写入的数据，已经删除的节点会被跳过
+type skiplistIterator struct {
+	list    *Skiplist
+	reverse bool
+	node    *skiplistNode //当前遍历到的节点，为nil表示遍历结束
+}
+
+// Rewind 重新回到迭代器的起点
+func (it *skiplistIterator) Rewind() {
+	if it.reverse {
+		it.node = it.list.findLast()
+	} else {
+		it.node = it.list.head.next[0].Load()
+	}
+	it.skipDeleted()
+}
+
+// Seek 正向遍历时找到第一个大于等于key的节点，反向遍历时找到第一个小于等于key的节点
+func (it *skiplistIterator) Seek(key []byte) {
+	node := it.list.findGreaterOrEqual(key, nil)
+	if it.reverse && (node == nil || !bytes.Equal(node.key, key)) {
+		node = it.list.findLessThan(key)
+	}
+	it.node = node
+	it.skipDeleted()
+}
+
+func (it *skiplistIterator) Next() {
+	if it.node == nil {
+		return
+	}
+	if it.reverse {
+		it.node = it.list.findLessThan(it.node.key)
+	} else {
+		it.node = it.node.next[0].Load()
+	}
+	it.skipDeleted()
+}
+
+// 跳过已经删除的节点
+func (it *skiplistIterator) skipDeleted() {
+	for it.node != nil && it.node.deleted.Load() {
+		if it.reverse {
+			it.node = it.list.findLessThan(it.node.key)
+		} else {
+			it.node = it.node.next[0].Load()
+		}
+	}
+}
+
+func (it *skiplistIterator) Valid() bool {
+	return it.node != nil
+}
+
+func (it *skiplistIterator) Key() []byte {
+	return it.node.key
+}
+
+func (it *skiplistIterator) Value() *data.LogRecordPos {
+	return it.node.pos.Load()
+}
+
+func (it *skiplistIterator) Close() {
+	it.node = nil
+}
@@ -2,45 +2,134 @@ package lovedb
 
 import (
 	"bytes"
+	"context"
 	"lovedb/index"
 )
 
+// continuation token的格式：版本 | 遍历方向 | 下一个key
+const continuationVersion byte = 1
+
 // Iterator 面向用户的迭代器
 type Iterator struct {
 	indexIter index.Iterator //索引迭代器
 	db        *DB
 	options   IteratorOptions
+	lower     []byte //合并了前缀以后的下界，包含
+	upper     []byte //合并了前缀以后的上界，不包含，为nil表示没有上界
+	inRange   bool   //索引迭代器当前的key是否在范围内
+	count     int    //从Rewind或Seek开始已经遍历过的key的数量
+	ctx       context.Context
+	err       error
 }
 
-// NewIterator 初始化迭代器
+// NewIterator 初始化迭代器，初始化以后已经位于起点
 func (db *DB) NewIterator(opts IteratorOptions) *Iterator {
-	indexIter := db.index.Iterator(opts.Reverse)
-	return &Iterator{
-		db:        db,
-		indexIter: indexIter,
-		options:   opts,
+	return db.NewIteratorCtx(context.Background(), opts)
+}
+
+// NewIteratorCtx 和NewIterator一样，每次移动位置时检查ctx，取消以后迭代器无效，Err返回ctx.Err()
+func (db *DB) NewIteratorCtx(ctx context.Context, opts IteratorOptions) *Iterator {
+	db.ops.iterators.Add(1)
+	i := &Iterator{
+		ctx:     ctx,
+		db:      db,
+		options: opts,
+		lower:   opts.LowerBound,
+		upper:   opts.UpperBound,
+	}
+	//前缀转换成上下界，遍历到范围之外就可以直接结束
+	if len(opts.Prefix) > 0 {
+		if i.lower == nil || bytes.Compare(opts.Prefix, i.lower) > 0 {
+			i.lower = opts.Prefix
+		}
+		if end := prefixEnd(opts.Prefix); end != nil && (i.upper == nil || bytes.Compare(end, i.upper) < 0) {
+			i.upper = end
+		}
+	}
+	i.indexIter = i.newIndexIterator()
+	i.Rewind()
+	return i
+}
+
+// 索引支持范围遍历时只取出范围内的key，有continuation token时只取出token之后的key，
+// 分页遍历时每一页不需要复制整个索引
+func (i *Iterator) newIndexIterator() index.Iterator {
+	rangeIndexer, ok := i.db.index.(index.RangeIndexer)
+	if !ok {
+		return i.db.index.Iterator(i.options.Reverse)
+	}
+	start, end := i.lower, i.upper
+	if len(i.options.Continuation) > 0 {
+		//token无效时在Rewind中返回错误
+		if key, err := decodeContinuation(i.options.Continuation, i.options.Reverse); err == nil {
+			if !i.options.Reverse && (start == nil || bytes.Compare(key, start) > 0) {
+				start = key
+			}
+			//反向遍历从小于等于key的位置开始，key本身也在范围内
+			if keyEnd := append(append([]byte{}, key...), 0); i.options.Reverse && (end == nil || bytes.Compare(keyEnd, end) < 0) {
+				end = keyEnd
+			}
+		}
 	}
+	return rangeIndexer.RangeIterator(start, end, i.options.Reverse)
 }
 
+// Rewind 回到起点，设置了continuation token时从token记录的位置开始
 func (i *Iterator) Rewind() {
-	i.indexIter.Rewind()
+	if len(i.options.Continuation) > 0 {
+		key, err := decodeContinuation(i.options.Continuation, i.options.Reverse)
+		if err != nil {
+			i.err = err
+			return
+		}
+		i.Seek(key)
+		return
+	}
+	i.count = 0
+	switch {
+	case !i.options.Reverse && i.lower != nil:
+		i.indexIter.Seek(i.lower)
+	case i.options.Reverse && i.upper != nil:
+		i.indexIter.Seek(i.upper)
+	default:
+		i.indexIter.Rewind()
+	}
 	i.skipToNext()
 }
 
+// Seek 正向遍历时找到第一个大于等于key的位置，反向遍历时找到第一个小于等于key的位置，不会超出上下界
 func (i *Iterator) Seek(key []byte) {
+	i.count = 0
+	if !i.options.Reverse && i.lower != nil && bytes.Compare(key, i.lower) < 0 {
+		key = i.lower
+	}
+	if i.options.Reverse && i.upper != nil && bytes.Compare(key, i.upper) > 0 {
+		key = i.upper
+	}
 	i.indexIter.Seek(key)
 	i.skipToNext()
 }
 
 func (i *Iterator) Next() {
-	//k1 k2 j3 k4
+	if !i.Valid() {
+		return
+	}
+	i.count++
 	i.indexIter.Next()
-	//next完了发现是j3，不符合前缀，就再跳一下，符合了直接return
 	i.skipToNext()
 }
 
+// Valid 当前位置是否有效，超出范围、达到Limit或者出错时无效
 func (i *Iterator) Valid() bool {
-	return i.indexIter.Valid()
+	if i.err != nil || !i.inRange {
+		return false
+	}
+	return i.options.Limit <= 0 || i.count < i.options.Limit
+}
+
+// Err 返回迭代器遇到的错误：continuation token无效，或者ctx已经取消
+func (i *Iterator) Err() error {
+	return i.err
 }
 
 func (i *Iterator) Key() []byte {
@@ -49,30 +138,79 @@ func (i *Iterator) Key() []byte {
 
 // Value 用户需要拿到的是整体的value而不是索引pos
 func (i *Iterator) Value() ([]byte, error) {
+	//只遍历key的迭代器不会读取数据文件
+	if i.options.KeysOnly {
+		return nil, ErrIteratorKeysOnly
+	}
 	logRecordPos := i.indexIter.Value()
 	i.db.mu.Lock()
 	defer i.db.mu.Unlock()
 	return i.db.getValueByPos(logRecordPos)
 }
 
+// Continuation 返回从当前位置继续遍历的token，下一次用IteratorOptions.Continuation创建迭代器可以接着遍历
+// 达到Limit时当前位置是下一页的第一个key，已经遍历完所有的key时返回nil
+func (i *Iterator) Continuation() []byte {
+	if i.err != nil || !i.inRange {
+		return nil
+	}
+	key := i.indexIter.Key()
+	token := make([]byte, 2+len(key))
+	token[0] = continuationVersion
+	if i.options.Reverse {
+		token[1] = 1
+	}
+	copy(token[2:], key)
+	return token
+}
+
 func (i *Iterator) Close() {
 	i.indexIter.Close()
 }
 
-// 筛选用户提供的prefix条件
+// 跳过范围之前的key，遇到范围之后的key时结束遍历，每跳过一个key都检查ctx
 func (i *Iterator) skipToNext() {
-	preFixLen := len(i.options.Prefix)
-	//如果prefix为空，无需处理
-	if preFixLen == 0 {
+	for ; i.indexIter.Valid(); i.indexIter.Next() {
+		select {
+		case <-i.ctx.Done():
+			i.err = i.ctx.Err()
+			return
+		default:
+		}
+		key := i.indexIter.Key()
+		if i.options.Reverse {
+			//上界不包含在范围内
+			if i.upper != nil && bytes.Compare(key, i.upper) >= 0 {
+				continue
+			}
+			i.inRange = i.lower == nil || bytes.Compare(key, i.lower) >= 0
+		} else {
+			if i.lower != nil && bytes.Compare(key, i.lower) < 0 {
+				continue
+			}
+			i.inRange = i.upper == nil || bytes.Compare(key, i.upper) < 0
+		}
 		return
 	}
+	i.inRange = false
+}
 
-	//执行完函数以后发现是j3，不符合前缀，就再跳一下，符合了直接return，说白了就是让迭代器跳几格
-	for ; i.indexIter.Valid(); i.indexIter.Next() {
-		key := i.indexIter.Key()
-		//
-		if preFixLen <= len(key) && bytes.Compare(i.options.Prefix, key[:preFixLen]) == 0 {
-			return
+// 解析continuation token，遍历方向必须和创建token时一致
+func decodeContinuation(token []byte, reverse bool) ([]byte, error) {
+	if len(token) < 2 || token[0] != continuationVersion || token[1] > 1 || (token[1] == 1) != reverse {
+		return nil, ErrInvalidContinuation
+	}
+	return token[2:], nil
+}
+
+// 大于所有以prefix为前缀的key的最小的key，prefix全部是0xff时没有上界，返回nil
+func prefixEnd(prefix []byte) []byte {
+	end := append([]byte{}, prefix...)
+	for n := len(end) - 1; n >= 0; n-- {
+		if end[n] < 0xff {
+			end[n]++
+			return end[:n+1]
 		}
 	}
+	return nil
 }
@@ -1 +1,150 @@
 package lovedb
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"lovedb/index"
+	"path/filepath"
+	"testing"
+)
+
+func TestIterator_HashIndex(t *testing.T) {
+	t.Parallel()
+	db, opts := openInMemoryDB(t)
+	assert.Nil(t, db.Close())
+	opts.IndexType = index.Hash
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, db.Put([]byte(fmt.Sprintf("a-%03d", i)), testValue(i)))
+		assert.Nil(t, db.Put([]byte(fmt.Sprintf("b-%03d", i)), testValue(i)))
+	}
+
+	//前缀遍历的结果是有序的
+	it := db.NewIterator(IteratorOptions{Prefix: []byte("b-")})
+	var keys []string
+	for it.Rewind(); it.Valid(); it.Next() {
+		keys = append(keys, string(it.Key()))
+		val, err := it.Value()
+		assert.Nil(t, err)
+		assert.NotNil(t, val)
+	}
+	it.Close()
+	assert.Equal(t, 100, len(keys))
+	assert.Equal(t, "b-000", keys[0])
+	assert.Equal(t, "b-099", keys[99])
+
+	it = db.NewIterator(IteratorOptions{Prefix: []byte("a-")})
+	it.Seek([]byte("a-050"))
+	assert.Equal(t, "a-050", string(it.Key()))
+	it.Close()
+	assert.Nil(t, db.Close())
+}
+
+// 遍历迭代器剩下的所有key
+func iterKeys(it *Iterator) []string {
+	var keys []string
+	for ; it.Valid(); it.Next() {
+		keys = append(keys, string(it.Key()))
+	}
+	return keys
+}
+
+func iterRange(prefix string, start, end int, reverse bool) []string {
+	var keys []string
+	for i := start; i < end; i++ {
+		keys = append(keys, fmt.Sprintf("%s%03d", prefix, i))
+	}
+	if reverse {
+		for l, r := 0, len(keys)-1; l < r; l, r = l+1, r-1 {
+			keys[l], keys[r] = keys[r], keys[l]
+		}
+	}
+	return keys
+}
+
+func TestIterator_Options(t *testing.T) {
+	for _, typ := range []index.IndexerType{index.BTree, index.ART, index.BPTree} {
+		opts := DefaultOptions
+		opts.DirPath = filepath.Join(t.TempDir(), "lovedb")
+		opts.IndexType = typ
+		db, err := Open(opts)
+		assert.Nil(t, err)
+		for i := 0; i < 100; i++ {
+			assert.Nil(t, db.Put([]byte(fmt.Sprintf("a-%03d", i)), testValue(i)))
+			assert.Nil(t, db.Put([]byte(fmt.Sprintf("b-%03d", i)), testValue(i)))
+		}
+		assert.Nil(t, db.Put([]byte("b"), testValue(0)))
+		assert.Nil(t, db.Put([]byte("c"), testValue(0)))
+
+		for _, reverse := range []bool{false, true} {
+			//前缀遍历
+			it := db.NewIterator(IteratorOptions{Prefix: []byte("b-"), Reverse: reverse})
+			assert.Equal(t, iterRange("b-", 0, 100, reverse), iterKeys(it))
+			it.Close()
+
+			//上下界和前缀一起使用，上界不包含在内
+			it = db.NewIterator(IteratorOptions{
+				Prefix:     []byte("a-"),
+				LowerBound: []byte("a-050"),
+				UpperBound: []byte("a-060"),
+				Reverse:    reverse,
+			})
+			assert.Equal(t, iterRange("a-", 50, 60, reverse), iterKeys(it))
+			//seek不会超出上下界
+			it.Seek([]byte("a-000"))
+			if reverse {
+				assert.False(t, it.Valid())
+			} else {
+				assert.Equal(t, "a-050", string(it.Key()))
+			}
+			it.Seek([]byte("z"))
+			if reverse {
+				assert.Equal(t, "a-059", string(it.Key()))
+			} else {
+				assert.False(t, it.Valid())
+			}
+			it.Close()
+
+			//只遍历key
+			it = db.NewIterator(IteratorOptions{UpperBound: []byte("a-001"), KeysOnly: true, Reverse: reverse})
+			assert.Equal(t, "a-000", string(it.Key()))
+			_, err := it.Value()
+			assert.Equal(t, ErrIteratorKeysOnly, err)
+			it.Close()
+
+			//分页遍历，每一页都是一个新的迭代器
+			var keys []string
+			var token []byte
+			for pages := 0; ; pages++ {
+				it = db.NewIterator(IteratorOptions{Prefix: []byte("a-"), Limit: 7, Continuation: token, Reverse: reverse})
+				page := iterKeys(it)
+				assert.True(t, len(page) <= 7)
+				keys = append(keys, page...)
+				token = it.Continuation()
+				it.Close()
+				if token == nil {
+					assert.Equal(t, 14, pages)
+					break
+				}
+			}
+			assert.Equal(t, iterRange("a-", 0, 100, reverse), keys)
+
+			//token不能用于另一个方向的遍历
+			it = db.NewIterator(IteratorOptions{Limit: 1, Reverse: reverse})
+			token = it.Continuation()
+			it.Close()
+			it = db.NewIterator(IteratorOptions{Continuation: token, Reverse: !reverse})
+			assert.False(t, it.Valid())
+			assert.Equal(t, ErrInvalidContinuation, it.Err())
+			it.Close()
+		}
+		assert.Nil(t, db.Close())
+	}
+}
+
+func TestPrefixEnd(t *testing.T) {
+	assert.Equal(t, []byte("b"), prefixEnd([]byte("a")))
+	assert.Equal(t, []byte{'a', 0x01}, prefixEnd([]byte{'a', 0x00, 0xff}))
+	assert.Nil(t, prefixEnd([]byte{0xff, 0xff}))
+}
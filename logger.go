@@ -0,0 +1,93 @@
+package lovedb
+
+import (
+	"fmt"
+	"log"
+)
+
+// LogLevel 日志级别
+type LogLevel int8
+
+const (
+	LogDebug LogLevel = iota
+	LogInfo
+	LogWarn
+	LogError
+)
+
+var logLevelNames = map[LogLevel]string{
+	LogDebug: "DEBUG",
+	LogInfo:  "INFO",
+	LogWarn:  "WARN",
+	LogError: "ERROR",
+}
+
+func (l LogLevel) String() string {
+	if name, ok := logLevelNames[l]; ok {
+		return name
+	}
+	return fmt.Sprintf("LogLevel(%d)", l)
+}
+
+// Logger 分级别的日志接口，通过Options.Logger设置，需要是并发安全的
+// 日志可能在持有db的锁时输出，实现中不能调用db的方法
+type Logger interface {
+	Debugf(format string, args ...any)
+	Infof(format string, args ...any)
+	Warnf(format string, args ...any)
+	Errorf(format string, args ...any)
+}
+
+// NopLogger 丢弃所有日志，Options.Logger为nil时使用
+type NopLogger struct{}
+
+func (NopLogger) Debugf(string, ...any) {}
+func (NopLogger) Infof(string, ...any)  {}
+func (NopLogger) Warnf(string, ...any)  {}
+func (NopLogger) Errorf(string, ...any) {}
+
+// stdLogger 把日志写到标准库的log.Logger
+type stdLogger struct {
+	logger *log.Logger
+	level  LogLevel
+}
+
+// NewStdLogger 用标准库的log.Logger输出日志，低于level的日志会被丢弃，logger为nil时使用log.Default()
+func NewStdLogger(logger *log.Logger, level LogLevel) Logger {
+	if logger == nil {
+		logger = log.Default()
+	}
+	return &stdLogger{logger: logger, level: level}
+}
+
+func (l *stdLogger) Debugf(format string, args ...any) {
+	l.output(LogDebug, format, args)
+}
+
+func (l *stdLogger) Infof(format string, args ...any) {
+	l.output(LogInfo, format, args)
+}
+
+func (l *stdLogger) Warnf(format string, args ...any) {
+	l.output(LogWarn, format, args)
+}
+
+func (l *stdLogger) Errorf(format string, args ...any) {
+	l.output(LogError, format, args)
+}
+
+func (l *stdLogger) output(level LogLevel, format string, args []any) {
+	if level < l.level {
+		return
+	}
+	//跳过output和Debugf这些方法，日志中的文件名是调用方的位置
+	_ = l.logger.Output(3, "["+level.String()+"] lovedb: "+fmt.Sprintf(format, args...))
+}
+
+// 配置的日志，没有设置时丢弃所有日志
+func optionsLogger(options Options) Logger {
+	if options.Logger == nil {
+		return NopLogger{}
+	}
+	return options.Logger
+}
@@ -0,0 +1,90 @@
+package lovedb
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"log"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// 记录所有日志的Logger
+type recordingLogger struct {
+	mu    sync.Mutex
+	lines []string
+}
+
+func (l *recordingLogger) logf(level LogLevel, format string, args ...any) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.lines = append(l.lines, level.String()+" "+fmt.Sprintf(format, args...))
+}
+
+func (l *recordingLogger) Debugf(format string, args ...any) { l.logf(LogDebug, format, args...) }
+func (l *recordingLogger) Infof(format string, args ...any)  { l.logf(LogInfo, format, args...) }
+func (l *recordingLogger) Warnf(format string, args ...any)  { l.logf(LogWarn, format, args...) }
+func (l *recordingLogger) Errorf(format string, args ...any) { l.logf(LogError, format, args...) }
+
+// 以prefix开头的日志的数量
+func (l *recordingLogger) count(prefix string) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var n int
+	for _, line := range l.lines {
+		if strings.HasPrefix(line, prefix) {
+			n++
+		}
+	}
+	return n
+}
+
+func TestStdLogger(t *testing.T) {
+	var buf bytes.Buffer
+	logger := NewStdLogger(log.New(&buf, "", log.Lshortfile), LogInfo)
+	logger.Debugf("debug %d", 1)
+	logger.Infof("info %d", 2)
+	logger.Errorf("error %d", 3)
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	assert.Equal(t, 2, len(lines))
+	//文件名是调用方的位置
+	assert.True(t, strings.HasPrefix(lines[0], "logger_test.go:"), lines[0])
+	assert.True(t, strings.HasSuffix(lines[0], "[INFO] lovedb: info 2"), lines[0])
+	assert.True(t, strings.HasSuffix(lines[1], "[ERROR] lovedb: error 3"), lines[1])
+	assert.Equal(t, "LogLevel(9)", LogLevel(9).String())
+}
+
+func TestDB_Logger(t *testing.T) {
+	logger := &recordingLogger{}
+	opts := DefaultOptions
+	opts.DirPath = filepath.Join(t.TempDir(), "lovedb")
+	opts.DataFileSize = 32 * 1024
+	opts.DataFileMergeRatio = 0
+	opts.Logger = logger
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, logger.count("INFO opened "))
+
+	for i := 0; i < 2000; i++ {
+		assert.Nil(t, db.Put(testKey(i), testValue(i)))
+	}
+	assert.True(t, logger.count("INFO rotated data file ") > 0)
+
+	//目录已经被打开
+	_, err = Open(opts)
+	assert.Equal(t, ErrDatabaseIsUsing, err)
+	assert.Equal(t, 1, logger.count("WARN directory "))
+
+	assert.Nil(t, db.Merge())
+	assert.Equal(t, 1, logger.count("INFO merge finished "))
+	assert.Nil(t, db.Close())
+
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, logger.count("INFO applied merge result"))
+	assert.Equal(t, 2, logger.count("INFO opened "))
+	assert.Equal(t, 0, logger.count("ERROR"))
+	assert.Nil(t, db.Close())
+}
@@ -1,72 +1,111 @@
 package lovedb
 
 import (
+	"context"
 	"io"
 	"lovedb/data"
+	"lovedb/index"
 	"lovedb/utils"
-	"os"
 	"path"
 	"path/filepath"
 	"sort"
 	"strconv"
+	"time"
 )
 
 const (
 	mergeDirName     = "-merge"
 	mergeFinishedKey = "merge.finished"
+
+	// 从hint文件加载索引时每批更新的key数量，b+树索引每批是一个事务
+	hintBatchSize = 10000
 )
 
 // Merge 清理无效数据，生成hint文件
 func (db *DB) Merge() error {
+	return db.MergeCtx(context.Background())
+}
+
+// MergeCtx 和Merge一样，每个数据文件和每条记录之前检查ctx
+// 取消时删除merge目录并返回ctx.Err()，已经切换的活跃文件不会恢复，数据文件和索引都不会变化
+func (db *DB) MergeCtx(ctx context.Context) (err error) {
+	start := time.Now()
+	defer func() {
+		db.metrics.merge.observe(start, err)
+	}()
 	//判断活跃文件为空，代表目录就是空的
 	if db.activeFile == nil {
 		return nil
 	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	db.mu.Lock()
 
 	//如果merge正在进行，则直接返回
 	if db.isMerging {
 		db.mu.Unlock()
+		db.logger.Warnf("merge skipped: another merge is in progress")
 		return ErrMergeIsProgress
 	}
 
 	//查看merge的数据量是否达到阈值
-	totalSize, err := utils.DirSize(db.options.DirPath)
+	totalSize, err := db.fs.DirSize(db.options.DirPath)
 	if err != nil {
 		db.mu.Unlock()
 		return err
 	}
 	// 无效数据的数量 除以 所有数据的数量   如果 小于  用户要求的 阈值
 	if float32(db.reclaimSize)/float32(totalSize) < db.options.DataFileMergeRatio {
+		reclaimSize := db.reclaimSize
 		db.mu.Unlock()
+		db.logger.Debugf("merge skipped: reclaimable %d of %d bytes is below ratio %v", reclaimSize, totalSize, db.options.DataFileMergeRatio)
 		return ErrMergeRatioUnreached
 	}
 
-	//看我们剩余磁盘容量能否供我们merge以后的数据量
-	availableDiskSize, err := utils.AvailableDiskSize()
-	if err != nil {
-		db.mu.Unlock()
-		return err
-	}
-	if uint64(totalSize-db.reclaimSize) > availableDiskSize {
-		db.mu.Unlock()
-		return ErrNoEnoughSpaceForMerge
+	//看我们剩余磁盘容量能否供我们merge以后的数据量，内存模式不需要检查
+	if !db.options.InMemory {
+		availableDiskSize, err := utils.AvailableDiskSize()
+		if err != nil {
+			db.mu.Unlock()
+			return err
+		}
+		if uint64(totalSize-db.reclaimSize) > availableDiskSize {
+			db.mu.Unlock()
+			return ErrNoEnoughSpaceForMerge
+		}
 	}
 
 	db.isMerging = true
+	//记录这次merge的结果，没有真正开始的merge不会记录
+	mergeStart := time.Now()
+	reclaimSize := db.reclaimSize
+	db.events.OnMergeStarted(MergeStartedInfo{TotalSize: totalSize, ReclaimableSize: reclaimSize})
+	defer func() {
+		mergeStat := &MergeStat{Time: mergeStart, Duration: time.Since(mergeStart)}
+		if err != nil {
+			mergeStat.Err = err.Error()
+			db.logger.Errorf("merge failed after %v: %v", mergeStat.Duration, err)
+		}
+		db.lastMerge.Store(mergeStat)
+		db.events.OnMergeFinished(MergeFinishedInfo{Duration: mergeStat.Duration, Err: err})
+	}()
 
 	defer func() {
 		db.isMerging = false
 	}()
 
-	//持久化当前活跃文件
-	if err := db.activeFile.Sync(); err != nil {
-		db.mu.Unlock()
-		return err
-	}
-	//将当前活跃转化为旧的,打开一个新的活跃文件
-	db.olderFiles[db.activeFile.FileId] = db.activeFile
-	if err := db.setActiveDataFile(); err != nil {
+	//正在分块写入的value还没有写清单，索引中找不到它的分块，要等写完再切换活跃文件，否则分块会被回收掉
+	//等待期间不让新的PutReader开始，切换以后新写入的分块都在不参与merge的文件中
+	db.mergeWaitStreams = true
+	for db.inflightStreams > 0 {
+		db.streamCond.Wait()
+	}
+	db.mergeWaitStreams = false
+	db.streamCond.Broadcast()
+
+	//持久化当前活跃文件，将当前活跃转化为旧的,打开一个新的活跃文件
+	if err := db.rotateActiveFile(); err != nil {
 		db.mu.Unlock()
 		return err
 	}
@@ -83,41 +122,72 @@ func (db *DB) Merge() error {
 	sort.Slice(mergeFiles, func(i, j int) bool {
 		return mergeFiles[i].FileId < mergeFiles[j].FileId
 	})
+	//分块存储的value需要根据清单读取分块
+	mergeFileMap := make(map[uint32]*data.DataFile, len(mergeFiles))
+	for _, file := range mergeFiles {
+		mergeFileMap[file.FileId] = file
+	}
 
 	mergePath := db.getMergePath()
 
 	//如果本身有这个目录，说明之前merge过，要先删除并创建
-	if _, err := os.Stat(mergePath); err != nil {
-		if err := os.RemoveAll(mergePath); err != nil {
+	if db.fs.Exists(mergePath) {
+		if err := db.fs.RemoveAll(mergePath); err != nil {
 			return err
 		}
 	}
 
 	//新建merge目录
-	if err := os.MkdirAll(mergePath, os.ModePerm); err != nil {
+	if err := db.fs.MkdirAll(mergePath); err != nil {
 		return err
 	}
+	//没有完成的merge目录在下次启动时也会被丢弃，出错或者取消时直接删除，在临时实例关闭以后执行
+	defer func() {
+		if err != nil {
+			_ = db.fs.RemoveAll(mergePath)
+		}
+	}()
 
 	//在该目录打开一个临时bitcask示例用于merge
 	mergeOptions := db.options
 	mergeOptions.DirPath = mergePath
 	//merge发生错误之前的就不要sync，所以sync不需要一直有，最后来一次就可以
 	mergeOptions.SyncWrite = false
+	//临时实例不需要缓存和索引快照
+	mergeOptions.ValueCacheSize = 0
+	mergeOptions.IndexCheckpoint = false
+	//临时实例不使用自己的索引，b+树索引会在目录中留下一个空的索引文件
+	mergeOptions.IndexType = index.BTree
+	//临时实例内部的事件不通知监听者，也不输出日志
+	mergeOptions.EventListener = nil
+	mergeOptions.Logger = nil
 	mergeDB, err := Open(mergeOptions)
 	if err != nil {
 		return err
 	}
+	//merge完成以后释放临时实例持有的目录锁
+	defer func() {
+		_ = mergeDB.Close()
+	}()
 
 	//打开一个hint文件处理索引
-	hintFile, err := data.OpenHintFile(mergePath)
+	hintFile, err := data.OpenHintFile(mergePath, db.fileIOType(), db.options.Checksum, db.options.IOOpener)
 	if err != nil {
 		return err
 	}
+	defer func() {
+		_ = hintFile.Close()
+	}()
 	//遍历处理每个数据文件
+	var mergedRecords int
 	for _, file := range mergeFiles {
-
+		offset := file.HeaderSize()
 		for {
-			var offset int64 = 0
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			default:
+			}
 			logRecord, size, err := file.ReadLogRecord(offset)
 			if err != nil {
 				if err == io.EOF {
@@ -125,20 +195,33 @@ func (db *DB) Merge() error {
 				}
 				return err
 			}
-			realKey, _ := ParseLogRecordKey(logRecord.Key)
+			realKey := logRecord.Key
 			//拿到记录和内存索引中进行对比
 			logRecordPos := db.index.Get(realKey)
 			if logRecordPos != nil && logRecordPos.Fid == file.FileId && logRecordPos.Offset == offset {
 				//往merge里面写,清除事务标记
-				logRecord.Key = LogRecordKeyWithSeq(realKey, nonTxSeqNo)
+				logRecord.SeqNo = nonTxSeqNo
+				//分块存储的value先把分块写过去，清单中记录新的位置
+				var chunked *data.ChunkedValue
+				if logRecord.Flags&data.LogRecordFlagChunked != 0 {
+					chunked, err = mergeChunks(mergeDB, mergeFileMap, logRecord.Value)
+					if err != nil {
+						return err
+					}
+					logRecord.Value = data.EncodeChunkedValue(chunked)
+				}
 				mergeRecordPos, err := mergeDB.appendLogRecord(logRecord)
 				if err != nil {
 					return err
 				}
+				if chunked != nil {
+					mergeRecordPos.Size = chunked.DiskSize(int64(mergeRecordPos.Size))
+				}
 				//将merge的pos写入到Hint文件中
 				if err := hintFile.WriteHintRecord(realKey, mergeRecordPos); err != nil {
 					return err
 				}
+				mergedRecords++
 			}
 			offset += size
 		}
@@ -152,10 +235,13 @@ func (db *DB) Merge() error {
 		return err
 	}
 	//打开标示着merge完成的文件
-	mergeFinishedFile, err := data.OpenMergeFinishedFile(mergePath)
+	mergeFinishedFile, err := data.OpenMergeFinishedFile(mergePath, db.fileIOType(), db.options.Checksum, db.options.IOOpener)
 	if err != nil {
 		return err
 	}
+	defer func() {
+		_ = mergeFinishedFile.Close()
+	}()
 	//记录当前db的活跃文件，这是第一个没有被merge的文件
 	nonMergeId := db.activeFile.FileId
 	//往这个文件里写一条数据记录相关信息
@@ -164,23 +250,57 @@ func (db *DB) Merge() error {
 		Value: []byte(strconv.Itoa(int(nonMergeId))),
 	}
 	//写入到标识merge完成的文件中
-	record, _ := data.EncodeLogRecord(mergeFinRecord)
+	record, _ := data.EncodeLogRecord(mergeFinRecord, mergeFinishedFile.Checksum)
 	if err := mergeFinishedFile.Write(record); err != nil {
 		return err
 	}
 	if err := mergeFinishedFile.Sync(); err != nil {
 		return err
 	}
+	db.logger.Infof("merge finished in %v: %d data files, %d live records, %d bytes written, reclaimable %d of %d bytes before merge",
+		time.Since(mergeStart), len(mergeFiles), mergedRecords, mergeDB.ops.bytesWritten.Load(), reclaimSize, totalSize)
 	return nil
 }
 
+// 把分块存储的value的所有分块写到merge实例中，返回新的分块清单
+func mergeChunks(mergeDB *DB, files map[uint32]*data.DataFile, manifest []byte) (*data.ChunkedValue, error) {
+	chunked, err := data.DecodeChunkedValue(manifest)
+	if err != nil {
+		return nil, err
+	}
+	for i, pos := range chunked.Chunks {
+		file := files[pos.Fid]
+		if file == nil {
+			return nil, ErrDataFileNotFound
+		}
+		chunk, _, err := file.ReadLogRecord(pos.Offset)
+		if err != nil {
+			return nil, err
+		}
+		if chunk.Type != data.LogRecordChunk {
+			return nil, data.ErrInvalidChunkedValue
+		}
+		chunk.SeqNo = nonTxSeqNo
+		newPos, err := mergeDB.appendLogRecord(chunk)
+		if err != nil {
+			return nil, err
+		}
+		chunked.Chunks[i] = newPos
+	}
+	return chunked, nil
+}
+
 func (db *DB) getMergePath() string {
+	return mergeDirPath(db.options.DirPath)
+}
+
+func mergeDirPath(dirPath string) string {
 	// Dir返回路径除去最后一个路径元素的部分，即该路径最后一个元素所在的目录
 	//D:/git_space/lovedb/tmp  ---->    D:/git_space/lovedb
-	dir := path.Dir(path.Clean(db.options.DirPath))
+	dir := path.Dir(path.Clean(dirPath))
 
 	//D:/git_space/lovedb/tmp  ---->   tmp
-	base := path.Base(db.options.DirPath)
+	base := path.Base(dirPath)
 
 	//D:/git_space/lovedb/tmp-merge
 	return filepath.Join(dir, base+mergeDirName)
@@ -190,73 +310,115 @@ func (db *DB) getMergePath() string {
 func (db *DB) loadMergeFiles() error {
 	mergePath := db.getMergePath()
 	//merge目录不存在直接返回
-	if _, err := os.Stat(mergePath); os.IsNotExist(err) {
+	if !db.fs.Exists(mergePath) {
 		return nil
 	}
 	defer func() {
-		_ = os.RemoveAll(mergePath)
+		_ = db.fs.RemoveAll(mergePath)
 	}()
 
-	dirEntries, err := os.ReadDir(mergePath)
+	dirEntries, err := db.fs.ReadDir(mergePath)
 	if err != nil {
 		return err
 	}
 	//查找是否有merge-finished的文件，判断是否处理完
 	var mergeFinished bool
 	var mergeFileNames []string
-	for _, file := range dirEntries {
-		if file.Name() == data.MergeFinishedFileName {
+	for _, fileName := range dirEntries {
+		if fileName == data.MergeFinishedFileName {
 			mergeFinished = true
 		}
-		if file.Name() == data.SeqNoFileName {
+		if fileName == data.SeqNoFileName || fileName == data.IndexCheckpointName || fileName == data.IndexTypeFileName {
 			continue
 		}
-		if file.Name() == fileLockName {
+		if fileName == fileLockName || fileName == index.BPTreeIndexFileName {
 			continue
 		}
-		mergeFileNames = append(mergeFileNames, file.Name())
+		mergeFileNames = append(mergeFileNames, fileName)
 	}
 
 	//没有完成merge就直接返回
 	if !mergeFinished {
+		db.logger.Warnf("discarded unfinished merge in %s", mergePath)
 		return nil
 	}
 
 	//用merge下的文件替代
 	nonMergeFileId, err := db.getNonMergeFileId(mergePath)
 	if err != nil {
+		//标识merge完成的记录没有写完就崩溃了，merge没有完成，直接丢弃
+		if err == io.EOF || isCorruptRecord(err) {
+			db.logger.Warnf("discarded unfinished merge in %s: %v", mergePath, err)
+			return nil
+		}
 		return err
 	}
+	//索引快照中的位置指向merge之前的文件，不能再使用
+	checkpointFileName := filepath.Join(db.options.DirPath, data.IndexCheckpointName)
+	if db.fs.Exists(checkpointFileName) {
+		if err := db.fs.Remove(checkpointFileName); err != nil {
+			return err
+		}
+	}
+	//b+树索引启动时不会从hint文件加载，先把merge之后的位置写入b+树索引，再删除旧的数据文件
+	//只更新仍然指向merge之前的文件的key，merge之后又写入或删除的key保持不变
+	//写入的过程中崩溃了，下次启动时会重新写入一遍
+	if db.options.IndexType == index.BPTree {
+		if err := db.loadHintFile(mergePath, func(key []byte) bool {
+			pos := db.index.Get(key)
+			return pos != nil && pos.Fid < nonMergeFileId
+		}); err != nil {
+			return err
+		}
+	}
 	//将旧的目录文件删掉,比nonMergeFileId更小的所有文件
 	var fileId uint32 = 0
 	for ; fileId < nonMergeFileId; fileId++ {
 		//fixme
 		fileName := data.GetDataFileName(db.options.DirPath, fileId)
-		if _, err := os.Stat(fileName); err == nil {
-			if err := os.Remove(fileName); err != nil {
+		if db.fs.Exists(fileName) {
+			if err := db.fs.Remove(fileName); err != nil {
+				return err
+			}
+		}
+		//旧数据文件的hint文件也一起删除
+		hintFileName := data.GetDataHintFileName(db.options.DirPath, fileId)
+		if db.fs.Exists(hintFileName) {
+			if err := db.fs.Remove(hintFileName); err != nil {
 				return err
 			}
 		}
 	}
+	//旧的数据文件已经删除，对应的缓存也要清除
+	if db.cache != nil {
+		db.cache.RemoveFiles(nonMergeFileId)
+	}
 	//将merge下的文件移动过去,包括hint文件
 	for _, fileName := range mergeFileNames {
 		srcPath := filepath.Join(mergePath, fileName)
 		destPath := filepath.Join(db.options.DirPath, fileName)
-		err := os.Rename(srcPath, destPath)
+		err := db.fs.Rename(srcPath, destPath)
 		if err != nil {
 			return err
 		}
+		if fileName == data.HintFileName {
+			db.events.OnHintFileWritten(HintFileInfo{Path: destPath, Merge: true})
+		}
 	}
+	db.logger.Infof("applied merge result: replaced data files before %d", nonMergeFileId)
 	return nil
 }
 
 // 获取最近没有被merge的文件的id
 func (db *DB) getNonMergeFileId(dirPath string) (uint32, error) {
-	mergeFinFile, err := data.OpenMergeFinishedFile(dirPath)
+	mergeFinFile, err := data.OpenMergeFinishedFile(dirPath, db.fileIOType(), db.options.Checksum, db.options.IOOpener)
 	if err != nil {
 		return 0, err
 	}
-	record, _, err := mergeFinFile.ReadLogRecord(0)
+	defer func() {
+		_ = mergeFinFile.Close()
+	}()
+	record, _, err := mergeFinFile.ReadLogRecord(mergeFinFile.HeaderSize())
 	if err != nil {
 		return 0, err
 	}
@@ -269,17 +431,26 @@ func (db *DB) getNonMergeFileId(dirPath string) (uint32, error) {
 
 // 从hint去加载我们的索引
 func (db *DB) loadIndexFromHint() error {
-	hintFileName := filepath.Join(db.options.DirPath, data.HintFileName)
-	if _, err := os.Stat(hintFileName); os.IsNotExist(err) {
-		return err
+	return db.loadHintFile(db.options.DirPath, nil)
+}
+
+// 读取dirPath目录下的hint文件，分批更新到索引中，filter不为nil时只更新filter返回true的key
+func (db *DB) loadHintFile(dirPath string, filter func(key []byte) bool) error {
+	hintFileName := filepath.Join(dirPath, data.HintFileName)
+	if !db.fs.Exists(hintFileName) {
+		return nil
 	}
 	//打开hint索引文件
-	hintFile, err := data.OpenHintFile(db.options.DirPath)
+	hintFile, err := data.OpenHintFile(dirPath, db.fileIOType(), db.options.Checksum, db.options.IOOpener)
 	if err != nil {
 		return err
 	}
+	defer func() {
+		_ = hintFile.Close()
+	}()
 	//读取hint文件，并更新到内存
-	var offset int64 = 0
+	var ops []index.BatchOp
+	offset := hintFile.HeaderSize()
 	for {
 		logRecord, n, err := hintFile.ReadLogRecord(offset)
 		if err != nil {
@@ -288,10 +459,24 @@ func (db *DB) loadIndexFromHint() error {
 			}
 			return err
 		}
+		offset += n
+		if filter != nil && !filter(logRecord.Key) {
+			continue
+		}
 		//解码拿到实际的索引信息
 		pos := data.DecodeLogRecordPos(logRecord.Value)
-		db.index.Put(logRecord.Key, pos)
-		offset += n
+		ops = append(ops, index.BatchOp{Key: logRecord.Key, Pos: pos})
+		if len(ops) == hintBatchSize {
+			if _, err := db.applyIndexBatch(ops, 0); err != nil {
+				return err
+			}
+			ops = ops[:0]
+		}
+	}
+	if len(ops) > 0 {
+		if _, err := db.applyIndexBatch(ops, 0); err != nil {
+			return err
+		}
 	}
 	return nil
 }
@@ -0,0 +1,72 @@
+package lovedb
+
+import (
+	"lovedb/metrics"
+	"time"
+)
+
+// 一种操作的指标：调用次数、失败次数以及耗时
+type opMetric struct {
+	total   *metrics.Counter
+	errors  *metrics.Counter
+	latency *metrics.Histogram
+}
+
+// db的所有指标，指标名以lovedb_开头
+type dbMetrics struct {
+	registry     *metrics.Registry
+	put          opMetric
+	get          opMetric
+	delete       opMetric
+	batchCommit  opMetric
+	merge        opMetric
+	rotate       opMetric
+	sync         opMetric
+	bytesWritten *metrics.Counter
+}
+
+func newOpMetric(r *metrics.Registry, name, desc string) opMetric {
+	return opMetric{
+		total:   r.Counter("lovedb_"+name+"_total", "Total number of "+desc+"."),
+		errors:  r.Counter("lovedb_"+name+"_errors_total", "Total number of failed "+desc+"."),
+		latency: r.Histogram("lovedb_"+name+"_duration_seconds", "Latency of "+desc+".", metrics.DefaultLatencyBuckets),
+	}
+}
+
+// 记录一次从start开始的操作
+func (m opMetric) observe(start time.Time, err error) {
+	m.total.Inc()
+	if err != nil {
+		m.errors.Inc()
+	}
+	m.latency.ObserveSince(start)
+}
+
+func newDBMetrics(db *DB) *dbMetrics {
+	r := metrics.NewRegistry()
+	m := &dbMetrics{
+		registry:     r,
+		put:          newOpMetric(r, "put", "Put calls"),
+		get:          newOpMetric(r, "get", "Get calls"),
+		delete:       newOpMetric(r, "delete", "Delete calls"),
+		batchCommit:  newOpMetric(r, "batch_commit", "WriteBatch commits"),
+		merge:        newOpMetric(r, "merge", "Merge calls"),
+		rotate:       newOpMetric(r, "file_rotation", "active data file rotations"),
+		sync:         newOpMetric(r, "sync", "data file syncs"),
+		bytesWritten: r.Counter("lovedb_bytes_written_total", "Total bytes appended to data files."),
+	}
+	r.GaugeFunc("lovedb_keys", "Number of keys in the index.", func() float64 {
+		return float64(db.index.Size())
+	})
+	r.GaugeFunc("lovedb_reclaimable_bytes", "Bytes of stale data that merge can reclaim.", func() float64 {
+		db.mu.RLock()
+		defer db.mu.RUnlock()
+		return float64(db.reclaimSize)
+	})
+	return m
+}
+
+// Metrics 返回db的指标，可以用Handler以Prometheus格式输出，或者用PublishExpvar发布到expvar
+func (db *DB) Metrics() *metrics.Registry {
+	return db.metrics.registry
+}
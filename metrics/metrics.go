@@ -0,0 +1,190 @@
+package metrics
+
+import (
+	"expvar"
+	"math"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultLatencyBuckets 延迟直方图默认的桶上界，单位为秒，从10微秒到10秒
+var DefaultLatencyBuckets = []float64{
+	0.00001, 0.000025, 0.00005, 0.0001, 0.00025, 0.0005,
+	0.001, 0.0025, 0.005, 0.01, 0.025, 0.05,
+	0.1, 0.25, 0.5, 1, 2.5, 5, 10,
+}
+
+// Counter 只增不减的计数器
+type Counter struct {
+	value atomic.Uint64
+}
+
+func (c *Counter) Inc() {
+	c.value.Add(1)
+}
+
+func (c *Counter) Add(n uint64) {
+	c.value.Add(n)
+}
+
+func (c *Counter) Value() uint64 {
+	return c.value.Load()
+}
+
+// Histogram 固定分桶的直方图，每个桶统计小于等于上界的观测值数量
+type Histogram struct {
+	bounds  []float64       //从小到大排列的桶上界
+	counts  []atomic.Uint64 //每个桶中的数量，不是累计值，最后一个桶是+Inf
+	count   atomic.Uint64
+	sumBits atomic.Uint64 //观测值之和，float64的二进制表示
+}
+
+// HistogramSnapshot 直方图某一时刻的数据，Counts是累计值，和Bounds一一对应
+type HistogramSnapshot struct {
+	Bounds []float64
+	Counts []uint64
+	Count  uint64
+	Sum    float64
+}
+
+func newHistogram(bounds []float64) *Histogram {
+	bounds = append([]float64{}, bounds...)
+	sort.Float64s(bounds)
+	return &Histogram{
+		bounds: bounds,
+		counts: make([]atomic.Uint64, len(bounds)+1),
+	}
+}
+
+// Observe 记录一个观测值
+func (h *Histogram) Observe(v float64) {
+	h.counts[sort.SearchFloat64s(h.bounds, v)].Add(1)
+	h.count.Add(1)
+	for {
+		old := h.sumBits.Load()
+		sum := math.Float64frombits(old) + v
+		if h.sumBits.CompareAndSwap(old, math.Float64bits(sum)) {
+			return
+		}
+	}
+}
+
+// ObserveDuration 记录一次耗时，单位为秒
+func (h *Histogram) ObserveDuration(d time.Duration) {
+	h.Observe(d.Seconds())
+}
+
+// ObserveSince 记录从start到现在的耗时
+func (h *Histogram) ObserveSince(start time.Time) {
+	h.ObserveDuration(time.Since(start))
+}
+
+// Snapshot 返回直方图当前的数据，并发写入时各个字段之间可能有细微的出入
+func (h *Histogram) Snapshot() HistogramSnapshot {
+	snapshot := HistogramSnapshot{
+		Bounds: h.bounds,
+		Counts: make([]uint64, len(h.bounds)),
+		Count:  h.count.Load(),
+		Sum:    math.Float64frombits(h.sumBits.Load()),
+	}
+	var cumulative uint64
+	for i := range h.bounds {
+		cumulative += h.counts[i].Load()
+		snapshot.Counts[i] = cumulative
+	}
+	return snapshot
+}
+
+type metricType string
+
+const (
+	counterType   metricType = "counter"
+	gaugeType     metricType = "gauge"
+	histogramType metricType = "histogram"
+)
+
+// 注册的指标，counter、gauge、histogram只有一个不为nil
+type metric struct {
+	name      string
+	help      string
+	typ       metricType
+	counter   *Counter
+	gauge     func() float64
+	histogram *Histogram
+}
+
+// Registry 一组指标，按照注册的顺序输出
+type Registry struct {
+	lock    *sync.RWMutex
+	metrics []*metric
+	names   map[string]bool
+}
+
+// NewRegistry 初始化一组指标
+func NewRegistry() *Registry {
+	return &Registry{
+		lock:  new(sync.RWMutex),
+		names: make(map[string]bool),
+	}
+}
+
+// Counter 注册一个计数器，名字重复时panic
+func (r *Registry) Counter(name, help string) *Counter {
+	c := &Counter{}
+	r.register(&metric{name: name, help: help, typ: counterType, counter: c})
+	return c
+}
+
+// GaugeFunc 注册一个瞬时值，每次输出时调用fn获取当前的值
+func (r *Registry) GaugeFunc(name, help string, fn func() float64) {
+	r.register(&metric{name: name, help: help, typ: gaugeType, gauge: fn})
+}
+
+// Histogram 注册一个直方图，buckets为桶的上界
+func (r *Registry) Histogram(name, help string, buckets []float64) *Histogram {
+	h := newHistogram(buckets)
+	r.register(&metric{name: name, help: help, typ: histogramType, histogram: h})
+	return h
+}
+
+func (r *Registry) register(m *metric) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.names[m.name] {
+		panic("metrics: duplicate metric name " + m.name)
+	}
+	r.names[m.name] = true
+	r.metrics = append(r.metrics, m)
+}
+
+// 复制一份注册的指标，输出时不需要一直持有锁
+func (r *Registry) all() []*metric {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return append([]*metric{}, r.metrics...)
+}
+
+// Snapshot 返回所有指标当前的值，计数器为uint64，瞬时值为float64，直方图为HistogramSnapshot
+func (r *Registry) Snapshot() map[string]any {
+	values := make(map[string]any)
+	for _, m := range r.all() {
+		switch m.typ {
+		case counterType:
+			values[m.name] = m.counter.Value()
+		case gaugeType:
+			values[m.name] = m.gauge()
+		case histogramType:
+			values[m.name] = m.histogram.Snapshot()
+		}
+	}
+	return values
+}
+
+// PublishExpvar 以name为名字把所有指标发布到expvar，同一个name只能发布一次，重复发布时panic
+func (r *Registry) PublishExpvar(name string) {
+	expvar.Publish(name, expvar.Func(func() any {
+		return r.Snapshot()
+	}))
+}
@@ -0,0 +1,81 @@
+package metrics
+
+import (
+	"bytes"
+	"encoding/json"
+	"expvar"
+	"github.com/stretchr/testify/assert"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestHistogram(t *testing.T) {
+	r := NewRegistry()
+	h := r.Histogram("latency", "test", []float64{1, 0.1, 10})
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			h.Observe(0.05)
+			h.Observe(1)
+			h.Observe(20)
+		}()
+	}
+	wg.Wait()
+
+	snapshot := h.Snapshot()
+	assert.Equal(t, []float64{0.1, 1, 10}, snapshot.Bounds)
+	assert.Equal(t, []uint64{10, 20, 20}, snapshot.Counts)
+	assert.Equal(t, uint64(30), snapshot.Count)
+	assert.InDelta(t, 210.5, snapshot.Sum, 1e-9)
+}
+
+func TestRegistry_WritePrometheus(t *testing.T) {
+	r := NewRegistry()
+	c := r.Counter("test_total", "Total number\nof tests.")
+	c.Add(3)
+	r.GaugeFunc("test_gauge", "A gauge.", func() float64 { return 1.5 })
+	h := r.Histogram("test_duration_seconds", "Latency.", []float64{0.001, 0.01})
+	h.ObserveDuration(5 * time.Millisecond)
+	h.ObserveDuration(time.Second)
+
+	var buf bytes.Buffer
+	assert.Nil(t, r.WritePrometheus(&buf))
+	expected := `# HELP test_total Total number\nof tests.
+# TYPE test_total counter
+test_total 3
+# HELP test_gauge A gauge.
+# TYPE test_gauge gauge
+test_gauge 1.5
+# HELP test_duration_seconds Latency.
+# TYPE test_duration_seconds histogram
+test_duration_seconds_bucket{le="0.001"} 0
+test_duration_seconds_bucket{le="0.01"} 1
+test_duration_seconds_bucket{le="+Inf"} 2
+test_duration_seconds_sum 1.005
+test_duration_seconds_count 2
+`
+	assert.Equal(t, expected, buf.String())
+
+	recorder := httptest.NewRecorder()
+	r.Handler().ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	assert.Equal(t, prometheusContentType, recorder.Header().Get("Content-Type"))
+	assert.Equal(t, expected, recorder.Body.String())
+
+	assert.Panics(t, func() {
+		r.Counter("test_total", "duplicate")
+	})
+}
+
+func TestRegistry_PublishExpvar(t *testing.T) {
+	r := NewRegistry()
+	r.Counter("test_total", "test").Inc()
+	r.PublishExpvar("metrics-test")
+
+	var values map[string]json.RawMessage
+	assert.Nil(t, json.Unmarshal([]byte(expvar.Get("metrics-test").String()), &values))
+	assert.Equal(t, "1", string(values["test_total"]))
+}
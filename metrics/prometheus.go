@@ -0,0 +1,63 @@
+package metrics
+
+import (
+	"bufio"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Prometheus文本格式的Content-Type
+const prometheusContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// WritePrometheus 按照Prometheus文本格式输出所有指标
+func (r *Registry) WritePrometheus(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	for _, m := range r.all() {
+		bw.WriteString("# HELP " + m.name + " " + escapeHelp(m.help) + "\n")
+		bw.WriteString("# TYPE " + m.name + " " + string(m.typ) + "\n")
+		switch m.typ {
+		case counterType:
+			bw.WriteString(m.name + " " + strconv.FormatUint(m.counter.Value(), 10) + "\n")
+		case gaugeType:
+			bw.WriteString(m.name + " " + formatFloat(m.gauge()) + "\n")
+		case histogramType:
+			snapshot := m.histogram.Snapshot()
+			for i, bound := range snapshot.Bounds {
+				bw.WriteString(m.name + `_bucket{le="` + formatFloat(bound) + `"} ` +
+					strconv.FormatUint(snapshot.Counts[i], 10) + "\n")
+			}
+			bw.WriteString(m.name + `_bucket{le="+Inf"} ` + strconv.FormatUint(snapshot.Count, 10) + "\n")
+			bw.WriteString(m.name + "_sum " + formatFloat(snapshot.Sum) + "\n")
+			bw.WriteString(m.name + "_count " + strconv.FormatUint(snapshot.Count, 10) + "\n")
+		}
+	}
+	return bw.Flush()
+}
+
+// Handler 输出Prometheus文本格式的http handler，可以挂载到/metrics
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", prometheusContentType)
+		_ = r.WritePrometheus(w)
+	})
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// HELP中的反斜杠和换行需要转义
+func escapeHelp(help string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(help)
+}
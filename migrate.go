@@ -0,0 +1,335 @@
+package lovedb
+
+import (
+	"io"
+	"lovedb/data"
+	"lovedb/fio"
+	"lovedb/index"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	migrateDirName     = "-migrate"
+	migrateFinishedKey = "migrate-finished"
+)
+
+// Migrate 离线把数据目录中旧格式(v1)的文件重写为当前格式，数据库不能处于打开状态
+// 重写的文件使用默认的校验算法
+// 新文件先全部写到 <dir>-migrate 目录中，写完以后放一个完成标识，再逐个移动到数据目录，
+// 移动的过程中崩溃了，再次执行Migrate会继续完成移动。完成标识之前不会修改数据目录中的任何文件
+// 记录的位置会发生变化，hint文件和b+树索引中的位置会一起更新
+func Migrate(dirPath string) error {
+	if _, err := os.Stat(dirPath); err != nil {
+		return err
+	}
+	unlockDir, err := fio.OSFileSystem.TryLock(filepath.Join(dirPath, fileLockName))
+	if err != nil {
+		return err
+	}
+	if unlockDir == nil {
+		return ErrDatabaseIsUsing
+	}
+	defer func() {
+		_ = unlockDir()
+	}()
+
+	migratePath := migrateDirPath(dirPath)
+	//上一次已经写完了新文件，只是没有移动完
+	if _, err := os.Stat(filepath.Join(migratePath, migrateFinishedKey)); err == nil {
+		return finishMigrate(dirPath, migratePath)
+	}
+	//没有完成的merge中是旧格式的文件，需要先打开一次数据库完成merge
+	if _, err := os.Stat(mergeDirPath(dirPath)); err == nil {
+		return ErrMergeIsProgress
+	}
+	if err := os.RemoveAll(migratePath); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(migratePath, os.ModePerm); err != nil {
+		return err
+	}
+	entries, err := os.ReadDir(dirPath)
+	if err != nil {
+		return err
+	}
+	var fileIds []int
+	for _, entry := range entries {
+		if strings.HasSuffix(entry.Name(), data.DataFileNameSuffix) {
+			fileId, err := strconv.Atoi(strings.Split(entry.Name(), ".")[0])
+			if err != nil {
+				return ErrDataDirectoryCorrupted
+			}
+			fileIds = append(fileIds, fileId)
+		}
+	}
+	sort.Ints(fileIds)
+
+	//旧的位置 -> 新的位置
+	positions := make(map[uint32]map[int64]*data.LogRecordPos)
+	for i, fid := range fileIds {
+		filePositions, err := migrateDataFile(dirPath, migratePath, uint32(fid), i == len(fileIds)-1)
+		if err != nil {
+			return err
+		}
+		if filePositions != nil {
+			positions[uint32(fid)] = filePositions
+		}
+	}
+	if err := migrateHintFile(dirPath, migratePath, positions); err != nil {
+		return err
+	}
+	if err := migrateSeqNoFile(dirPath, migratePath); err != nil {
+		return err
+	}
+	if err := migrateBPTreeIndex(dirPath, migratePath, positions); err != nil {
+		return err
+	}
+
+	//所有新文件都已经写完，放一个完成标识，内容是重写过的数据文件id，移动完以后删除它们的hint文件
+	finishedFile, err := os.Create(filepath.Join(migratePath, migrateFinishedKey))
+	if err != nil {
+		return err
+	}
+	var rewritten []string
+	for _, fid := range fileIds {
+		if positions[uint32(fid)] != nil {
+			rewritten = append(rewritten, strconv.Itoa(fid))
+		}
+	}
+	if _, err := finishedFile.WriteString(strings.Join(rewritten, "\n")); err != nil {
+		_ = finishedFile.Close()
+		return err
+	}
+	if err := finishedFile.Sync(); err != nil {
+		_ = finishedFile.Close()
+		return err
+	}
+	if err := finishedFile.Close(); err != nil {
+		return err
+	}
+	return finishMigrate(dirPath, migratePath)
+}
+
+// 重写一个数据文件，已经是当前格式的文件不需要重写，返回nil
+// 旧文件只读打开，空文件不会被写入文件头
+func migrateDataFile(dirPath, migratePath string, fileId uint32, isLast bool) (map[int64]*data.LogRecordPos, error) {
+	oldFile, err := data.OpenDataFileReadOnly(dirPath, fileId)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = oldFile.Close()
+	}()
+	if oldFile.Version == data.CurrentFileFormat {
+		return nil, nil
+	}
+	newFile, err := data.OpenDataFile(migratePath, fileId, fio.StandardFIO, DefaultOptions.Checksum, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = newFile.Close()
+	}()
+
+	positions := make(map[int64]*data.LogRecordPos)
+	offset := oldFile.HeaderSize()
+	for {
+		logRecord, size, err := oldFile.ReadLogRecord(offset)
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			//最后一个文件末尾崩溃时写了一半的记录直接丢弃
+			if isLast && isTornTail(oldFile, offset, err) {
+				break
+			}
+			return nil, err
+		}
+		encRecord, newSize := data.EncodeLogRecord(logRecord, newFile.Checksum)
+		positions[offset] = &data.LogRecordPos{Fid: fileId, Offset: newFile.WriteOff, Size: uint32(newSize)}
+		if err := newFile.Write(encRecord); err != nil {
+			return nil, err
+		}
+		offset += size
+	}
+	if err := newFile.Sync(); err != nil {
+		return nil, err
+	}
+	return positions, nil
+}
+
+// 重写hint文件，更新其中记录的位置
+func migrateHintFile(dirPath, migratePath string, positions map[uint32]map[int64]*data.LogRecordPos) error {
+	if _, err := os.Stat(filepath.Join(dirPath, data.HintFileName)); err != nil {
+		return nil
+	}
+	oldFile, err := data.OpenFileReadOnly(filepath.Join(dirPath, data.HintFileName), 0)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = oldFile.Close()
+	}()
+	newFile, err := data.OpenHintFile(migratePath, fio.StandardFIO, DefaultOptions.Checksum, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = newFile.Close()
+	}()
+
+	offset := oldFile.HeaderSize()
+	for {
+		logRecord, size, err := oldFile.ReadLogRecord(offset)
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return err
+		}
+		pos := data.DecodeLogRecordPos(logRecord.Value)
+		if newPos, ok := positions[pos.Fid][pos.Offset]; ok {
+			pos = newPos
+		}
+		if err := newFile.WriteHintRecord(logRecord.Key, pos); err != nil {
+			return err
+		}
+		offset += size
+	}
+	return newFile.Sync()
+}
+
+// 重写事务序列号文件
+func migrateSeqNoFile(dirPath, migratePath string) error {
+	if _, err := os.Stat(filepath.Join(dirPath, data.SeqNoFileName)); err != nil {
+		return nil
+	}
+	oldFile, err := data.OpenFileReadOnly(filepath.Join(dirPath, data.SeqNoFileName), 0)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = oldFile.Close()
+	}()
+	if oldFile.Version == data.CurrentFileFormat {
+		return nil
+	}
+	record, _, err := oldFile.ReadLogRecord(oldFile.HeaderSize())
+	if err != nil {
+		return err
+	}
+	newFile, err := data.OpenSeqNoFile(migratePath, fio.StandardFIO, DefaultOptions.Checksum, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = newFile.Close()
+	}()
+	encRecord, _ := data.EncodeLogRecord(record, newFile.Checksum)
+	if err := newFile.Write(encRecord); err != nil {
+		return err
+	}
+	return newFile.Sync()
+}
+
+// 拷贝一份b+树索引，更新其中记录的位置
+func migrateBPTreeIndex(dirPath, migratePath string, positions map[uint32]map[int64]*data.LogRecordPos) error {
+	indexFileName := filepath.Join(dirPath, index.BPTreeIndexFileName)
+	if _, err := os.Stat(indexFileName); err != nil {
+		return nil
+	}
+	if err := copyFile(indexFileName, filepath.Join(migratePath, index.BPTreeIndexFileName)); err != nil {
+		return err
+	}
+	bptree := index.NewBplusTree(migratePath, true)
+	defer func() {
+		_ = bptree.Close()
+	}()
+
+	//先取出所有需要更新的位置，遍历时不能写入
+	var keys [][]byte
+	var newPositions []*data.LogRecordPos
+	it := bptree.Iterator(false)
+	for it.Rewind(); it.Valid(); it.Next() {
+		pos := it.Value()
+		if newPos, ok := positions[pos.Fid][pos.Offset]; ok {
+			//key指向事务内的内存，关闭迭代器以后就失效了，需要拷贝
+			keys = append(keys, append([]byte{}, it.Key()...))
+			newPositions = append(newPositions, newPos)
+		}
+	}
+	it.Close()
+	for i, key := range keys {
+		bptree.Put(key, newPositions[i])
+	}
+	return nil
+}
+
+// 把migrate目录中的新文件移动到数据目录，全部移动完以后删除过期的hint文件和索引快照
+// 中途崩溃时完成标识还在，再次执行会继续移动剩下的文件，删除也可以重复执行
+func finishMigrate(dirPath, migratePath string) error {
+	finished, err := os.ReadFile(filepath.Join(migratePath, migrateFinishedKey))
+	if err != nil {
+		return err
+	}
+	entries, err := os.ReadDir(migratePath)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if entry.Name() == migrateFinishedKey || entry.Name() == fileLockName {
+			continue
+		}
+		if err := os.Rename(filepath.Join(migratePath, entry.Name()), filepath.Join(dirPath, entry.Name())); err != nil {
+			return err
+		}
+	}
+	//重写以后记录的位置会变化，索引快照不能再使用
+	if err := os.Remove(filepath.Join(dirPath, data.IndexCheckpointName)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	//重写过的数据文件的hint文件也不能再使用，删除以后启动时会重新生成
+	for _, field := range strings.Fields(string(finished)) {
+		fileId, err := strconv.Atoi(field)
+		if err != nil {
+			return ErrDataDirectoryCorrupted
+		}
+		if err := os.Remove(data.GetDataHintFileName(dirPath, uint32(fileId))); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return os.RemoveAll(migratePath)
+}
+
+func migrateDirPath(dirPath string) string {
+	dir := filepath.Dir(filepath.Clean(dirPath))
+	base := filepath.Base(dirPath)
+	return filepath.Join(dir, base+migrateDirName)
+}
+
+func copyFile(src, dest string) error {
+	srcFile, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = srcFile.Close()
+	}()
+	destFile, err := os.OpenFile(dest, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, fio.DataFilePerm)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(destFile, srcFile); err != nil {
+		_ = destFile.Close()
+		return err
+	}
+	if err := destFile.Sync(); err != nil {
+		_ = destFile.Close()
+		return err
+	}
+	return destFile.Close()
+}
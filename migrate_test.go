@@ -0,0 +1,172 @@
+package lovedb
+
+import (
+	"encoding/binary"
+	"github.com/stretchr/testify/assert"
+	"hash/crc32"
+	"lovedb/data"
+	"lovedb/fio"
+	"lovedb/index"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// 按照v1格式编码记录：没有标志位、时间和序列号，序列号编码在key的前面
+func encodeLogRecordV1(key, value []byte, typ data.LogRecordType, seqNo uint64) []byte {
+	key = LogRecordKeyWithSeq(key, seqNo)
+	buf := make([]byte, 5+binary.MaxVarintLen32*2+len(key)+len(value))
+	buf[4] = typ
+	index := 5
+	index += binary.PutVarint(buf[index:], int64(len(key)))
+	index += binary.PutVarint(buf[index:], int64(len(value)))
+	index += copy(buf[index:], key)
+	index += copy(buf[index:], value)
+	binary.LittleEndian.PutUint32(buf[:4], crc32.ChecksumIEEE(buf[4:index]))
+	return buf[:index]
+}
+
+// 写一个v1格式的数据目录，返回每个key最新记录的位置
+func writeV1DataFile(t *testing.T, dir string) map[string]*data.LogRecordPos {
+	file, err := os.Create(data.GetDataFileName(dir, 0))
+	assert.Nil(t, err)
+	defer func() {
+		_ = file.Close()
+	}()
+	positions := make(map[string]*data.LogRecordPos)
+	var offset int64
+	write := func(key, value []byte, typ data.LogRecordType, seqNo uint64) {
+		record := encodeLogRecordV1(key, value, typ, seqNo)
+		_, err := file.Write(record)
+		assert.Nil(t, err)
+		if typ == data.LogRecordNormal {
+			positions[string(key)] = &data.LogRecordPos{Fid: 0, Offset: offset, Size: uint32(len(record))}
+		}
+		offset += int64(len(record))
+	}
+	for i := 0; i < 100; i++ {
+		write(testKey(i), testValue(i), data.LogRecordNormal, nonTxSeqNo)
+	}
+	write(testKey(0), nil, data.LogRecordDeleted, nonTxSeqNo)
+	delete(positions, string(testKey(0)))
+	//提交完成的事务
+	write(testKey(100), testValue(100), data.LogRecordNormal, 1)
+	write(txnFinKey, nil, data.LogRecordFinished, 1)
+	return positions
+}
+
+func checkMigratedDB(t *testing.T, opts Options) {
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	defer func() {
+		assert.Nil(t, db.Close())
+	}()
+	_, err = db.Get(testKey(0))
+	assert.Equal(t, ErrKeyNotFound, err)
+	for i := 1; i <= 101; i++ {
+		val, err := db.Get(testKey(i))
+		assert.Nil(t, err)
+		assert.Equal(t, testValue(i), val)
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	opts := DefaultOptions
+	opts.DirPath = filepath.Join(t.TempDir(), "lovedb")
+	assert.Nil(t, os.MkdirAll(opts.DirPath, os.ModePerm))
+	writeV1DataFile(t, opts.DirPath)
+
+	//不迁移也可以读取v1文件，新的数据写到新格式的文件中
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	assert.Nil(t, db.Put(testKey(101), testValue(101)))
+	assert.Equal(t, data.FileFormatV1, db.olderFiles[0].Version)
+	assert.Equal(t, uint32(1), db.activeFile.FileId)
+	assert.Equal(t, data.CurrentFileFormat, db.activeFile.Version)
+	assert.Equal(t, uint64(1), db.seqNo)
+	assert.Nil(t, db.Close())
+	checkMigratedDB(t, opts)
+
+	//数据库打开时不能迁移
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, ErrDatabaseIsUsing, Migrate(opts.DirPath))
+	assert.Nil(t, db.Close())
+
+	assert.Nil(t, Migrate(opts.DirPath))
+	_, err = os.Stat(migrateDirPath(opts.DirPath))
+	assert.True(t, os.IsNotExist(err))
+	dataFile, err := data.OpenDataFile(opts.DirPath, 0, fio.StandardFIO, opts.Checksum, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, data.CurrentFileFormat, dataFile.Version)
+	assert.Nil(t, dataFile.Close())
+	checkMigratedDB(t, opts)
+
+	//再次迁移什么也不做
+	assert.Nil(t, Migrate(opts.DirPath))
+	checkMigratedDB(t, opts)
+}
+
+func TestMigrate_BPTree(t *testing.T) {
+	opts := DefaultOptions
+	opts.DirPath = filepath.Join(t.TempDir(), "lovedb")
+	opts.IndexType = index.BPTree
+	assert.Nil(t, os.MkdirAll(opts.DirPath, os.ModePerm))
+	positions := writeV1DataFile(t, opts.DirPath)
+	//b+树索引中保存的是v1文件中的位置
+	bptree := index.NewBplusTree(opts.DirPath, true)
+	for key, pos := range positions {
+		bptree.Put([]byte(key), pos)
+	}
+	assert.Nil(t, bptree.Close())
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	assert.Nil(t, db.Put(testKey(101), testValue(101)))
+	assert.Nil(t, db.Close())
+
+	assert.Nil(t, Migrate(opts.DirPath))
+	checkMigratedDB(t, opts)
+}
+
+func TestMigrate_Unfinished(t *testing.T) {
+	opts := DefaultOptions
+	opts.DirPath = filepath.Join(t.TempDir(), "lovedb")
+	assert.Nil(t, os.MkdirAll(opts.DirPath, os.ModePerm))
+	writeV1DataFile(t, opts.DirPath)
+
+	//旧的hint文件，迁移完成之前不能删除
+	hintFileName := data.GetDataHintFileName(opts.DirPath, 0)
+	assert.Nil(t, os.WriteFile(hintFileName, nil, fio.DataFilePerm))
+	//空的数据文件只读打开，不会写入文件头
+	assert.Nil(t, os.WriteFile(data.GetDataFileName(opts.DirPath, 1), nil, fio.DataFilePerm))
+
+	//模拟新文件已经写完，还没有移动就崩溃了
+	migratePath := migrateDirPath(opts.DirPath)
+	assert.Nil(t, os.MkdirAll(migratePath, os.ModePerm))
+	positions, err := migrateDataFile(opts.DirPath, migratePath, 0, false)
+	assert.Nil(t, err)
+	assert.NotNil(t, positions)
+	positions, err = migrateDataFile(opts.DirPath, migratePath, 1, true)
+	assert.Nil(t, err)
+	assert.Nil(t, positions)
+	info, err := os.Stat(data.GetDataFileName(opts.DirPath, 1))
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), info.Size())
+	_, err = os.Stat(hintFileName)
+	assert.Nil(t, err)
+	assert.Nil(t, os.WriteFile(filepath.Join(migratePath, migrateFinishedKey), []byte("0"), fio.DataFilePerm))
+	_, err = Open(opts)
+	assert.Equal(t, ErrMigrateUnfinished, err)
+
+	//再次迁移完成移动，删除重写过的数据文件的hint文件
+	assert.Nil(t, Migrate(opts.DirPath))
+	_, err = os.Stat(hintFileName)
+	assert.True(t, os.IsNotExist(err))
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, data.CurrentFileFormat, db.activeFile.Version)
+	val, err := db.Get(testKey(100))
+	assert.Nil(t, err)
+	assert.Equal(t, testValue(100), val)
+	assert.Nil(t, db.Close())
+}
@@ -0,0 +1,184 @@
+package lovedb
+
+import (
+	"bytes"
+	"context"
+	"lovedb/data"
+	"lovedb/index"
+	"math/rand"
+	"runtime"
+	"sort"
+	"sync"
+	"time"
+)
+
+// 每个worker平均分到的范围数量，范围分得更细一些，扫描快的worker可以多处理几个范围
+const parallelFoldRangesPerWorker = 4
+
+// 无序的索引每个范围抽取的key数量，抽出的key排序以后等间隔地选出边界
+const splitSamplesPerRange = 32
+
+// KeyRange 一个key的范围[Start, End)
+type KeyRange struct {
+	Start []byte //包含，为nil表示没有下界
+	End   []byte //不包含，为nil表示没有上界
+}
+
+// SplitRanges 把所有的key分成最多n个数量大致相等的范围，范围之间首尾相接，覆盖所有的key，之后写入的key也一定落在某个范围内
+// 只保存边界上的key，不会复制整个索引：有序的索引按顺序遍历，每隔size/n个key取一个边界；
+// 哈希索引随机抽取n*32个key，排序以后等间隔地选出边界，每个范围的key数量是估计的，和size/n的偏差的标准差大约是18%
+func (db *DB) SplitRanges(n int) []KeyRange {
+	size := db.index.Size()
+	if n > size {
+		n = size
+	}
+	if n <= 1 {
+		return []KeyRange{{}}
+	}
+
+	bounds := db.splitBounds(n, size)
+	ranges := make([]KeyRange, 0, len(bounds)+1)
+	var start []byte
+	for _, bound := range bounds {
+		ranges = append(ranges, KeyRange{Start: start, End: bound})
+		start = bound
+	}
+	return append(ranges, KeyRange{Start: start})
+}
+
+// 选出把所有key分成n份的n-1个边界，边界严格递增
+func (db *DB) splitBounds(n, size int) [][]byte {
+	bounds := make([][]byte, 0, n-1)
+	//第i个边界是第i*size/n个key
+	var idx int
+	visit := func(key []byte) bool {
+		if idx == (len(bounds)+1)*size/n {
+			//b+树迭代器的key只在事务中有效，需要拷贝
+			bounds = append(bounds, append([]byte{}, key...))
+		}
+		idx++
+		return len(bounds) < n-1
+	}
+
+	switch indexer := db.index.(type) {
+	case index.Ascender:
+		indexer.Ascend(nil, func(key []byte, _ *data.LogRecordPos) bool {
+			return visit(key)
+		})
+	case index.Sampler:
+		sample := indexer.SampleKeys(n*splitSamplesPerRange, rand.New(rand.NewSource(time.Now().UnixNano())))
+		sort.Slice(sample, func(i, j int) bool {
+			return bytes.Compare(sample[i], sample[j]) < 0
+		})
+		for i := 1; i < n; i++ {
+			bound := sample[i*len(sample)/n]
+			//样本比较少时相邻的边界可能相同，跳过空的范围
+			if len(bounds) > 0 && bytes.Equal(bounds[len(bounds)-1], bound) {
+				continue
+			}
+			bounds = append(bounds, bound)
+		}
+	default:
+		//其余索引的迭代器不会复制所有的key
+		it := db.index.Iterator(false)
+		for it.Rewind(); it.Valid() && visit(it.Key()); it.Next() {
+		}
+		it.Close()
+	}
+	return bounds
+}
+
+// ParallelFold 用workers个协程并发遍历所有的数据，workers不大于0时使用CPU的核数
+// fn会被并发调用，返回错误时停止所有的worker并返回这个错误，ctx取消时返回ctx.Err()
+// 和Fold一样，遍历期间持有读锁，fn中不能调用db的方法：写入和Get都需要获取写锁，会一直阻塞
+// 需要读取其他key时，先把key收集起来，ParallelFold返回以后再读取
+// 每个worker一次只遍历一个范围，内存索引只复制这个范围内的key
+func (db *DB) ParallelFold(ctx context.Context, workers int, fn func(key []byte, value []byte) error) error {
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var (
+		wg       sync.WaitGroup
+		errOnce  sync.Once
+		firstErr error
+	)
+	rangeCh := make(chan KeyRange)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for keyRange := range rangeCh {
+				if err := db.foldRange(ctx, keyRange, fn); err != nil {
+					//第一个错误取消其他的worker
+					errOnce.Do(func() {
+						firstErr = err
+						cancel()
+					})
+					return
+				}
+			}
+		}()
+	}
+
+feed:
+	for _, keyRange := range db.SplitRanges(workers * parallelFoldRangesPerWorker) {
+		select {
+		case rangeCh <- keyRange:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(rangeCh)
+	wg.Wait()
+
+	if firstErr != nil {
+		return firstErr
+	}
+	return ctx.Err()
+}
+
+// 返回遍历[start, end)的索引迭代器，已经位于start，调用方需要自己判断end
+// 内存索引只复制范围内的key，b+树等索引的迭代器本身不复制key
+func (db *DB) rangeIterator(start, end []byte) index.Iterator {
+	var it index.Iterator
+	if rangeIndexer, ok := db.index.(index.RangeIndexer); ok {
+		it = rangeIndexer.RangeIterator(start, end, false)
+	} else {
+		it = db.index.Iterator(false)
+	}
+	if start != nil {
+		it.Seek(start)
+	} else {
+		it.Rewind()
+	}
+	return it
+}
+
+// 遍历一个范围内的数据，需要在持有锁的情况下调用
+func (db *DB) foldRange(ctx context.Context, keyRange KeyRange, fn func(key []byte, value []byte) error) error {
+	it := db.rangeIterator(keyRange.Start, keyRange.End)
+	defer it.Close()
+	for ; it.Valid(); it.Next() {
+		if keyRange.End != nil && bytes.Compare(it.Key(), keyRange.End) >= 0 {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+		value, err := db.getValueByPos(it.Value())
+		if err != nil {
+			return err
+		}
+		if err := fn(it.Key(), value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
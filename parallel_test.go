@@ -0,0 +1,129 @@
+package lovedb
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"lovedb/index"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestDB_SplitRanges(t *testing.T) {
+	t.Parallel()
+	db, _ := openInMemoryDB(t)
+	defer func() {
+		assert.Nil(t, db.Close())
+	}()
+	assert.Equal(t, []KeyRange{{}}, db.SplitRanges(4))
+
+	for i := 0; i < 10000; i++ {
+		assert.Nil(t, db.Put(testKey(i), testValue(i)))
+	}
+	ranges := db.SplitRanges(8)
+	assert.Equal(t, 8, len(ranges))
+	assert.Nil(t, ranges[0].Start)
+	assert.Nil(t, ranges[7].End)
+	for i, keyRange := range ranges {
+		if i > 0 {
+			assert.Equal(t, ranges[i-1].End, keyRange.Start)
+		}
+		var count int
+		for _, key := range db.ListKeys() {
+			if (keyRange.Start == nil || bytes.Compare(key, keyRange.Start) >= 0) &&
+				(keyRange.End == nil || bytes.Compare(key, keyRange.End) < 0) {
+				count++
+			}
+		}
+		assert.Equal(t, 1250, count)
+	}
+	assert.Equal(t, 1, len(db.SplitRanges(1)))
+}
+
+func TestDB_SplitRanges_Hash(t *testing.T) {
+	opts := DefaultOptions
+	opts.DirPath = filepath.Join(t.TempDir(), "lovedb")
+	opts.IndexType = index.Hash
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	defer func() {
+		assert.Nil(t, db.Close())
+	}()
+	for i := 0; i < 10000; i++ {
+		assert.Nil(t, db.Put(testKey(i), testValue(i)))
+	}
+	//哈希索引的边界是抽样得到的，范围首尾相接覆盖所有的key，数量大致相等
+	ranges := db.SplitRanges(8)
+	assert.True(t, len(ranges) > 1 && len(ranges) <= 8)
+	assert.Nil(t, ranges[0].Start)
+	assert.Nil(t, ranges[len(ranges)-1].End)
+	keys := db.ListKeys()
+	var total int
+	for i, keyRange := range ranges {
+		if i > 0 {
+			assert.Equal(t, ranges[i-1].End, keyRange.Start)
+			assert.True(t, bytes.Compare(keyRange.Start, ranges[i-1].Start) > 0)
+		}
+		var count int
+		for _, key := range keys {
+			if (keyRange.Start == nil || bytes.Compare(key, keyRange.Start) >= 0) &&
+				(keyRange.End == nil || bytes.Compare(key, keyRange.End) < 0) {
+				count++
+			}
+		}
+		assert.True(t, count > 0 && count < 10000/2)
+		total += count
+	}
+	assert.Equal(t, 10000, total)
+}
+
+func TestDB_ParallelFold(t *testing.T) {
+	for _, typ := range []index.IndexerType{index.BTree, index.ART, index.BPTree, index.SkipList, index.Hash, index.Compact} {
+		opts := DefaultOptions
+		opts.DirPath = filepath.Join(t.TempDir(), "lovedb")
+		opts.DataFileSize = 64 * 1024
+		opts.IndexType = typ
+		db, err := Open(opts)
+		assert.Nil(t, err)
+		for i := 0; i < 3000; i++ {
+			assert.Nil(t, db.Put(testKey(i), testValue(i)))
+		}
+
+		var mu sync.Mutex
+		values := make(map[string][]byte)
+		err = db.ParallelFold(context.Background(), 4, func(key []byte, value []byte) error {
+			mu.Lock()
+			defer mu.Unlock()
+			_, ok := values[string(key)]
+			assert.False(t, ok)
+			values[string(key)] = value
+			return nil
+		})
+		assert.Nil(t, err)
+		assert.Equal(t, 3000, len(values))
+		assert.Equal(t, testValue(2999), values[string(testKey(2999))])
+
+		//一个worker出错时其他的worker也会停止
+		errStop := errors.New("stop")
+		var count atomic.Int64
+		err = db.ParallelFold(context.Background(), 4, func(key []byte, value []byte) error {
+			if count.Add(1) == 100 {
+				return errStop
+			}
+			return nil
+		})
+		assert.Equal(t, errStop, err)
+		assert.True(t, count.Load() < 3000)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		err = db.ParallelFold(ctx, 0, func(key []byte, value []byte) error {
+			return nil
+		})
+		assert.Equal(t, context.Canceled, err)
+		assert.Nil(t, db.Close())
+	}
+}
@@ -0,0 +1,278 @@
+package lovedb
+
+import (
+	"io"
+	"lovedb/data"
+	"lovedb/fio"
+	"lovedb/index"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	indexTypeKey   = "index.type"
+	reindexDirName = "-reindex"
+)
+
+// 数据目录中记录的索引类型名称
+var indexTypeNames = map[index.IndexerType]string{
+	index.BTree:    "btree",
+	index.ART:      "art",
+	index.BPTree:   "bptree",
+	index.SkipList: "skiplist",
+	index.Hash:     "hash",
+	index.Compact:  "compact",
+}
+
+// IndexTypeNames 所有索引类型的名称，按照索引类型排序，ParseIndexType可以解析这些名称
+func IndexTypeNames() []string {
+	types := make([]index.IndexerType, 0, len(indexTypeNames))
+	for typ := range indexTypeNames {
+		types = append(types, typ)
+	}
+	sort.Slice(types, func(i, j int) bool {
+		return types[i] < types[j]
+	})
+	names := make([]string, len(types))
+	for i, typ := range types {
+		names[i] = indexTypeNames[typ]
+	}
+	return names
+}
+
+// ParseIndexType 根据名称解析索引类型，例如btree、art、bptree
+func ParseIndexType(name string) (index.IndexerType, error) {
+	for typ, typName := range indexTypeNames {
+		if strings.EqualFold(typName, name) {
+			return typ, nil
+		}
+	}
+	return 0, ErrUnsupportedIndexType
+}
+
+// Reindex 离线切换数据目录的索引类型，数据库不能处于打开状态
+// 切换到b+树索引时从数据文件和hint文件重新生成b+树索引文件，切换到内存索引时删除b+树索引文件，
+// 最后在数据目录中记录新的索引类型，之后需要用对应的索引类型打开数据库
+func Reindex(dirPath string, to index.IndexerType) error {
+	if _, ok := indexTypeNames[to]; !ok {
+		return ErrUnsupportedIndexType
+	}
+	if _, err := os.Stat(dirPath); err != nil {
+		return err
+	}
+	unlockDir, err := fio.OSFileSystem.TryLock(filepath.Join(dirPath, fileLockName))
+	if err != nil {
+		return err
+	}
+	if unlockDir == nil {
+		return ErrDatabaseIsUsing
+	}
+	defer func() {
+		_ = unlockDir()
+	}()
+	if _, err := os.Stat(filepath.Join(migrateDirPath(dirPath), migrateFinishedKey)); err == nil {
+		return ErrMigrateUnfinished
+	}
+
+	options := DefaultOptions
+	options.DirPath = dirPath
+	options.IndexType = to
+	indexFileName := filepath.Join(dirPath, index.BPTreeIndexFileName)
+	if to != index.BPTree {
+		//先记录新的索引类型，之后残留的b+树索引文件会被忽略
+		if err := writeIndexType(options, fio.OSFileSystem); err != nil {
+			return err
+		}
+		if err := os.Remove(indexFileName); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+
+	//新的b+树索引先生成在 <dir>-reindex 目录中，完整写完以后再替换旧的索引文件
+	reindexPath := filepath.Join(filepath.Dir(filepath.Clean(dirPath)), filepath.Base(dirPath)+reindexDirName)
+	if err := os.RemoveAll(reindexPath); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(reindexPath, os.ModePerm); err != nil {
+		return err
+	}
+	defer func() {
+		_ = os.RemoveAll(reindexPath)
+	}()
+	if err := buildBPTreeIndex(options, reindexPath); err != nil {
+		return err
+	}
+	//替换期间没有记录时根据目录中的文件推断索引类型，旧的和新的b+树索引文件都是完整的
+	if err := os.Remove(filepath.Join(dirPath, data.IndexTypeFileName)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Rename(filepath.Join(reindexPath, index.BPTreeIndexFileName), indexFileName); err != nil {
+		return err
+	}
+	return writeIndexType(options, fio.OSFileSystem)
+}
+
+// 用内存索引加载数据目录，再把所有的key写入到indexPath目录下新的b+树索引中
+func buildBPTreeIndex(options Options, indexPath string) error {
+	memOptions := options
+	memOptions.IndexType = index.BTree
+	//调用方已经持有目录锁
+	db, err := openDB(memOptions, fio.OSFileSystem, func() error { return nil })
+	if err != nil {
+		return err
+	}
+	bptree := index.NewBplusTree(indexPath, false)
+	//分批写入，每批是一个bbolt事务，最后一批和事务序列号一起写入
+	var ops []index.BatchOp
+	it := db.index.Iterator(false)
+	for it.Rewind(); it.Valid(); it.Next() {
+		ops = append(ops, index.BatchOp{Key: it.Key(), Pos: it.Value()})
+		if len(ops) == hintBatchSize {
+			if _, err := bptree.ApplyBatch(ops, 0); err != nil {
+				it.Close()
+				_ = bptree.Close()
+				_ = db.Close()
+				return err
+			}
+			ops = ops[:0]
+		}
+	}
+	it.Close()
+	if _, err := bptree.ApplyBatch(ops, db.seqNo); err != nil {
+		_ = bptree.Close()
+		_ = db.Close()
+		return err
+	}
+	if err := bptree.Close(); err != nil {
+		_ = db.Close()
+		return err
+	}
+	if err := db.Close(); err != nil {
+		return err
+	}
+	//生成时没有每次写入都sync，最后整体持久化一次
+	return syncFile(filepath.Join(indexPath, index.BPTreeIndexFileName))
+}
+
+// 检查数据目录记录的索引类型
+// 内存索引之间可以直接切换，每次启动都会重新生成；b+树索引和内存索引之间切换需要先执行Reindex，
+// 否则b+树索引中没有数据，或者切换回来时使用了过期的b+树索引
+func checkIndexType(options Options, fs fio.FileSystem) error {
+	typ, recorded, err := readIndexType(options, fs)
+	if err != nil {
+		return err
+	}
+	if !recorded {
+		if typ, err = guessIndexType(options, fs); err != nil {
+			return err
+		}
+	}
+	if typ != 0 && (typ == index.BPTree) != (options.IndexType == index.BPTree) {
+		return ErrIndexTypeMismatch
+	}
+	if recorded && typ == options.IndexType {
+		return nil
+	}
+	return writeIndexType(options, fs)
+}
+
+// 读取数据目录记录的索引类型，没有记录时返回false
+func readIndexType(options Options, fs fio.FileSystem) (index.IndexerType, bool, error) {
+	fileName := filepath.Join(options.DirPath, data.IndexTypeFileName)
+	if !fs.Exists(fileName) {
+		return 0, false, nil
+	}
+	typeFile, err := data.OpenIndexTypeFile(options.DirPath, indexTypeFileIOType(options), options.Checksum, options.IOOpener)
+	if err != nil {
+		return 0, false, err
+	}
+	defer func() {
+		_ = typeFile.Close()
+	}()
+	logRecord, _, err := typeFile.ReadLogRecord(typeFile.HeaderSize())
+	if err != nil {
+		//写了一半就崩溃了，和没有记录一样处理
+		if err == io.EOF || isCorruptRecord(err) {
+			return 0, false, nil
+		}
+		return 0, false, err
+	}
+	typ, err := ParseIndexType(string(logRecord.Value))
+	if err != nil {
+		return 0, false, ErrDataDirectoryCorrupted
+	}
+	return typ, true, nil
+}
+
+// 之前的版本没有记录索引类型，根据目录中的文件推断，有数据文件时b+树索引会留下索引文件
+// 没有数据文件的新目录返回0
+func guessIndexType(options Options, fs fio.FileSystem) (index.IndexerType, error) {
+	fileNames, err := fs.ReadDir(options.DirPath)
+	if err != nil {
+		return 0, err
+	}
+	var hasDataFile, hasBPTreeIndex bool
+	for _, name := range fileNames {
+		if strings.HasSuffix(name, data.DataFileNameSuffix) {
+			hasDataFile = true
+		}
+		if name == index.BPTreeIndexFileName {
+			hasBPTreeIndex = true
+		}
+	}
+	if !hasDataFile {
+		return 0, nil
+	}
+	if hasBPTreeIndex {
+		return index.BPTree, nil
+	}
+	return index.BTree, nil
+}
+
+// 在数据目录中记录options中的索引类型
+func writeIndexType(options Options, fs fio.FileSystem) error {
+	fileName := filepath.Join(options.DirPath, data.IndexTypeFileName)
+	if fs.Exists(fileName) {
+		if err := fs.Remove(fileName); err != nil {
+			return err
+		}
+	}
+	typeFile, err := data.OpenIndexTypeFile(options.DirPath, indexTypeFileIOType(options), options.Checksum, options.IOOpener)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = typeFile.Close()
+	}()
+	logRecord := &data.LogRecord{
+		Key:   []byte(indexTypeKey),
+		Value: []byte(indexTypeNames[options.IndexType]),
+	}
+	encRecord, _ := data.EncodeLogRecord(logRecord, typeFile.Checksum)
+	if err := typeFile.Write(encRecord); err != nil {
+		return err
+	}
+	return typeFile.Sync()
+}
+
+func indexTypeFileIOType(options Options) fio.FileIOType {
+	if options.InMemory {
+		return fio.MemoryIO
+	}
+	return fio.StandardFIO
+}
+
+func syncFile(name string) error {
+	file, err := os.OpenFile(name, os.O_RDWR, fio.DataFilePerm)
+	if err != nil {
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		_ = file.Close()
+		return err
+	}
+	return file.Close()
+}
@@ -0,0 +1,113 @@
+package lovedb
+
+import (
+	"github.com/stretchr/testify/assert"
+	"lovedb/data"
+	"lovedb/index"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func checkReindexedDB(t *testing.T, opts Options) {
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	defer func() {
+		assert.Nil(t, db.Close())
+	}()
+	assert.Equal(t, uint64(1), db.seqNo)
+	assert.Equal(t, 900, len(db.ListKeys()))
+	for i := 0; i < 1000; i++ {
+		val, err := db.Get(testKey(i))
+		if i < 100 {
+			assert.Equal(t, ErrKeyNotFound, err)
+			continue
+		}
+		assert.Nil(t, err)
+		assert.Equal(t, testValue(i), val)
+	}
+}
+
+func TestReindex(t *testing.T) {
+	opts := DefaultOptions
+	opts.DirPath = filepath.Join(t.TempDir(), "lovedb")
+	opts.DataFileSize = 32 * 1024
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	for i := 0; i < 900; i++ {
+		assert.Nil(t, db.Put(testKey(i), testValue(i)))
+	}
+	wb := db.NewWriteBatch(DefaultWriteBatchOptions)
+	for i := 900; i < 1000; i++ {
+		assert.Nil(t, wb.Put(testKey(i), testValue(i)))
+	}
+	assert.Nil(t, wb.Commit())
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, db.Delete(testKey(i)))
+	}
+	//打开时不能切换索引类型
+	assert.Equal(t, ErrDatabaseIsUsing, Reindex(opts.DirPath, index.BPTree))
+	assert.Nil(t, db.Close())
+
+	//内存索引之间可以直接切换
+	opts.IndexType = index.ART
+	checkReindexedDB(t, opts)
+
+	//b+树索引中没有数据，不能直接打开
+	opts.IndexType = index.BPTree
+	_, err = Open(opts)
+	assert.Equal(t, ErrIndexTypeMismatch, err)
+
+	assert.Nil(t, Reindex(opts.DirPath, index.BPTree))
+	checkReindexedDB(t, opts)
+	_, err = os.Stat(opts.DirPath + reindexDirName)
+	assert.True(t, os.IsNotExist(err))
+
+	//切换回内存索引之前不能使用过期的b+树索引
+	opts.IndexType = index.BTree
+	_, err = Open(opts)
+	assert.Equal(t, ErrIndexTypeMismatch, err)
+	assert.Nil(t, Reindex(opts.DirPath, index.BTree))
+	_, err = os.Stat(filepath.Join(opts.DirPath, index.BPTreeIndexFileName))
+	assert.True(t, os.IsNotExist(err))
+	checkReindexedDB(t, opts)
+}
+
+func TestReindex_Unrecorded(t *testing.T) {
+	opts := DefaultOptions
+	opts.DirPath = filepath.Join(t.TempDir(), "lovedb")
+	opts.IndexType = index.BPTree
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	assert.Nil(t, db.Put(testKey(1), testValue(1)))
+	assert.Nil(t, db.Close())
+
+	//之前的版本没有记录索引类型，有b+树索引文件时认为是b+树索引
+	assert.Nil(t, os.Remove(filepath.Join(opts.DirPath, data.IndexTypeFileName)))
+	opts.IndexType = index.BTree
+	_, err = Open(opts)
+	assert.Equal(t, ErrIndexTypeMismatch, err)
+	opts.IndexType = index.BPTree
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	assert.Nil(t, db.Close())
+	_, err = os.Stat(filepath.Join(opts.DirPath, data.IndexTypeFileName))
+	assert.Nil(t, err)
+}
+
+func TestParseIndexType(t *testing.T) {
+	typ, err := ParseIndexType("BPTree")
+	assert.Nil(t, err)
+	assert.Equal(t, index.BPTree, typ)
+	_, err = ParseIndexType("lsm")
+	assert.Equal(t, ErrUnsupportedIndexType, err)
+	assert.Equal(t, ErrUnsupportedIndexType, Reindex(t.TempDir(), 0))
+
+	//命令行用法中列出的名称都可以解析
+	names := IndexTypeNames()
+	assert.Equal(t, []string{"btree", "art", "bptree", "skiplist", "hash", "compact"}, names)
+	for _, name := range names {
+		_, err := ParseIndexType(name)
+		assert.Nil(t, err)
+	}
+}
@@ -1,6 +1,12 @@
 package lovedb
 
-import "lovedb/index"
+import (
+	"lovedb/data"
+	"lovedb/fio"
+	"lovedb/index"
+	"runtime"
+	"time"
+)
 
 // 索引类型选择
 
@@ -15,6 +21,15 @@ const (
 
 	// BPTree B+树索引类型
 	BPTree
+
+	// SkipList 并发跳表索引
+	SkipList
+
+	// Hash 分片哈希表索引
+	Hash
+
+	// Compact 内存紧凑的索引
+	Compact
 )
 
 // Options 配置文件，数据库启动，用户传递过去的配置信息
@@ -39,6 +54,57 @@ type Options struct {
 
 	//数据文件合并的阈值(无效数据占的比例为多少)
 	DataFileMergeRatio float32
+
+	//是否使用直接IO(O_DIRECT)读写数据文件，绕过操作系统的页缓存
+	DirectIO bool
+
+	//新建活跃文件时是否按DataFileSize预分配磁盘空间，避免每次追加写都更新文件系统元数据
+	PreAllocate bool
+
+	//活跃文件写缓冲区的大小，为0表示不开启写缓冲，每次写入都直接写到文件
+	//缓冲区中的数据在写入文件之前进程崩溃就会丢失，持久化仍然由SyncWrite、BytesPerSync和Sync保证
+	WriteBufferSize int
+
+	//定时把写缓冲区写入文件的间隔，为0表示只在缓冲区满、Sync和Close时写入
+	WriteBufferFlushInterval time.Duration
+
+	//是否为纯内存模式，所有文件都保存在进程内的内存文件系统中，不会访问磁盘
+	//同一个DirPath重新打开可以读到之前的数据，Close不会释放内存，不再使用时调用 DB.Destroy 删除数据，不支持B+树索引
+	InMemory bool
+
+	//value缓存占用内存的上限，字节为单位，为0表示不开启缓存
+	//读取和写入的value会按照LRU缓存在内存中，命中时不需要再读文件和校验crc
+	ValueCacheSize int64
+
+	//PutReader写入大value时每一块的大小，不超过这个大小的value直接写成一条记录
+	ValueChunkSize int64
+
+	//新建文件时记录使用的校验算法，保存在文件头中，已有的文件仍然使用原来的算法
+	Checksum data.ChecksumType
+
+	//Get、Fold和迭代器读取value时是否跳过crc校验，存储介质可信时可以减少读取的开销
+	//启动时加载索引、Verify和Merge总是会校验crc
+	SkipChecksumOnRead bool
+
+	//启动时并发读取数据文件和hint文件加载索引的文件数量，读取的结果仍然按照文件id的顺序更新到索引
+	IndexLoadParallelism int
+
+	//关闭时是否写入内存索引的快照，下次启动时只需要读取快照之后写入的记录，b+树索引不需要快照
+	IndexCheckpoint bool
+
+	//定时写入内存索引快照的间隔，为0表示只在关闭时写入，写入期间会阻塞写操作
+	IndexCheckpointInterval time.Duration
+
+	//存储引擎内部事件的回调，例如活跃文件切换、持久化完成、merge开始和结束，为nil表示不需要回调
+	EventListener EventListener
+
+	//分级别的日志，例如启动和恢复的汇总、merge的结果、活跃文件切换，为nil表示不输出日志
+	//可以用NewStdLogger输出到标准库的log
+	Logger Logger
+
+	//打开数据目录中文件的IO的方式，为nil表示使用fio.NewIOManager，merge时的临时实例也会使用
+	//可以在打开时包装IO，比如测试崩溃恢复时用fio.FaultInjector注入故障
+	IOOpener fio.IOOpener
 }
 
 type IteratorOptions struct {
@@ -46,6 +112,16 @@ type IteratorOptions struct {
 	Prefix []byte
 	// 是否反向遍历，默认 false 是正向
 	Reverse bool
+	// 遍历的下界，包含这个key，为nil时没有下界
+	LowerBound []byte
+	// 遍历的上界，不包含这个key，为nil时没有上界
+	UpperBound []byte
+	// 只遍历key，Value 返回 ErrIteratorKeysOnly，不会读取数据文件
+	KeysOnly bool
+	// 每次 Rewind 或 Seek 以后最多遍历的key的数量，0表示不限制
+	Limit int
+	// 上一次遍历时 Iterator.Continuation 返回的token，Rewind 时从token记录的位置继续遍历，token之前的key不在迭代器的范围内
+	Continuation []byte
 }
 
 // WriteBatchOption 批量写配置项
@@ -57,13 +133,23 @@ type WriteBatchOption struct {
 }
 
 var DefaultOptions = Options{
-	DirPath:            "D:\\git_space\\lovedb\\tmp",
-	DataFileSize:       256 * 1024 * 1024, //256MB
-	SyncWrite:          false,
-	BytesPerSync:       0,
-	IndexType:          index.BTree,
-	MMapAtStartUp:      true,
-	DataFileMergeRatio: 0.5,
+	DirPath:              "D:\\git_space\\lovedb\\tmp",
+	DataFileSize:         256 * 1024 * 1024, //256MB
+	SyncWrite:            false,
+	BytesPerSync:         0,
+	IndexType:            index.BTree,
+	MMapAtStartUp:        true,
+	DataFileMergeRatio:   0.5,
+	DirectIO:             false,
+	PreAllocate:          false,
+	WriteBufferSize:      0,
+	InMemory:             false,
+	ValueCacheSize:       0,
+	ValueChunkSize:       1024 * 1024, //1MB
+	Checksum:             data.ChecksumCRC32C,
+	SkipChecksumOnRead:   false,
+	IndexLoadParallelism: runtime.NumCPU(),
+	IndexCheckpoint:      true,
 }
 
 var DefaultIteratorOptions = IteratorOptions{
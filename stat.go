@@ -0,0 +1,244 @@
+package lovedb
+
+import (
+	"io"
+	"lovedb/data"
+	"math/bits"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// 估算内存索引大小时每个key除了key本身以外的开销，包括索引节点、LogRecordPos以及指针
+const indexEntryOverhead = 64
+
+// 估算value大小时使用的记录header大小，v2格式的header是变长的，普通记录一般在20字节左右
+const estimatedRecordHeaderSize = 20
+
+// OpStat 数据库打开以后各种操作的累计次数
+type OpStat struct {
+	Puts          uint64        //Put的次数，包括WriteBatch中的Put
+	Gets          uint64        //Get的次数
+	Deletes       uint64        //Delete的次数，包括WriteBatch中的Delete
+	Iterators     uint64        //创建迭代器的次数
+	BytesWritten  uint64        //写入数据文件的字节数
+	SyncCount     uint64        //数据文件持久化的次数
+	SyncTotalTime time.Duration //持久化的总耗时
+	SyncMaxTime   time.Duration //单次持久化的最大耗时
+}
+
+// MergeStat 最近一次merge的结果
+type MergeStat struct {
+	Time     time.Time     //开始的时间
+	Duration time.Duration //耗时
+	Err      string        //失败时的错误信息，成功时为空
+}
+
+// DataFileStat 单个数据文件的统计信息
+type DataFileStat struct {
+	Fid        uint32
+	Size       int64 //文件中数据的大小，不包括预分配的空间
+	LiveBytes  int64 //索引仍然指向的记录的大小
+	DeadBytes  int64 //可以被merge回收的大小
+	Records    int64 //记录的数量，包括删除记录，不包括事务结束记录和value分块
+	Tombstones int64 //删除记录的数量
+}
+
+// SizeHistogram 大小的直方图，第i个桶统计二进制位数为i的大小，即[2^(i-1), 2^i)，第0个桶统计大小为0
+type SizeHistogram struct {
+	Buckets [33]uint64
+	Count   uint64
+	Sum     uint64
+	Max     uint64
+}
+
+// DetailedStat 详细的统计信息，需要遍历整个索引，旧的数据文件第一次统计时需要读取整个文件
+type DetailedStat struct {
+	Stat
+	DataFiles  []DataFileStat //按照文件id从小到大排列
+	KeySizes   SizeHistogram  //所有有效key的大小
+	ValueSizes SizeHistogram  //所有有效value的大小，根据记录大小估算
+	Tombstones int64          //数据文件中删除记录的总数
+}
+
+// 数据库内部的操作计数，都是原子操作，读写时不需要持有db的锁
+type opCounters struct {
+	puts         atomic.Uint64
+	gets         atomic.Uint64
+	deletes      atomic.Uint64
+	iterators    atomic.Uint64
+	bytesWritten atomic.Uint64
+	syncCount    atomic.Uint64
+	syncNanos    atomic.Int64
+	syncMaxNanos atomic.Int64
+}
+
+// 数据文件中已经统计过的记录，end之前的部分已经读取过
+type fileRecordStat struct {
+	end        int64
+	records    int64
+	tombstones int64
+}
+
+func (c *opCounters) snapshot() OpStat {
+	return OpStat{
+		Puts:          c.puts.Load(),
+		Gets:          c.gets.Load(),
+		Deletes:       c.deletes.Load(),
+		Iterators:     c.iterators.Load(),
+		BytesWritten:  c.bytesWritten.Load(),
+		SyncCount:     c.syncCount.Load(),
+		SyncTotalTime: time.Duration(c.syncNanos.Load()),
+		SyncMaxTime:   time.Duration(c.syncMaxNanos.Load()),
+	}
+}
+
+// 记录一次持久化的耗时
+func (c *opCounters) addSync(d time.Duration) {
+	c.syncCount.Add(1)
+	c.syncNanos.Add(int64(d))
+	for {
+		cur := c.syncMaxNanos.Load()
+		if int64(d) <= cur || c.syncMaxNanos.CompareAndSwap(cur, int64(d)) {
+			return
+		}
+	}
+}
+
+// Mean 平均大小，没有数据时为0
+func (h *SizeHistogram) Mean() float64 {
+	if h.Count == 0 {
+		return 0
+	}
+	return float64(h.Sum) / float64(h.Count)
+}
+
+func (h *SizeHistogram) add(size uint64) {
+	h.Buckets[bits.Len64(size)]++
+	h.Count++
+	h.Sum += size
+	if size > h.Max {
+		h.Max = size
+	}
+}
+
+// 持久化数据文件并记录耗时
+func (db *DB) syncDataFile(dataFile *data.DataFile) error {
+	start := time.Now()
+	err := dataFile.Sync()
+	db.ops.addSync(time.Since(start))
+	db.metrics.sync.observe(start, err)
+	db.events.OnSyncCompleted(SyncInfo{FileId: dataFile.FileId, Duration: time.Since(start), Err: err})
+	return err
+}
+
+// DetailedStat 返回详细的统计信息，包括每个数据文件的有效和无效数据量、key和value大小的分布
+// 统计期间持有读锁，会阻塞写入
+func (db *DB) DetailedStat() (*DetailedStat, error) {
+	stat, err := db.Stat()
+	if err != nil {
+		return nil, err
+	}
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	detailed := &DetailedStat{Stat: *stat}
+	liveBytes := make(map[uint32]int64)
+	var keyBytes int64
+	it := db.index.Iterator(false)
+	for it.Rewind(); it.Valid(); it.Next() {
+		key, pos := it.Key(), it.Value()
+		liveBytes[pos.Fid] += int64(pos.Size)
+		keyBytes += int64(len(key))
+		detailed.KeySizes.add(uint64(len(key)))
+		//value的大小没有记录在索引中，用记录的大小减去key和header估算
+		valueSize := int64(pos.Size) - int64(len(key)) - estimatedRecordHeaderSize
+		if valueSize < 0 {
+			valueSize = 0
+		}
+		detailed.ValueSizes.add(uint64(valueSize))
+	}
+	it.Close()
+	//索引不支持统计内存时根据key的大小估算
+	if detailed.IndexMemory == 0 && detailed.KeyNum > 0 {
+		detailed.IndexMemory = keyBytes + int64(detailed.KeyNum)*indexEntryOverhead
+		detailed.IndexMemoryPerKey = float64(detailed.IndexMemory) / float64(detailed.KeyNum)
+	}
+
+	files := make([]*data.DataFile, 0, len(db.olderFiles)+1)
+	for _, file := range db.olderFiles {
+		files = append(files, file)
+	}
+	if db.activeFile != nil {
+		files = append(files, db.activeFile)
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].FileId < files[j].FileId
+	})
+	records, err := db.fileRecordStats(files)
+	if err != nil {
+		return nil, err
+	}
+	for i, file := range files {
+		fileStat := DataFileStat{
+			Fid:        file.FileId,
+			Size:       records[i].end,
+			LiveBytes:  liveBytes[file.FileId],
+			Records:    records[i].records,
+			Tombstones: records[i].tombstones,
+		}
+		fileStat.DeadBytes = fileStat.Size - file.HeaderSize() - fileStat.LiveBytes
+		if fileStat.DeadBytes < 0 {
+			fileStat.DeadBytes = 0
+		}
+		detailed.DataFiles = append(detailed.DataFiles, fileStat)
+		detailed.Tombstones += fileStat.Tombstones
+	}
+	return detailed, nil
+}
+
+// 统计数据文件中的记录数量，需要持有读锁
+// 每个文件已经统计过的部分会保存下来，旧的数据文件不会再变化，活跃文件只需要读取新写入的部分
+func (db *DB) fileRecordStats(files []*data.DataFile) ([]fileRecordStat, error) {
+	db.statMu.Lock()
+	defer db.statMu.Unlock()
+
+	current := make(map[*data.DataFile]*fileRecordStat, len(files))
+	stats := make([]fileRecordStat, 0, len(files))
+	for _, file := range files {
+		stat, ok := db.fileRecords[file]
+		if !ok {
+			stat = &fileRecordStat{end: file.HeaderSize()}
+		}
+		if err := db.scanFileRecords(file, stat); err != nil {
+			return nil, err
+		}
+		current[file] = stat
+		stats = append(stats, *stat)
+	}
+	//merge以后已经关闭的文件不再保留
+	db.fileRecords = current
+	return stats, nil
+}
+
+// 从stat.end开始读取数据文件中的记录，活跃文件读取到WriteOff为止
+func (db *DB) scanFileRecords(file *data.DataFile, stat *fileRecordStat) error {
+	for file != db.activeFile || stat.end < file.WriteOff {
+		logRecord, size, err := file.ReadLogRecordNoVerify(stat.end)
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		switch logRecord.Type {
+		case data.LogRecordNormal:
+			stat.records++
+		case data.LogRecordDeleted:
+			stat.records++
+			stat.tombstones++
+		}
+		stat.end += size
+	}
+	return nil
+}
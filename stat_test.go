@@ -0,0 +1,108 @@
+package lovedb
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestDB_Stat(t *testing.T) {
+	t.Parallel()
+	db, _ := openInMemoryDB(t)
+	defer func() {
+		assert.Nil(t, db.Close())
+	}()
+
+	for i := 0; i < 1000; i++ {
+		assert.Nil(t, db.Put(testKey(i), testValue(i)))
+	}
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, db.Delete(testKey(i)))
+		_, err := db.Get(testKey(i + 100))
+		assert.Nil(t, err)
+	}
+	wb := db.NewWriteBatch(DefaultWriteBatchOptions)
+	assert.Nil(t, wb.Put(testKey(2000), testValue(2000)))
+	assert.Nil(t, wb.Delete(testKey(100)))
+	assert.Nil(t, wb.Commit())
+	db.NewIterator(DefaultIteratorOptions).Close()
+	assert.Nil(t, db.Sync())
+
+	stat, err := db.Stat()
+	assert.Nil(t, err)
+	assert.Equal(t, uint(900), stat.KeyNum)
+	assert.Equal(t, uint64(1001), stat.Ops.Puts)
+	assert.Equal(t, uint64(101), stat.Ops.Deletes)
+	assert.Equal(t, uint64(100), stat.Ops.Gets)
+	assert.Equal(t, uint64(1), stat.Ops.Iterators)
+	assert.True(t, stat.Ops.SyncCount > 0)
+	assert.True(t, stat.Ops.SyncMaxTime <= stat.Ops.SyncTotalTime)
+	var written int64
+	for _, file := range db.olderFiles {
+		written += file.WriteOff - file.HeaderSize()
+	}
+	written += db.activeFile.WriteOff - db.activeFile.HeaderSize()
+	assert.Equal(t, uint64(written), stat.Ops.BytesWritten)
+	assert.Nil(t, stat.LastMerge)
+
+	assert.Nil(t, db.Merge())
+	stat, err = db.Stat()
+	assert.Nil(t, err)
+	assert.NotNil(t, stat.LastMerge)
+	assert.Equal(t, "", stat.LastMerge.Err)
+	assert.False(t, stat.LastMerge.Time.IsZero())
+}
+
+func TestDB_DetailedStat(t *testing.T) {
+	t.Parallel()
+	db, _ := openInMemoryDB(t)
+	defer func() {
+		assert.Nil(t, db.Close())
+	}()
+
+	detailed, err := db.DetailedStat()
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(detailed.DataFiles))
+	assert.Equal(t, uint64(0), detailed.KeySizes.Count)
+
+	for i := 0; i < 2000; i++ {
+		assert.Nil(t, db.Put(testKey(i), testValue(i)))
+	}
+	for i := 0; i < 500; i++ {
+		assert.Nil(t, db.Delete(testKey(i)))
+	}
+	detailed, err = db.DetailedStat()
+	assert.Nil(t, err)
+	assert.True(t, len(detailed.DataFiles) > 1)
+	assert.Equal(t, int64(500), detailed.Tombstones)
+	assert.Equal(t, uint64(1500), detailed.KeySizes.Count)
+	assert.Equal(t, uint64(len(testKey(0))), detailed.KeySizes.Max)
+	assert.Equal(t, uint64(1500), detailed.KeySizes.Buckets[5])
+	assert.Equal(t, uint64(1500), detailed.ValueSizes.Count)
+	assert.True(t, detailed.ValueSizes.Mean() > 0)
+	assert.True(t, detailed.IndexMemory > 0)
+
+	var records, live, dead int64
+	for i, file := range detailed.DataFiles {
+		if i > 0 {
+			assert.True(t, file.Fid > detailed.DataFiles[i-1].Fid)
+		}
+		records += file.Records
+		live += file.LiveBytes
+		dead += file.DeadBytes
+	}
+	assert.Equal(t, int64(2500), records)
+	assert.Equal(t, db.reclaimSize, dead)
+
+	//活跃文件只统计新写入的记录
+	for i := 2000; i < 2100; i++ {
+		assert.Nil(t, db.Put(testKey(i), testValue(i)))
+	}
+	detailed, err = db.DetailedStat()
+	assert.Nil(t, err)
+	records = 0
+	for _, file := range detailed.DataFiles {
+		records += file.Records
+	}
+	assert.Equal(t, int64(2600), records)
+	assert.Equal(t, uint64(1600), detailed.KeySizes.Count)
+}
@@ -0,0 +1,303 @@
+package lovedb
+
+import (
+	"bytes"
+	"io"
+	"lovedb/data"
+	"sync"
+	"time"
+)
+
+// PutReader 从r中读取size字节作为key的value写入，value不需要完整地放在内存中
+// 超过ValueChunkSize的value分块写入，每一块是一条chunk记录，全部写完以后再写一条分块清单记录，
+// 清单记录就是提交点，类似批量写入的fin记录：清单写入之前崩溃，已经写入的分块都不会生效
+// 每一块都在锁外从r中读取，读取慢不会阻塞其他读写；写入期间merge会等待清单写完再开始，不会回收已经写入的分块
+// 和Put一样计入写入次数和耗时，不超过一块的value在Put中统计
+func (db *DB) PutReader(key []byte, r io.Reader, size int64) (err error) {
+	if len(key) == 0 {
+		return ErrKeyIsEmpty
+	}
+	if size < 0 {
+		return ErrInvalidValueSize
+	}
+	chunkSize := db.options.ValueChunkSize
+
+	//不超过一块的value直接写成普通记录
+	if size <= chunkSize {
+		value := make([]byte, size)
+		if _, err := io.ReadFull(r, value); err != nil {
+			return readSizeError(err)
+		}
+		return db.Put(key, value)
+	}
+	db.ops.puts.Add(1)
+	start := time.Now()
+	defer func() {
+		db.metrics.put.observe(start, err)
+	}()
+
+	db.beginStream()
+	defer db.endStream()
+
+	chunked := &data.ChunkedValue{Size: size, ChunkSize: chunkSize}
+	//已经写入的分块不会被引用，可以直接回收
+	discardChunks := func() {
+		db.mu.Lock()
+		defer db.mu.Unlock()
+		for _, pos := range chunked.Chunks {
+			db.reclaimSize += int64(pos.Size)
+		}
+	}
+	buf := make([]byte, chunkSize)
+	for remaining := size; remaining > 0; {
+		n := chunkSize
+		if remaining < n {
+			n = remaining
+		}
+		var err error
+		if _, err = io.ReadFull(r, buf[:n]); err == nil {
+			var pos *data.LogRecordPos
+			pos, err = db.appendLogRecordWithLock(&data.LogRecord{
+				Key:   key,
+				Value: buf[:n],
+				Type:  data.LogRecordChunk,
+				SeqNo: nonTxSeqNo,
+			})
+			if err == nil {
+				chunked.Chunks = append(chunked.Chunks, pos)
+			}
+		}
+		if err != nil {
+			discardChunks()
+			return readSizeError(err)
+		}
+		remaining -= n
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	//写入分块清单，提交整个value
+	pos, err := db.appendLogRecord(&data.LogRecord{
+		Key:   key,
+		Value: data.EncodeChunkedValue(chunked),
+		Type:  data.LogRecordNormal,
+		Flags: data.LogRecordFlagChunked,
+		SeqNo: nonTxSeqNo,
+	})
+	if err != nil {
+		for _, pos := range chunked.Chunks {
+			db.reclaimSize += int64(pos.Size)
+		}
+		return err
+	}
+	pos.Size = chunked.DiskSize(int64(pos.Size))
+
+	if oldPos := db.index.Put(key, pos); oldPos != nil {
+		db.reclaimSize += int64(oldPos.Size)
+		db.removeCache(oldPos)
+	}
+	return nil
+}
+
+// 开始分块写入，merge正在等待已有的分块写入结束时先等它切换完活跃文件
+func (db *DB) beginStream() {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	for db.mergeWaitStreams {
+		db.streamCond.Wait()
+	}
+	db.inflightStreams++
+}
+
+// 分块写入结束，清单已经写入或者放弃写入，唤醒等待的merge
+func (db *DB) endStream() {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.inflightStreams--
+	if db.inflightStreams == 0 {
+		db.streamCond.Broadcast()
+	}
+}
+
+// 数据不够size个字节时，ReadFull在一个字节都没读到的情况下返回的是io.EOF，统一成io.ErrUnexpectedEOF
+func readSizeError(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// GetReader 获取key的value，分块存储的value在读取时才逐块从文件中读取
+// 和Get一样计入读取次数，耗时只包括读取分块清单，不包括之后逐块读取
+func (db *DB) GetReader(key []byte) (_ io.ReadCloser, err error) {
+	db.ops.gets.Add(1)
+	start := time.Now()
+	defer func() {
+		db.observeGet(start, err)
+	}()
+	if len(key) == 0 {
+		return nil, ErrKeyIsEmpty
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	chunked, value, err := db.getChunkedValue(key)
+	if err != nil {
+		return nil, err
+	}
+	if chunked == nil {
+		return io.NopCloser(bytes.NewReader(value)), nil
+	}
+	return &chunkReader{mu: new(sync.Mutex), db: db, chunked: chunked}, nil
+}
+
+// GetRange 读取key的value中从offset开始的length个字节，超过value末尾的部分不返回
+// 分块存储的value只读取需要的分块，和Get一样计入读取次数和耗时
+func (db *DB) GetRange(key []byte, offset, length int64) (_ []byte, err error) {
+	db.ops.gets.Add(1)
+	start := time.Now()
+	defer func() {
+		db.observeGet(start, err)
+	}()
+	if len(key) == 0 {
+		return nil, ErrKeyIsEmpty
+	}
+	if offset < 0 || length < 0 {
+		return nil, ErrInvalidRange
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	chunked, value, err := db.getChunkedValue(key)
+	if err != nil {
+		return nil, err
+	}
+	if chunked == nil {
+		if offset > int64(len(value)) {
+			return nil, ErrInvalidRange
+		}
+		end := offset + length
+		if end > int64(len(value)) {
+			end = int64(len(value))
+		}
+		return value[offset:end], nil
+	}
+
+	if offset > chunked.Size {
+		return nil, ErrInvalidRange
+	}
+	end := offset + length
+	if end > chunked.Size {
+		end = chunked.Size
+	}
+	result := make([]byte, 0, end-offset)
+	for off := offset; off < end; {
+		idx := off / chunked.ChunkSize
+		chunk, err := db.readChunk(chunked.Chunks[idx])
+		if err != nil {
+			return nil, err
+		}
+		chunkStart := idx * chunked.ChunkSize
+		chunkEnd := end - chunkStart
+		if chunkEnd > int64(len(chunk)) {
+			chunkEnd = int64(len(chunk))
+		}
+		result = append(result, chunk[off-chunkStart:chunkEnd]...)
+		off = chunkStart + chunkEnd
+	}
+	return result, nil
+}
+
+// 获取key的分块清单，不是分块存储的value直接返回value，需要在持有锁的情况下调用
+func (db *DB) getChunkedValue(key []byte) (*data.ChunkedValue, []byte, error) {
+	logRecordPos := db.index.Get(key)
+	if logRecordPos == nil {
+		return nil, nil, ErrKeyNotFound
+	}
+	logRecord, err := db.readLogRecordAt(logRecordPos)
+	if err != nil {
+		return nil, nil, err
+	}
+	if logRecord.Type == data.LogRecordDeleted {
+		return nil, nil, ErrKeyNotFound
+	}
+	if logRecord.Flags&data.LogRecordFlagChunked == 0 {
+		return nil, logRecord.Value, nil
+	}
+	chunked, err := data.DecodeChunkedValue(logRecord.Value)
+	if err != nil {
+		return nil, nil, err
+	}
+	return chunked, nil, nil
+}
+
+// 读取所有的分块拼成完整的value，需要在持有锁的情况下调用
+func (db *DB) readChunkedValue(manifest []byte) ([]byte, error) {
+	chunked, err := data.DecodeChunkedValue(manifest)
+	if err != nil {
+		return nil, err
+	}
+	value := make([]byte, 0, chunked.Size)
+	for _, pos := range chunked.Chunks {
+		chunk, err := db.readChunk(pos)
+		if err != nil {
+			return nil, err
+		}
+		value = append(value, chunk...)
+	}
+	return value, nil
+}
+
+// 读取一个分块，需要在持有锁的情况下调用
+func (db *DB) readChunk(pos *data.LogRecordPos) ([]byte, error) {
+	logRecord, err := db.readLogRecordAt(pos)
+	if err != nil {
+		return nil, err
+	}
+	if logRecord.Type != data.LogRecordChunk {
+		return nil, data.ErrInvalidChunkedValue
+	}
+	return logRecord.Value, nil
+}
+
+// 按顺序逐块读取分块存储的value
+type chunkReader struct {
+	mu      *sync.Mutex
+	db      *DB
+	chunked *data.ChunkedValue
+	next    int    //下一个要读取的分块
+	buf     []byte //当前分块中还没有读取的数据
+	closed  bool
+}
+
+func (cr *chunkReader) Read(p []byte) (int, error) {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	if cr.closed {
+		return 0, io.ErrClosedPipe
+	}
+	for len(cr.buf) == 0 {
+		if cr.next >= len(cr.chunked.Chunks) {
+			return 0, io.EOF
+		}
+		cr.db.mu.RLock()
+		chunk, err := cr.db.readChunk(cr.chunked.Chunks[cr.next])
+		cr.db.mu.RUnlock()
+		if err != nil {
+			return 0, err
+		}
+		cr.buf = chunk
+		cr.next++
+	}
+	n := copy(p, cr.buf)
+	cr.buf = cr.buf[n:]
+	return n, nil
+}
+
+func (cr *chunkReader) Close() error {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	cr.closed = true
+	cr.buf = nil
+	return nil
+}
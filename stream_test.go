@@ -0,0 +1,216 @@
+package lovedb
+
+import (
+	"bytes"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestDB_PutReader(t *testing.T) {
+	t.Parallel()
+	db, opts := openInMemoryDB(t)
+	assert.Nil(t, db.Close())
+	opts.ValueChunkSize = 1000
+	db, err := Open(opts)
+	assert.Nil(t, err)
+
+	bigValue := make([]byte, 100*1000+123)
+	for i := range bigValue {
+		bigValue[i] = byte(i % 251)
+	}
+	assert.Nil(t, db.PutReader([]byte("big"), bytes.NewReader(bigValue), int64(len(bigValue))))
+	//不超过一块的value是普通记录
+	assert.Nil(t, db.PutReader([]byte("small"), bytes.NewReader([]byte("small-value")), 11))
+
+	check := func(db *DB) {
+		val, err := db.Get([]byte("big"))
+		assert.Nil(t, err)
+		assert.Equal(t, bigValue, val)
+
+		r, err := db.GetReader([]byte("big"))
+		assert.Nil(t, err)
+		val, err = io.ReadAll(r)
+		assert.Nil(t, err)
+		assert.Equal(t, bigValue, val)
+		assert.Nil(t, r.Close())
+
+		//跨越多个分块的范围
+		val, err = db.GetRange([]byte("big"), 1500, 2000)
+		assert.Nil(t, err)
+		assert.Equal(t, bigValue[1500:3500], val)
+		//超过末尾的部分不返回
+		val, err = db.GetRange([]byte("big"), int64(len(bigValue))-10, 100)
+		assert.Nil(t, err)
+		assert.Equal(t, bigValue[len(bigValue)-10:], val)
+		_, err = db.GetRange([]byte("big"), int64(len(bigValue))+1, 1)
+		assert.Equal(t, ErrInvalidRange, err)
+
+		val, err = db.GetRange([]byte("small"), 6, 100)
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("value"), val)
+	}
+	check(db)
+
+	//数据不够时写入失败，key不可见
+	err = db.PutReader([]byte("short"), bytes.NewReader(bigValue[:5000]), 10000)
+	assert.True(t, errors.Is(err, io.ErrUnexpectedEOF))
+	_, err = db.Get([]byte("short"))
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	//重新打开
+	assert.Nil(t, db.Close())
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	check(db)
+	_, err = db.Get([]byte("short"))
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	//merge之后分块跟着清单一起移动
+	for i := 0; i < 1000; i++ {
+		assert.Nil(t, db.Put(testKey(i), testValue(i)))
+		assert.Nil(t, db.Delete(testKey(i)))
+	}
+	assert.Nil(t, db.Merge())
+	assert.Nil(t, db.Close())
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	check(db)
+	assert.Nil(t, db.Verify())
+	assert.Nil(t, db.Close())
+}
+
+// 读取到pause个字节以后阻塞，直到resume被关闭
+type pausingReader struct {
+	r      io.Reader
+	pause  int
+	paused chan struct{}
+	resume chan struct{}
+}
+
+func (p *pausingReader) Read(buf []byte) (int, error) {
+	if p.pause == 0 {
+		if p.paused != nil {
+			close(p.paused)
+			p.paused = nil
+			<-p.resume
+		}
+		return p.r.Read(buf)
+	}
+	if len(buf) > p.pause {
+		buf = buf[:p.pause]
+	}
+	n, err := p.r.Read(buf)
+	p.pause -= n
+	return n, err
+}
+
+func TestDB_PutReader_SlowReader(t *testing.T) {
+	t.Parallel()
+	db, opts := openInMemoryDB(t)
+	assert.Nil(t, db.Close())
+	opts.ValueChunkSize = 1000
+	db, err := Open(opts)
+	assert.Nil(t, err)
+
+	for i := 0; i < 1000; i++ {
+		assert.Nil(t, db.Put(testKey(i), testValue(i)))
+	}
+	bigValue := make([]byte, 50*1000)
+	for i := range bigValue {
+		bigValue[i] = byte(i % 251)
+	}
+	r := &pausingReader{
+		r:      bytes.NewReader(bigValue),
+		pause:  20 * 1000,
+		paused: make(chan struct{}),
+		resume: make(chan struct{}),
+	}
+	paused := r.paused
+	putDone := make(chan error)
+	go func() {
+		putDone <- db.PutReader([]byte("big"), r, int64(len(bigValue)))
+	}()
+	<-paused
+
+	//读取value的过程中不持有锁，其他读写不会被阻塞
+	val, err := db.Get(testKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, testValue(1), val)
+	assert.Nil(t, db.Put(testKey(1000), testValue(1000)))
+
+	//merge等待分块写入结束，不会回收已经写入的分块
+	mergeDone := make(chan error)
+	go func() {
+		mergeDone <- db.Merge()
+	}()
+	assert.Eventually(t, func() bool {
+		db.mu.RLock()
+		defer db.mu.RUnlock()
+		return db.mergeWaitStreams
+	}, time.Second, time.Millisecond)
+	close(r.resume)
+	assert.Nil(t, <-putDone)
+	assert.Nil(t, <-mergeDone)
+
+	assert.Nil(t, db.Close())
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	val, err = db.Get([]byte("big"))
+	assert.Nil(t, err)
+	assert.Equal(t, bigValue, val)
+	assert.Nil(t, db.Verify())
+	assert.Nil(t, db.Close())
+}
+
+func TestDB_PutReader_ZeroChunkSize(t *testing.T) {
+	t.Parallel()
+	db, opts := openInMemoryDB(t)
+	assert.Nil(t, db.Close())
+	//没有设置分块大小时使用默认值
+	opts.ValueChunkSize = 0
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, DefaultOptions.ValueChunkSize, db.options.ValueChunkSize)
+	value := bytes.Repeat([]byte("v"), 100)
+	assert.Nil(t, db.PutReader([]byte("key"), bytes.NewReader(value), int64(len(value))))
+	assert.Nil(t, db.Close())
+
+	opts.ValueChunkSize = -1
+	_, err = Open(opts)
+	assert.NotNil(t, err)
+}
+
+func TestDB_PutReader_Stats(t *testing.T) {
+	t.Parallel()
+	db, opts := openInMemoryDB(t)
+	assert.Nil(t, db.Close())
+	opts.ValueChunkSize = 1000
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	defer func() {
+		assert.Nil(t, db.Close())
+	}()
+
+	//分块写入和不超过一块的写入都只计一次
+	bigValue := make([]byte, 10*1000+1)
+	assert.Nil(t, db.PutReader([]byte("big"), bytes.NewReader(bigValue), int64(len(bigValue))))
+	assert.Nil(t, db.PutReader([]byte("small"), bytes.NewReader([]byte("small-value")), 11))
+	r, err := db.GetReader([]byte("big"))
+	assert.Nil(t, err)
+	assert.Nil(t, r.Close())
+	_, err = db.GetRange([]byte("big"), 10, 100)
+	assert.Nil(t, err)
+	_, err = db.GetRange([]byte("missing"), 0, 1)
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	stat, err := db.Stat()
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(2), stat.Ops.Puts)
+	assert.Equal(t, uint64(3), stat.Ops.Gets)
+	assert.Equal(t, uint64(2), db.metrics.put.total.Value())
+	assert.Equal(t, uint64(3), db.metrics.get.total.Value())
+	assert.Equal(t, uint64(0), db.metrics.get.errors.Value())
+}
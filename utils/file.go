@@ -1,6 +1,7 @@
 package utils
 
 import (
+	"context"
 	"io/fs"
 	"os"
 	"path/filepath"
@@ -53,8 +54,8 @@ func AvailableDiskSize() (uint64, error) {
 	return uint64(freeBytesAvailableToCaller), nil
 }
 
-// CopyFile 拷贝数据目录的方法
-func CopyFile(src, dest string, exclude []string) error {
+// CopyFile 拷贝数据目录的方法，每拷贝一个文件之前检查ctx，取消时返回ctx.Err()
+func CopyFile(ctx context.Context, src, dest string, exclude []string) error {
 	//目标不存在的话就创建一个
 	if _, err := os.Stat(dest); os.IsNotExist(err) {
 		if err := os.Mkdir(dest, os.ModePerm); err != nil {
@@ -65,6 +66,9 @@ func CopyFile(src, dest string, exclude []string) error {
 	//遍历源目录
 	// tmp/a/11.data ----> /11.data
 	return filepath.Walk(src, func(path string, info fs.FileInfo, err error) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 		//将前面的路径替换为空的就变为文件名了
 		filename := strings.Replace(path, src, "", 1)
 		if filename == "" {